@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// configFilePath returns the path of the configuration file. When no
+// configuration file has been read, it is $HOME/.kaweezle.yaml.
+func configFilePath() (string, error) {
+	if path := viper.ConfigFileUsed(); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "."+commandName+".yaml"), nil
+}
+
+// saveConfigValue sets the top level key to value in the configuration
+// file. Unlike viper.WriteConfig, the other keys and the comments are kept
+// and the flags values are not saved.
+func saveConfigValue(key string, value interface{}) error {
+	path, err := configFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	document := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err = yaml.Unmarshal(data, document); err != nil {
+			return errors.Wrapf(err, "while reading configuration file %s", path)
+		}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("configuration file %s is not a map", path)
+	}
+
+	node := &yaml.Node{}
+	if err = node.Encode(value); err != nil {
+		return err
+	}
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			root.Content[i+1] = node
+			found = true
+		}
+	}
+	if !found {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+	}
+
+	if data, err = yaml.Marshal(document); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return errors.Wrapf(err, "while saving configuration file %s", path)
+	}
+	viper.Set(key, value)
+	return nil
+}
@@ -16,13 +16,18 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/Microsoft/go-winio"
 	"github.com/kaweezle/kaweezle/pkg/cluster"
 	"github.com/kaweezle/kaweezle/pkg/config"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -30,6 +35,11 @@ import (
 )
 
 var RemoveDomains bool
+
+// DomainsFromIngresses is the configure domains flag. It is not
+// ConfigurationOptions.DomainsFromIngresses, whose configuration value
+// applies to start, reset and upgrade.
+var DomainsFromIngresses bool
 var ForceDomains bool
 var RemoveRoute bool
 
@@ -82,7 +92,20 @@ func NewConfigureCommand() *cobra.Command {
 		Args:  cobra.MinimumNArgs(0),
 		Short: "Bind domain names to the cluster ingress IP address",
 		Long: `Bind domain names to the cluster ingress IP address.
-	This command will bind or remove domain names to the cluster ingress IP address.`,
+	This command will bind or remove domain names to the cluster ingress IP address.
+
+	With --from-ingresses, the domain names are the hosts of the Ingresses and
+	Gateway API HTTPRoutes of the cluster, optionally restricted with
+	--domain-suffix. The names mapped to the IP address that are no longer
+	routed by the cluster are removed, except the ones of the domain_name
+	configuration. The start, reset and upgrade commands do the same once
+	the cluster is ready with --domains-from-ingresses.
+
+	Examples:
+
+	> kaweezle configure domains argocd.localhost
+	> kaweezle configure domains --from-ingresses --domain-suffix localhost
+	`,
 		Run: performDomains,
 	}
 
@@ -133,6 +156,8 @@ This command will add the ssh hosts to the ~/.ssh/known_hosts file.`,
 	flags.StringVar(&ConfigurationOptions.PersistentIPAddress, "ip-address", ConfigurationOptions.PersistentIPAddress, "The persistent IP address to use for the WSL distribution")
 	flags.BoolVarP(&RemoveDomains, "remove", "r", false, "Remove the domain names")
 	flags.BoolVarP(&ForceDomains, "force", "f", false, "Remove the domain names")
+	flags.BoolVar(&DomainsFromIngresses, "from-ingresses", false, "Bind the hosts of the cluster Ingresses and HTTPRoutes and unbind the stale ones")
+	flags.StringArrayVar(&ConfigurationOptions.DomainSuffixes, "domain-suffix", ConfigurationOptions.DomainSuffixes, "Only bind the cluster hosts ending with this domain")
 
 	flags = routeCmd.Flags()
 	flags.BoolVarP(&RemoveRoute, "remove", "r", false, "Remove the route")
@@ -141,11 +166,14 @@ This command will add the ssh hosts to the ~/.ssh/known_hosts file.`,
 }
 
 func performConfigure(cmd *cobra.Command, args []string) {
-	status, err := cluster.GetClusterStatus(DistributionName)
+	state, err := cluster.GetClusterState(DistributionName)
 	cobra.CheckErr(err)
-	if status == cluster.Uninstalled {
+	if state.Status == cluster.Uninstalled {
 		cobra.CheckErr(fmt.Errorf("distribution %s is not installed", DistributionName))
 	}
+	if state.Phase == cluster.Stopping {
+		cobra.CheckErr(fmt.Errorf("cluster %s is stopping, retry once it is stopped", DistributionName))
+	}
 	config.Configure(DistributionName, ConfigurationOptions)
 }
 
@@ -178,6 +206,13 @@ func performKustomize(cmd *cobra.Command, args []string) {
 }
 
 func performDomains(cmd *cobra.Command, args []string) {
+	if DomainsFromIngresses {
+		if len(args) > 0 || RemoveDomains {
+			cobra.CheckErr(fmt.Errorf("--from-ingresses can't be used with domain names or --remove"))
+		}
+		cobra.CheckErr(configureIngressDomains())
+		return
+	}
 	if ForceDomains {
 		args = viper.GetStringSlice("domain_name")
 	}
@@ -187,6 +222,60 @@ func performDomains(cmd *cobra.Command, args []string) {
 	cobra.CheckErr(err)
 }
 
+// configureIngressDomains binds the hosts routed by the cluster to the
+// persistent IP address and unbinds the ones that are no longer routed.
+func configureIngressDomains() error {
+	options := ConfigurationOptions
+	client, err := k8s.NewRESTClientForDistribution(DistributionName)
+	if err != nil {
+		return err
+	}
+	restConfig, err := client.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	hosts, err := cluster.ClusterHostnames(context.Background(), clientset, dynamicClient, options.DomainSuffixes)
+	if err != nil {
+		return err
+	}
+	current, err := config.MappedDomains(options.PersistentIPAddress)
+	if err != nil {
+		return err
+	}
+	stale := cluster.StaleDomains(current, hosts, viper.GetStringSlice("domain_name"), options.DomainSuffixes)
+	if len(stale) > 0 {
+		if _, err = config.ConfigureDomains(DistributionName, options.PersistentIPAddress, stale, true); err != nil {
+			return errors.Wrap(err, "while removing stale domains")
+		}
+	}
+	if len(hosts) == 0 {
+		log.WithField("ip_address", options.PersistentIPAddress).Info("No host routed by the cluster")
+		return nil
+	}
+	_, err = config.ConfigureDomains(DistributionName, options.PersistentIPAddress, hosts, false)
+	return err
+}
+
+// configureIngressDomainsIfEnabled runs configureIngressDomains once the
+// cluster is ready when the domains come from the ingresses. Failures are
+// only reported as the cluster itself is fine.
+func configureIngressDomainsIfEnabled() {
+	if !ConfigurationOptions.DomainsFromIngresses {
+		return
+	}
+	if err := configureIngressDomains(); err != nil {
+		log.WithError(err).WithField("distrib_name", DistributionName).Warn("Domains of the cluster ingresses not configured")
+	}
+}
+
 func performElevate(cmd *cobra.Command, args []string) {
 	if !config.IsAdmin() {
 		cobra.CheckErr(fmt.Errorf("not running from an elevated prompt"))
@@ -226,12 +315,20 @@ func performElevate(cmd *cobra.Command, args []string) {
 
 }
 
-func performPrint(cmd *cobra.Command, args []string) {
+// printedConfig returns the current configuration in YAML format.
+func printedConfig() ([]byte, error) {
 	file, err := os.CreateTemp(os.Getenv("TEMP"), commandName)
-	cobra.CheckErr(err)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
 	defer os.Remove(file.Name())
 	viper.WriteConfigAs(file.Name())
-	config, err := os.ReadFile(file.Name())
+	return os.ReadFile(file.Name())
+}
+
+func performPrint(cmd *cobra.Command, args []string) {
+	config, err := printedConfig()
 	cobra.CheckErr(err)
 	fmt.Print(string(config))
 }
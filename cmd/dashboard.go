@@ -0,0 +1,148 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/pterm/pterm"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+// dashboardRefreshInterval is the interval at which the ages are redrawn.
+const dashboardRefreshInterval = time.Second
+
+// statusDashboard redraws the workloads states in place while waiting for
+// them to be ready.
+type statusDashboard struct {
+	mutex   sync.Mutex
+	history *cluster.WorkloadHistory
+	area    *pterm.AreaPrinter
+	booted  time.Time
+	ready   int
+	unready int
+	done    chan struct{}
+}
+
+// newStatusDashboard starts a dashboard. booted is the boot time of the
+// cluster, used in the final summary.
+func newStatusDashboard(booted time.Time) (*statusDashboard, error) {
+	area, err := pterm.DefaultArea.Start()
+	if err != nil {
+		return nil, err
+	}
+	d := &statusDashboard{
+		history: cluster.NewWorkloadHistory(),
+		area:    area,
+		booted:  booted,
+		done:    make(chan struct{}),
+	}
+	go d.refresh()
+	return d, nil
+}
+
+func (d *statusDashboard) refresh() {
+	ticker := time.NewTicker(dashboardRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mutex.Lock()
+			d.render()
+			d.mutex.Unlock()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// callback is the cluster.WorkloadStateCallbackFunc updating the dashboard.
+func (d *statusDashboard) callback(ok bool, count int, ready []*cluster.WorkloadState, unready []*cluster.WorkloadState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.ready, d.unready = len(ready), len(unready)
+	d.history.Update(ok, append(append([]*cluster.WorkloadState{}, ready...), unready...))
+	d.render()
+}
+
+func age(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return duration.HumanDuration(now.Sub(t))
+}
+
+// render redraws the area. It must be called with the mutex held.
+func (d *statusDashboard) render() {
+	now := time.Now()
+	data := pterm.TableData{{"", "NAMESPACE", "WORKLOAD", "AGE", "SINCE", "MESSAGE"}}
+	namespace := ""
+	for _, entry := range d.history.Entries() {
+		shown := ""
+		if entry.Namespace != namespace {
+			namespace = entry.Namespace
+			shown = namespace
+		}
+		message := entry.Message
+		if entry.Ignored {
+			message += " (ignored)"
+		}
+		row := []string{cluster.OkString(entry.Ok), shown, entry.Name, age(entry.Created, now), age(entry.Since, now), message}
+		if entry.Regressed {
+			for i := 1; i < len(row); i++ {
+				row[i] = pterm.Red(row[i])
+			}
+		}
+		data = append(data, row)
+	}
+
+	header := fmt.Sprintf("%d workloads, %d ready, %d unready, waiting for %s",
+		d.ready+d.unready, d.ready, d.unready, age(d.history.Started, now))
+	if d.history.Regressions > 0 {
+		header += pterm.Red(fmt.Sprintf(", %d regressions", d.history.Regressions))
+	}
+	table, err := pterm.DefaultTable.WithHasHeader().WithData(data).Srender()
+	if err != nil {
+		table = err.Error()
+	}
+	d.area.Update(header + "\n\n" + table)
+}
+
+// Stop stops redrawing and prints the summary.
+func (d *statusDashboard) Stop() {
+	close(d.done)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.render()
+	_ = d.area.Stop()
+
+	history := d.history
+	if history.ReadyAt.IsZero() {
+		pterm.Warning.Printfln("%d of %d workloads still unready after %s", d.unready, d.ready+d.unready, age(history.Started, time.Now()))
+	} else {
+		summary := fmt.Sprintf("🎉 All workloads (%d) ready after waiting %s", d.ready+d.unready, duration.HumanDuration(history.ReadyAt.Sub(history.Started)))
+		if !d.booted.IsZero() {
+			summary += fmt.Sprintf(", %s after boot", duration.HumanDuration(history.ReadyAt.Sub(d.booted)))
+		}
+		pterm.Success.Println(summary)
+	}
+	if history.Regressions > 0 {
+		pterm.Warning.Printfln("%d workloads became unready while waiting", history.Regressions)
+	}
+}
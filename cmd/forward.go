@@ -0,0 +1,288 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/forward"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/windows"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ForwardsKey is the configuration key of the port forwards.
+const ForwardsKey = "forwards"
+
+var ForwardFields = log.Fields{
+	logger.TaskKey: "Port forwards",
+}
+
+// NewForwardCommand creates a new forward command
+func NewForwardCommand() *cobra.Command {
+	forwardCmd := &cobra.Command{
+		Use:   "forward",
+		Short: "Manage the port forwards to the cluster services",
+		Long: `Manage persistent port forwards to the services of the cluster.
+
+	The forwards are saved in the configuration file and run by a supervisor
+	that reconnects them when the pods restart. The supervisor is started
+	in the background by the start command when forwards are configured.
+
+	Examples:
+
+	> kaweezle forward add argocd/argocd-server 8080:443
+	> kaweezle forward list
+	> kaweezle forward run
+	`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <namespace>/<service> <local-port>[:<service-port>]",
+		Args:  cobra.ExactArgs(2),
+		Short: "Add a port forward to a service",
+		Run:   performForwardAdd,
+	}
+	removeCmd := &cobra.Command{
+		Use:   "remove <namespace>/<service>|<local-port>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Remove the port forwards to a service or from a local port",
+		Run:   performForwardRemove,
+	}
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Args:  cobra.ExactArgs(0),
+		Short: "List the port forwards and their status",
+		Run:   performForwardList,
+	}
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Args:  cobra.ExactArgs(0),
+		Short: "Run the port forwards until interrupted",
+		Run:   performForwardRun,
+	}
+	stopCmd := &cobra.Command{
+		Use:   "stop",
+		Args:  cobra.ExactArgs(0),
+		Short: "Stop the port forwards supervisor running in the background",
+		Run: func(cmd *cobra.Command, args []string) {
+			cobra.CheckErr(stopForwardSupervisor())
+		},
+	}
+
+	forwardCmd.AddCommand(addCmd, removeCmd, listCmd, runCmd, stopCmd)
+	return forwardCmd
+}
+
+// configuredForwards returns the port forwards of the configuration.
+func configuredForwards() (forwards []*forward.Forward, err error) {
+	if err = viper.UnmarshalKey(ForwardsKey, &forwards); err != nil {
+		return nil, errors.Wrap(err, "while reading port forwards")
+	}
+	return forwards, forward.Validate(forwards)
+}
+
+// forwardsStateFile returns the state file of the forwards supervisor of
+// the distribution.
+func forwardsStateFile() string {
+	return filepath.Join(rootfs.HomeDir, DistributionName+"-forwards.json")
+}
+
+// runningSupervisor returns the state of the forwards supervisor, or nil if
+// none is running.
+func runningSupervisor() (*forward.State, error) {
+	state, err := forward.ReadState(forwardsStateFile())
+	if err != nil || state == nil || !state.Alive(time.Now()) {
+		return nil, err
+	}
+	return state, nil
+}
+
+func performForwardAdd(cmd *cobra.Command, args []string) {
+	added, err := forward.Parse(args[0], args[1])
+	cobra.CheckErr(err)
+	forwards, err := configuredForwards()
+	cobra.CheckErr(err)
+	forwards = append(forwards, added)
+	cobra.CheckErr(forward.Validate(forwards))
+	cobra.CheckErr(saveConfigValue(ForwardsKey, forwards))
+	log.WithFields(ForwardFields).Infof("Port forward %s added", pterm.Bold.Sprint(added))
+	if state, _ := runningSupervisor(); state != nil {
+		log.WithFields(ForwardFields).Infof("Restart the supervisor to apply: %s forward stop && %s forward run", commandName, commandName)
+	}
+}
+
+func performForwardRemove(cmd *cobra.Command, args []string) {
+	forwards, err := configuredForwards()
+	cobra.CheckErr(err)
+	port, _ := strconv.Atoi(args[0])
+	kept := make([]*forward.Forward, 0, len(forwards))
+	for _, f := range forwards {
+		if f.Target() == args[0] || f.LocalPort == port {
+			log.WithFields(ForwardFields).Infof("Port forward %s removed", pterm.Bold.Sprint(f))
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if len(kept) == len(forwards) {
+		cobra.CheckErr(fmt.Errorf("no port forward matches %s", args[0]))
+	}
+	cobra.CheckErr(saveConfigValue(ForwardsKey, kept))
+}
+
+// forwardRows returns a row for each configured forward with its status in
+// the running supervisor.
+func forwardRows(forwards []*forward.Forward) (data pterm.TableData) {
+	state, err := runningSupervisor()
+	for _, f := range forwards {
+		var message string
+		ok := false
+		switch status := stateFind(state, f); {
+		case err != nil:
+			message = err.Error()
+		case state == nil:
+			message = fmt.Sprintf("not running, use %s forward run", commandName)
+		case status == nil:
+			message = "not supervised, restart the supervisor"
+		default:
+			ok = status.Phase == forward.Forwarding
+			message = fmt.Sprintf("%s %s", status.Phase, duration.HumanDuration(time.Since(status.Since)))
+			if status.Pod != "" {
+				message += " to " + status.Pod
+			}
+			if status.Error != "" {
+				message += ": " + status.Error
+			}
+		}
+		data = append(data, []string{fmt.Sprintf("Forward localhost:%d", f.LocalPort), fmt.Sprintf("%s %s:%d %s", cluster.OkString(ok), f.Target(), f.RemotePort, message)})
+	}
+	return
+}
+
+func stateFind(state *forward.State, f *forward.Forward) *forward.Status {
+	if state == nil {
+		return nil
+	}
+	return state.Find(f)
+}
+
+func performForwardList(cmd *cobra.Command, args []string) {
+	forwards, err := configuredForwards()
+	cobra.CheckErr(err)
+	if len(forwards) == 0 {
+		log.WithFields(ForwardFields).Infof("No port forward configured, use %s forward add", commandName)
+		return
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithData(forwardRows(forwards)).Render())
+}
+
+func performForwardRun(cmd *cobra.Command, args []string) {
+	forwards, err := configuredForwards()
+	cobra.CheckErr(err)
+	if len(forwards) == 0 {
+		cobra.CheckErr(fmt.Errorf("no port forward configured, use %s forward add", commandName))
+	}
+	if state, _ := runningSupervisor(); state != nil {
+		cobra.CheckErr(fmt.Errorf("port forwards already run by process %d", state.PID))
+	}
+	runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
+
+	client, err := k8s.NewRESTClientForDistribution(DistributionName)
+	cobra.CheckErr(err)
+	config, err := client.ToRESTConfig()
+	cobra.CheckErr(err)
+	clientset, err := kubernetes.NewForConfig(config)
+	cobra.CheckErr(err)
+	cobra.CheckErr(rootfs.EnsureHomeDir(rootfs.HomeDir))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.WithFields(ForwardFields).Infof("Running %d port forwards, press Ctrl+C to stop", len(forwards))
+	supervisor := forward.NewSupervisor(clientset, forward.SPDYForwardFunc(config, clientset), forwardsStateFile())
+	cobra.CheckErr(supervisor.Run(ctx, forwards))
+}
+
+// startForwardSupervisor runs the forwards supervisor in a detached process
+// if forwards are configured and no supervisor is running.
+func startForwardSupervisor() error {
+	forwards, err := configuredForwards()
+	if err != nil || len(forwards) == 0 {
+		return err
+	}
+	if state, _ := runningSupervisor(); state != nil {
+		return nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err = rootfs.EnsureHomeDir(rootfs.HomeDir); err != nil {
+		return err
+	}
+	logFile := filepath.Join(rootfs.HomeDir, DistributionName+"-forwards.log")
+	args := []string{"forward", "run", "--name", DistributionName, "--logfile", logFile}
+	if cfgFile != "" {
+		args = append(args, "--config", cfgFile)
+	}
+	supervisor := exec.Command(executable, args...)
+	supervisor.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+	if err = supervisor.Start(); err != nil {
+		return errors.Wrap(err, "while starting the port forwards supervisor")
+	}
+	log.WithFields(ForwardFields).WithField("log_file", logFile).Infof("%d port forwards started in the background", len(forwards))
+	return supervisor.Process.Release()
+}
+
+// stopForwardSupervisor stops the forwards supervisor running in the
+// background, if any.
+func stopForwardSupervisor() error {
+	state, err := runningSupervisor()
+	if err != nil || state == nil {
+		return err
+	}
+	process, err := os.FindProcess(state.PID)
+	if err == nil {
+		err = process.Kill()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while stopping the port forwards supervisor %d", state.PID)
+	}
+	// Killed processes can't remove their state
+	_ = os.Remove(forwardsStateFile())
+	log.WithFields(ForwardFields).Info("Port forwards stopped")
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// NewHealthCommand creates a new health command
+func NewHealthCommand() *cobra.Command {
+	healthCmd := &cobra.Command{
+		Use:   "health",
+		Short: "Manage the health rules of custom resources",
+		Long: `Manage the health rules defined in the readiness.rules section of the
+	configuration. Each rule gives the group and kind of a custom resource along
+	with either a JSONPath or a CEL expression telling if it is healthy:
+
+	readiness:
+	  rules:
+	    - group: example.com
+	      kind: Widget
+	      jsonPath: '{.status.phase}'
+	      value: Running
+	      message: 'widget is {.status.phase}'
+	    - group: example.com
+	      kind: Gadget
+	      cel: object.status.readyReplicas == object.spec.replicas
+
+	The JSONPath result is compared to value (True by default). The CEL
+	expression must return a boolean and receives the resource as object. The
+	optional message is a JSONPath template.`,
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Args:  cobra.ExactArgs(0),
+		Short: "Validate the health rules of the configuration",
+		Long:  `Compile the health rules of the configuration and report the invalid ones.`,
+		Run:   performHealthValidate,
+	}
+
+	healthCmd.AddCommand(validateCmd)
+	return healthCmd
+}
+
+func performHealthValidate(cmd *cobra.Command, args []string) {
+	rules, err := healthRules()
+	cobra.CheckErr(err)
+	if len(rules) == 0 {
+		pterm.Info.Println("No health rules defined.")
+		return
+	}
+
+	data := pterm.TableData{{"", "KIND", "EXPRESSION", "ERROR"}}
+	kinds := make(map[string]bool, len(rules))
+	invalid := 0
+	for _, rule := range rules {
+		_, err := cluster.NewRuleStatusViewer(rule)
+		if err == nil && kinds[rule.String()] {
+			err = fmt.Errorf("duplicate health rule %s", rule)
+		}
+		kinds[rule.String()] = true
+		message := ""
+		if err != nil {
+			invalid++
+			message = err.Error()
+		}
+		data = append(data, []string{cluster.OkString(err == nil), rule.String(), rule.Expression(), message})
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+	if invalid > 0 {
+		cobra.CheckErr(fmt.Errorf("%d invalid health rules out of %d", invalid, len(rules)))
+	}
+}
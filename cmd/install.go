@@ -31,10 +31,12 @@ func NewInstallCommand() *cobra.Command {
 	Examples:
 	
 	> kaweezle install --root rootfs.tar.gz
+	> kaweezle install --root oci://ghcr.io/kaweezle/iknite-rootfs:latest
 	`,
 		Run: performStart,
 	}
-	installCmd.Flags().StringVarP(&rootfs.TarFilePath, "root", "r", rootfs.DefaultTarFilePath, "The root file system to install")
+	installCmd.Flags().StringVarP(&rootfs.TarFilePath, "root", "r", "", "The root file system to install: tar.gz, tar.zst or tar.xz file, OCI layout directory or oci:// image reference (default is the current cached one)")
+	installCmd.Flags().StringVar(&RootFSVersion, "rootfs-version", RootFSVersion, "The cached root file system version to install")
 
 	return installCmd
 }
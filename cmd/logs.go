@@ -0,0 +1,264 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const DefaultLogsTail = 100
+
+var (
+	LogsTail   = DefaultLogsTail
+	LogsSince  time.Duration
+	LogsFollow bool
+	LogsRaw    bool
+
+	LogsWorkload  string
+	LogsSelector  string
+	LogsNamespace string
+	LogsContainer string
+	LogsOutput    = "text"
+)
+
+// podLogColors are the colors of the pod logs prefixes.
+var podLogColors = []pterm.Color{
+	pterm.FgCyan,
+	pterm.FgGreen,
+	pterm.FgYellow,
+	pterm.FgMagenta,
+	pterm.FgBlue,
+	pterm.FgLightCyan,
+	pterm.FgLightGreen,
+	pterm.FgLightYellow,
+	pterm.FgLightMagenta,
+	pterm.FgLightBlue,
+}
+
+// NewLogsCommand creates a new logs command
+func NewLogsCommand() *cobra.Command {
+	logsCmd := &cobra.Command{
+		Use:   "logs [source...]",
+		Short: "Show the logs of the cluster services",
+		Long: fmt.Sprintf(`Show the logs of the services running in the distribution. The sources
+	are %s. The default is %s. Example:
+
+	> kaweezle logs kubelet containerd --since 10m --follow
+
+	JSON logs are formatted like the start command output. Use --raw to get
+	the lines as they are.
+
+	With --workload or --selector, the logs of the containers of the matching
+	pods are shown instead, prefixed by the pod and container names. With
+	--follow, the pods created afterwards are also shown:
+
+	> kaweezle logs -w deploy/argocd-server --namespace argocd -f`, strings.Join(cluster.LogSourceNames(), ", "), cluster.DefaultLogSource),
+		ValidArgs: cluster.LogSourceNames(),
+		Args:      cobra.OnlyValidArgs,
+		Run:       performLogs,
+	}
+
+	flags := logsCmd.Flags()
+	flags.IntVar(&LogsTail, "tail", LogsTail, "Number of lines to show from the end of the logs (-1 for all)")
+	flags.DurationVar(&LogsSince, "since", LogsSince, "Only show the lines logged since this duration (e.g. 10m)")
+	flags.BoolVarP(&LogsFollow, "follow", "f", LogsFollow, "Keep showing the new lines")
+	flags.BoolVar(&LogsRaw, "raw", LogsRaw, "Show the lines without processing them")
+	flags.StringVarP(&LogsWorkload, "workload", "w", LogsWorkload, "Workload whose pods logs to show, as <kind>/<name> (e.g. deploy/web, sts/db, ds/agent)")
+	flags.StringVar(&LogsSelector, "selector", LogsSelector, "Label selector of the pods whose logs to show")
+	flags.StringVar(&LogsNamespace, "namespace", LogsNamespace, "Namespace of the pods (default is the one of the kubeconfig context)")
+	flags.StringVarP(&LogsContainer, "container", "c", LogsContainer, "Glob pattern of the containers whose logs to show (default all)")
+	flags.StringVarP(&LogsOutput, "output", "o", LogsOutput, "Output format of the pods logs: text or json")
+	return logsCmd
+}
+
+func performLogs(cmd *cobra.Command, args []string) {
+	status, err := cluster.GetClusterStatus(DistributionName)
+	cobra.CheckErr(err)
+	if status == cluster.Uninstalled {
+		cobra.CheckErr(fmt.Errorf("distribution %s is not installed", DistributionName))
+	}
+
+	if LogsWorkload != "" || LogsSelector != "" {
+		if len(args) > 0 {
+			cobra.CheckErr(fmt.Errorf("log sources can't be used with --workload or --selector"))
+		}
+		cobra.CheckErr(showPodLogs())
+		return
+	}
+
+	sources := args
+	if len(sources) == 0 {
+		sources = []string{cluster.DefaultLogSource}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(sources))
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			errs[i] = showLogs(source, len(sources) > 1)
+		}(i, source)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		cobra.CheckErr(err)
+	}
+}
+
+// showLogs prints the logs of source. prefix tells to prefix the raw lines
+// with the source name.
+func showLogs(source string, prefix bool) (err error) {
+	lines := LogsTail
+	if LogsSince > 0 {
+		// The whole log is needed to find the first line to show
+		lines = -1
+	}
+	var script string
+	if script, err = cluster.LogCommand(source, lines, LogsFollow); err != nil {
+		return
+	}
+
+	var commandErr error
+	reader, writer := io.Pipe()
+	go func() {
+		commandErr = wsl.WslCommandToWriter(writer, DistributionName, "/bin/sh", "-c", script)
+		writer.Close()
+	}()
+
+	var output io.Reader = reader
+	if LogsSince > 0 {
+		filtered, filteredWriter := io.Pipe()
+		since := time.Now().Add(-LogsSince)
+		go func() {
+			filteredWriter.CloseWithError(cluster.FilterSince(reader, filteredWriter, since))
+		}()
+		output = filtered
+	}
+
+	if LogsRaw {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			if prefix {
+				fmt.Printf("%-10s | %s\n", source, scanner.Text())
+			} else {
+				fmt.Println(scanner.Text())
+			}
+		}
+		err = scanner.Err()
+	} else {
+		logger.PipeLogs(output, log.Fields{"source": source})
+	}
+	// Drain the output in case the scanning stopped early
+	_, _ = io.Copy(io.Discard, output)
+
+	if err == nil && commandErr != nil {
+		err = errors.Wrapf(commandErr, "while reading %s logs", source)
+	}
+	return
+}
+
+// showPodLogs prints the logs of the pods selected by the flags.
+func showPodLogs() (err error) {
+	if LogsOutput != "text" && LogsOutput != "json" {
+		return fmt.Errorf("unknown output format %s, should be text or json", LogsOutput)
+	}
+
+	var client *k8s.RESTClientGetter
+	if client, err = k8s.NewRESTClientForDistribution(DistributionName); err != nil {
+		return
+	}
+	var config *rest.Config
+	if config, err = client.ToRESTConfig(); err != nil {
+		return
+	}
+	var clientset kubernetes.Interface
+	if clientset, err = kubernetes.NewForConfig(config); err != nil {
+		return
+	}
+
+	options := &cluster.PodLogsOptions{
+		Namespace: LogsNamespace,
+		Container: LogsContainer,
+		Since:     LogsSince,
+		Tail:      int64(LogsTail),
+		Follow:    LogsFollow,
+	}
+	if options.Namespace == "" {
+		if options.Namespace, _, err = client.ToRawKubeConfigLoader().Namespace(); err != nil {
+			return
+		}
+	}
+	if LogsSince > 0 {
+		options.Tail = -1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if LogsWorkload != "" {
+		if options.Selector, err = cluster.WorkloadPodSelector(ctx, clientset, options.Namespace, LogsWorkload); err != nil {
+			return
+		}
+	}
+	if LogsSelector != "" {
+		var selector labels.Selector
+		if selector, err = labels.Parse(LogsSelector); err != nil {
+			return errors.Wrapf(err, "bad selector %s", LogsSelector)
+		}
+		if options.Selector != nil {
+			requirements, _ := selector.Requirements()
+			selector = options.Selector.Add(requirements...)
+		}
+		options.Selector = selector
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	colors := make(map[string]pterm.Color)
+	return cluster.TailPodLogs(ctx, clientset, options, func(line *cluster.PodLogLine) {
+		if LogsOutput == "json" {
+			_ = encoder.Encode(line)
+			return
+		}
+		color, ok := colors[line.Pod]
+		if !ok {
+			color = podLogColors[len(colors)%len(podLogColors)]
+			colors[line.Pod] = color
+		}
+		fmt.Printf("%s %s\n", color.Sprintf("%s %s │", line.Pod, line.Container), line.Message)
+	})
+}
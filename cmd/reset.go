@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const DefaultResetWaitTimeout = 300
+
+var (
+	ResetWaitTimeout = DefaultResetWaitTimeout
+	KeepImages       = false
+)
+
+func NewResetCommand() *cobra.Command {
+	resetCmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Rebuild the Kubernetes cluster without reinstalling the distribution",
+		Long: `Remove the Kubernetes state of the distribution and start a new cluster.
+
+	The cluster is stopped and reset with kubeadm: the etcd data, the
+	certificates, the kubelet credentials and the CNI state are removed. The
+	keys and the configuration set by the start command are kept. The cluster
+	is then configured and started like with the start command.
+
+	The containerd images are removed unless --keep-images is given. Keeping
+	them avoids downloading them again.
+
+	Examples:
+
+	> kaweezle reset
+	> kaweezle reset --keep-images
+	`,
+		Args: cobra.ExactArgs(0),
+		Run:  performReset,
+	}
+
+	flags := resetCmd.Flags()
+	flags.BoolVar(&KeepImages, "keep-images", KeepImages, "Keep the containerd image cache")
+	flags.IntVarP(&ResetWaitTimeout, "timeout", "t", DefaultResetWaitTimeout, "The time (in seconds) to wait for the cluster to settle")
+	AddConfigurationFlags(flags, ConfigurationOptions)
+	AddWorkloadFilterFlags(flags, WorkloadFilter)
+	AddWaitFlags(flags)
+
+	return resetCmd
+}
+
+func performReset(cmd *cobra.Command, args []string) {
+	runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
+	cobra.CheckErr(cluster.ResetCluster(DistributionName, &cluster.ResetOptions{
+		KeepImages:    KeepImages,
+		LogLevel:      LogLevel,
+		Timeout:       time.Second * time.Duration(ResetWaitTimeout),
+		Filter:        workloadFilter(),
+		Configuration: ConfigurationOptions,
+	}))
+	if ResetWaitTimeout > 0 {
+		configureIngressDomainsIfEnabled()
+	}
+}
@@ -23,8 +23,10 @@ import (
 	"strings"
 
 	"github.com/kaweezle/kaweezle/pkg/config"
+	"github.com/kaweezle/kaweezle/pkg/httpclient"
 	"github.com/kaweezle/kaweezle/pkg/logger"
-	"github.com/samber/lo"
+	"github.com/kaweezle/kaweezle/pkg/release"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
@@ -62,6 +64,7 @@ kaweezle -v debug start
 		// Run: func(cmd *cobra.Command, args []string) { },
 		PersistentPostRun: func(cmd *cobra.Command, args []string) {
 			config.ReleaseElevatedClient(context.TODO())
+			noticeNewerVersion(cmd)
 		},
 	}
 
@@ -80,6 +83,17 @@ kaweezle -v debug start
 	rootCmd.AddCommand(NewUninstallCommand())
 	rootCmd.AddCommand(NewVersionCommand())
 	rootCmd.AddCommand(NewUpdateCommand())
+	rootCmd.AddCommand(NewRootFSCommand())
+	rootCmd.AddCommand(NewUpgradeCommand())
+	rootCmd.AddCommand(NewSelfUpdateCommand())
+	rootCmd.AddCommand(NewHealthCommand())
+	rootCmd.AddCommand(NewLogsCommand())
+	rootCmd.AddCommand(NewSupportBundleCommand())
+	rootCmd.AddCommand(NewResetCommand())
+	rootCmd.AddCommand(NewTopCommand())
+	rootCmd.AddCommand(NewSyncCommand())
+	rootCmd.AddCommand(NewForwardCommand())
+	rootCmd.AddCommand(NewServeMetricsCommand())
 
 	bindFlags(rootCmd, viper.GetViper())
 
@@ -105,6 +119,18 @@ func initializeRootFlags(flags *pflag.FlagSet) {
 	flags.BoolVar(&JSONLogs, "json", false, "Output JSON logs")
 	flags.StringVarP(&DistributionName, "name", "n", "kaweezle", "The name of the WSL distribution to manage")
 
+	httpOptions := httpclient.DefaultOptions
+	flags.StringVar(&httpOptions.Proxy, "http-proxy", httpOptions.Proxy, "The proxy URL to use for downloads (default from HTTP_PROXY and HTTPS_PROXY)")
+	flags.StringVar(&httpOptions.NoProxy, "no-proxy", httpOptions.NoProxy, "Comma separated list of hosts that should not go through the proxy (default from NO_PROXY)")
+	flags.StringArrayVar(&httpOptions.CAFiles, "ca-bundle", httpOptions.CAFiles, "Additional PEM CA bundle to trust for downloads")
+	flags.DurationVar(&httpOptions.Timeout, "http-timeout", httpOptions.Timeout, "Timeout for connecting and receiving response headers on downloads")
+	flags.IntVar(&httpOptions.Retries, "http-retries", httpOptions.Retries, "Number of retries of failed downloads")
+
+	flags.StringVar(&release.APIURL, "github-api-url", release.APIURL, "Base URL of the GitHub API serving the releases (for GitHub Enterprise)")
+	flags.Var(&rootfs.Channel, "channel", "Release channel of the root file system, and of kaweezle unless --self-update-channel is given (stable, prerelease or edge)")
+	flags.Var(&SelfUpdateChannel, "self-update-channel", "Release channel of kaweezle for self-update and the update notice (default is --channel)")
+	flags.BoolVar(&UpdateNotice, "update-notice", false, "Tell when a newer kaweezle version is available (checked once a day)")
+
 }
 
 // initLogging initializes logging
@@ -166,13 +192,11 @@ func bindFlag(f *pflag.Flag, v *viper.Viper) {
 
 	// Apply the viper config value to the flag when the flag is not set and viper has a value
 	if !f.Changed && v.IsSet(viperName) {
-		val := v.Get(viperName)
-
 		if vi, ok := f.Value.(pflag.SliceValue); ok {
-			stringValues, _ := lo.FromAnySlice[string](val.([]interface{}))
-			vi.Replace(stringValues)
+			// Values coming from the environment are strings, not slices
+			vi.Replace(v.GetStringSlice(viperName))
 		} else {
-			f.Value.Set(fmt.Sprintf("%v", val))
+			f.Value.Set(fmt.Sprintf("%v", v.Get(viperName)))
 		}
 	}
 }
@@ -0,0 +1,271 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kaweezle/kaweezle/pkg/config"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/pkg/errors"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	RootFSVersion = ""
+	PruneKeep     = 2
+)
+
+func NewRootFSCommand() *cobra.Command {
+	rootfsCmd := &cobra.Command{
+		Use:   "rootfs",
+		Short: "Manage the cached root file systems",
+		Long: `Manage the root file systems kept in the kaweezle cache.
+
+	Each downloaded root file system is kept in the cache, allowing to
+	install a previous version without downloading it again.`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Args:  cobra.ExactArgs(0),
+		Short: "List the cached root file systems",
+		Long:  `List the root file systems present in the cache. The current one is marked with a star.`,
+		Run:   performRootFSList,
+	}
+
+	useCmd := &cobra.Command{
+		Use:   "use [version]",
+		Args:  cobra.ExactArgs(1),
+		Short: "Select the root file system to install",
+		Long: `Select the cached root file system that will be used on the next install.
+	The version can be a release version or a checksum prefix.`,
+		Run: performRootFSUse,
+	}
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Args:  cobra.ExactArgs(0),
+		Short: "Remove old root file systems from the cache",
+		Long: `Remove the oldest root file systems from the cache. The current one is
+	always kept.`,
+		Run: performRootFSPrune,
+	}
+	pruneCmd.Flags().IntVar(&PruneKeep, "keep", PruneKeep, "The number of root file systems to keep")
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect [path]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "Show the content of a root file system",
+		Long: `Show the OS, iknite and kubernetes components versions of a root file system
+	without importing it. By default, the current cached root file system is
+	inspected.`,
+		Run: performRootFSInspect,
+	}
+
+	rootfsCmd.AddCommand(listCmd)
+	rootfsCmd.AddCommand(useCmd)
+	rootfsCmd.AddCommand(pruneCmd)
+	rootfsCmd.AddCommand(inspectCmd)
+
+	return rootfsCmd
+}
+
+func openRootFSCache() *rootfs.Cache {
+	cache, err := rootfs.OpenCache(rootfs.CacheDir)
+	cobra.CheckErr(err)
+	if len(cache.Entries) == 0 {
+		_, err = rootfs.ImportLegacyRootFS(cache, rootfs.DefaultTarFilePath)
+		cobra.CheckErr(err)
+	}
+	return cache
+}
+
+// resolveRootFS returns the path of the root file system to import. An
+// explicit --root path takes precedence. OCI images given this way are
+// flattened into the cache. Otherwise, the version referenced
+// by the configuration, or the current one, is taken from the cache. The
+// latest release is downloaded if the cache is empty. The checksum is empty
+// when the file doesn't come from the cache.
+func resolveRootFS() (path string, checksum string, err error) {
+	if rootfs.TarFilePath != "" {
+		if rootfs.IsOCISource(rootfs.TarFilePath) {
+			cache := openRootFSCache()
+			var entry *rootfs.CacheEntry
+			if entry, err = rootfs.EnsureOCIRootFS(cache, rootfs.TarFilePath, &UpdateRootFSFields); err != nil {
+				return
+			}
+			path = cache.Path(entry)
+			checksum = entry.Checksum
+			return
+		}
+		if _, err = os.Stat(rootfs.TarFilePath); os.IsNotExist(err) {
+			err = errors.Wrapf(err, "rootfs file %s does not exist", rootfs.TarFilePath)
+		}
+		path = rootfs.TarFilePath
+		return
+	}
+
+	cache := openRootFSCache()
+	var entry *rootfs.CacheEntry
+	if RootFSVersion != "" {
+		if entry = cache.Find(RootFSVersion); entry == nil {
+			err = fmt.Errorf("root file system version %s is not in cache", RootFSVersion)
+			return
+		}
+	} else if entry = cache.CurrentEntry(); entry == nil {
+		if entry, err = rootfs.EnsureCachedRootFS(cache, &UpdateRootFSFields); err != nil {
+			return
+		}
+	}
+
+	log.WithFields(UpdateRootFSFields).WithFields(log.Fields{
+		"version":  entry.Version,
+		"checksum": entry.Checksum,
+	}).Infof("Using root FS %s", pterm.Bold.Sprint(entry.Version))
+	path = cache.Path(entry)
+	checksum = entry.Checksum
+	return
+}
+
+// customizeRootFS applies the overlay defined in the configuration, along
+// with the configuration options that can be set before import, to the root
+// file system at path. Archives that wsl cannot import are converted.
+func customizeRootFS(path string, checksum string) (string, error) {
+	overlay := &rootfs.Overlay{}
+	if err := viper.UnmarshalKey("overlay", overlay); err != nil {
+		return "", errors.Wrap(err, "while reading overlay configuration")
+	}
+	overlay.Files = append(overlay.Files, config.OverlayFiles(ConfigurationOptions)...)
+	if overlay.IsEmpty() {
+		compression, err := rootfs.FileCompression(path)
+		if err != nil {
+			return "", err
+		}
+		if compression.ImportSupported() {
+			return path, nil
+		}
+		// Applying an empty overlay converts the archive to tar.gz
+	}
+	return rootfs.DeriveRootFS(path, checksum, overlay, filepath.Join(rootfs.CacheDir, rootfs.OverlayDirName))
+}
+
+func performRootFSList(cmd *cobra.Command, args []string) {
+	cache := openRootFSCache()
+	data := pterm.TableData{{"", "VERSION", "CHECKSUM", "DATE", "SIZE"}}
+	for _, entry := range cache.Entries {
+		current := ""
+		if entry.Checksum == cache.Current {
+			current = "*"
+		}
+		data = append(data, []string{
+			current,
+			entry.Version,
+			entry.ShortChecksum(),
+			entry.Date.Format("2006-01-02 15:04"),
+			humanize.Bytes(uint64(entry.Size)),
+		})
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+}
+
+func performRootFSUse(cmd *cobra.Command, args []string) {
+	cache := openRootFSCache()
+	entry, err := cache.Use(args[0])
+	cobra.CheckErr(err)
+	log.WithFields(log.Fields{
+		"version":  entry.Version,
+		"checksum": entry.Checksum,
+	}).Infof("Root FS %s is now the current one", pterm.Bold.Sprint(entry.Version))
+}
+
+func performRootFSPrune(cmd *cobra.Command, args []string) {
+	cache := openRootFSCache()
+	removed, err := cache.Prune(PruneKeep)
+	// Customized root file systems are rebuilt on demand
+	os.RemoveAll(filepath.Join(rootfs.CacheDir, rootfs.OverlayDirName))
+	for _, entry := range removed {
+		log.WithFields(log.Fields{
+			"version":  entry.Version,
+			"checksum": entry.Checksum,
+		}).Infof("Removed root FS %s", pterm.Bold.Sprint(entry.Version))
+	}
+	cobra.CheckErr(err)
+}
+
+func performRootFSInspect(cmd *cobra.Command, args []string) {
+	var metadata *rootfs.Metadata
+	var err error
+	if len(args) == 1 {
+		metadata, err = rootfs.InspectFile(args[0])
+	} else {
+		cache := openRootFSCache()
+		entry := cache.CurrentEntry()
+		if entry == nil {
+			cobra.CheckErr("no current root file system in cache")
+		}
+		metadata, err = cache.Metadata(entry)
+	}
+	cobra.CheckErr(err)
+
+	data := pterm.TableData{
+		{"OS", metadata.OSName()},
+		{"Files", fmt.Sprintf("%d", metadata.FileCount)},
+		{"Uncompressed size", humanize.Bytes(uint64(metadata.UncompressedSize))},
+	}
+	components := make([]string, 0, len(metadata.Components))
+	for name := range metadata.Components {
+		components = append(components, name)
+	}
+	sort.Strings(components)
+	for _, name := range components {
+		data = append(data, []string{name, metadata.Components[name]})
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithData(data).Render())
+}
+
+// printRootFSChanges shows the differences between the old and new cached
+// root file systems.
+func printRootFSChanges(cache *rootfs.Cache, old *rootfs.CacheEntry, new *rootfs.CacheEntry) {
+	oldMetadata, err := cache.Metadata(old)
+	if err != nil {
+		log.WithError(err).Warn("Couldn't inspect previous root FS")
+		return
+	}
+	newMetadata, err := cache.Metadata(new)
+	if err != nil {
+		log.WithError(err).Warn("Couldn't inspect new root FS")
+		return
+	}
+
+	changes := rootfs.DiffMetadata(oldMetadata, newMetadata)
+	if len(changes) == 0 {
+		log.WithFields(UpdateRootFSFields).Info("No component change")
+		return
+	}
+	data := pterm.TableData{{"COMPONENT", old.Version, new.Version}}
+	for _, change := range changes {
+		data = append(data, []string{change.Name, change.Old, change.New})
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+}
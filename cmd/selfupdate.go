@@ -0,0 +1,148 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kaweezle/kaweezle/pkg/httpclient"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/release"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/kaweezle/kaweezle/pkg/selfupdate"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+var SelfUpdateFields = log.Fields{
+	logger.TaskKey: "Self update",
+}
+
+var (
+	SelfUpdateCheck bool
+	UpdateNotice    bool
+	// SelfUpdateChannel is the release channel of kaweezle. When empty, the
+	// root file system channel is used.
+	SelfUpdateChannel release.Channel
+)
+
+// selfUpdateChannel returns the release channel kaweezle updates from.
+func selfUpdateChannel() release.Channel {
+	if SelfUpdateChannel != "" {
+		return SelfUpdateChannel
+	}
+	return rootfs.Channel
+}
+
+func NewSelfUpdateCommand() *cobra.Command {
+	selfUpdateCmd := &cobra.Command{
+		Use:   "self-update",
+		Short: "Update kaweezle to the latest version",
+		Long: `Download the latest kaweezle release of the channel given by
+	--self-update-channel, or by --channel if not set, and replace the running
+	executable with it.
+
+	With --check, nothing is downloaded. The command exits with code 0 if
+	kaweezle is up to date and 2 if a newer version is available.`,
+		Run: performSelfUpdate,
+	}
+	selfUpdateCmd.Flags().BoolVar(&SelfUpdateCheck, "check", false, "Only check if a newer version is available")
+	return selfUpdateCmd
+}
+
+func performSelfUpdate(cmd *cobra.Command, args []string) {
+	current := cmd.Root().Version
+	client, err := release.NewClient()
+	cobra.CheckErr(err)
+
+	channel := selfUpdateChannel()
+	latest, available, err := selfupdate.Check(client, current, channel)
+	cobra.CheckErr(err)
+	if !available {
+		pterm.Success.Printfln("kaweezle %s is up to date (%s channel)", current, channel)
+		return
+	}
+	if SelfUpdateCheck {
+		pterm.Info.Printfln("kaweezle %s is available (%s channel), current is %s", latest.TagName, channel, current)
+		printReleaseNotes(latest)
+		os.Exit(UpdateAvailableExitCode)
+	}
+
+	executable, err := currentExecutable()
+	cobra.CheckErr(err)
+	cobra.CheckErr(selfupdate.Apply(client, latest, executable))
+	log.WithFields(SelfUpdateFields).WithFields(log.Fields{
+		"executable": executable,
+		"previous":   current,
+		"version":    latest.TagName,
+	}).Infof("kaweezle updated to %s", pterm.Bold.Sprint(latest.TagName))
+	printReleaseNotes(latest)
+}
+
+func currentExecutable() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(executable)
+}
+
+// noticeNewerVersion tells the user when a newer kaweezle is available. It
+// is opt-in and queries the releases at most once a day. Errors are ignored
+// as the notice is not the purpose of the command.
+func noticeNewerVersion(cmd *cobra.Command) {
+	if executable, err := currentExecutable(); err == nil {
+		selfupdate.Cleanup(executable)
+	}
+	if !UpdateNotice || cmd.Name() == "self-update" {
+		return
+	}
+	current := cmd.Root().Version
+	if _, err := version.ParseSemantic(current); err != nil {
+		// Development build
+		return
+	}
+
+	if err := rootfs.EnsureHomeDir(rootfs.HomeDir); err != nil {
+		return
+	}
+	path := filepath.Join(rootfs.HomeDir, selfupdate.NoticeFileName)
+	newer, err := selfupdate.NewerVersion(path, current, selfupdate.DefaultNoticeInterval, func() (string, error) {
+		// The notice must not slow down the command when offline
+		options := *httpclient.DefaultOptions
+		options.Timeout, options.Retries = selfupdate.NoticeTimeout, 0
+		client, err := release.NewClientWithOptions(&options)
+		if err != nil {
+			return "", err
+		}
+		client.HTTP.Timeout = selfupdate.NoticeTimeout
+		latest, _, err := selfupdate.Check(client, current, selfUpdateChannel())
+		if err != nil {
+			return "", err
+		}
+		return latest.TagName, nil
+	})
+	if err != nil {
+		log.WithError(err).Debug("Couldn't check for a newer kaweezle version")
+		return
+	}
+	if newer != "" {
+		pterm.Info.Printfln("kaweezle %s is available (current is %s). Run `kaweezle self-update` to update.", newer, current)
+	}
+}
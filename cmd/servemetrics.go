@@ -0,0 +1,169 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/exporter"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const DefaultMetricsAddress = "localhost:9799"
+
+var (
+	MetricsAddress = DefaultMetricsAddress
+)
+
+var serveMetricsFields = log.Fields{
+	logger.TaskKey: "Serve metrics",
+}
+
+// NewServeMetricsCommand creates a new serve-metrics command
+func NewServeMetricsCommand() *cobra.Command {
+	serveMetricsCmd := &cobra.Command{
+		Use:   "serve-metrics",
+		Short: "Serve the cluster metrics to Prometheus",
+		Long: `Serve the state of the cluster as Prometheus metrics until interrupted.
+
+	The /metrics endpoint reports the cluster status and phase, the number of
+	ready and unready workloads per namespace, the time the last start took
+	to be ready, the version of the root file system installed by the last
+	install or upgrade and the state of the WSL distributions. The /healthz
+	endpoint tells if the exporter is running.
+
+	The values are read on each scrape. The workloads are only queried when
+	the cluster is started.
+
+	Examples:
+
+	> kaweezle serve-metrics
+	> kaweezle serve-metrics --address :9799
+	`,
+		Args: cobra.ExactArgs(0),
+		Run:  performServeMetrics,
+	}
+
+	flags := serveMetricsCmd.Flags()
+	flags.StringVar(&MetricsAddress, "address", MetricsAddress, "The address to listen to")
+	AddWorkloadFilterFlags(flags, WorkloadFilter)
+
+	return serveMetricsCmd
+}
+
+// startRecordFile returns the file where the last start of the distribution
+// is recorded.
+func startRecordFile() string {
+	return filepath.Join(rootfs.HomeDir, DistributionName+"-start.json")
+}
+
+// installedRootFSFile returns the file where the version of the root file
+// system installed in the distribution is recorded.
+func installedRootFSFile() string {
+	return filepath.Join(rootfs.HomeDir, DistributionName+"-rootfs-version")
+}
+
+// recordInstalledRootFS records the version of the root file system of
+// checksum after its import. The checksum is empty when the root file system
+// doesn't come from the cache and its version is unknown.
+func recordInstalledRootFS(checksum string) {
+	version := ""
+	if checksum != "" {
+		if entry := openRootFSCache().Find(checksum); entry != nil {
+			version = entry.Version
+		}
+	}
+	if err := rootfs.SaveInstalledVersion(installedRootFSFile(), version); err != nil {
+		log.WithError(err).WithField("distrib_name", DistributionName).Warn("Couldn't record the root file system version")
+	}
+}
+
+// metricsSources returns the sources of the metrics. filter is built once as
+// the sources are called concurrently by the scrapes.
+func metricsSources(filter *cluster.WorkloadFilter) *exporter.Sources {
+	return &exporter.Sources{
+		Status: func() (cluster.ClusterStatus, error) {
+			return cluster.GetClusterStatus(DistributionName)
+		},
+		Phase: func() (cluster.ClusterPhase, error) {
+			state, err := cluster.GetClusterState(DistributionName)
+			if err != nil {
+				return cluster.Stopped, err
+			}
+			return state.Phase, nil
+		},
+		Workloads: func() ([]*cluster.WorkloadState, error) {
+			client, err := k8s.NewRESTClientForDistribution(DistributionName)
+			if err != nil {
+				return nil, err
+			}
+			return cluster.AllWorkloadStates(client, filter)
+		},
+		Distributions: func() (result []exporter.Distribution, err error) {
+			distributions, err := wsl.GetDistributions()
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range distributions {
+				result = append(result, exporter.Distribution{Name: d.Name, State: d.State.String(), Version: d.Version, IsDefault: d.IsDefault})
+			}
+			sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+			return
+		},
+		RootFSVersion: func() (string, error) {
+			return rootfs.ReadInstalledVersion(installedRootFSFile())
+		},
+		LastStart: func() (*cluster.StartRecord, error) {
+			return cluster.ReadStartRecord(startRecordFile())
+		},
+	}
+}
+
+func performServeMetrics(cmd *cobra.Command, args []string) {
+	runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
+	handler, err := exporter.NewHandler(exporter.NewCollector(DistributionName, metricsSources(workloadFilter())))
+	cobra.CheckErr(err)
+	server := &http.Server{Addr: MetricsAddress, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.WithFields(serveMetricsFields).Infof("Serving metrics on http://%s/metrics, press Ctrl+C to stop", MetricsAddress)
+	if err = server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		cobra.CheckErr(err)
+	}
+}
@@ -16,7 +16,7 @@ limitations under the License.
 package cmd
 
 import (
-	"os"
+	"fmt"
 	"time"
 
 	"github.com/kaweezle/kaweezle/pkg/cluster"
@@ -24,7 +24,6 @@ import (
 	"github.com/kaweezle/kaweezle/pkg/k8s"
 	"github.com/kaweezle/kaweezle/pkg/rootfs"
 	"github.com/kaweezle/kaweezle/pkg/wsl"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/runtime"
 
@@ -38,6 +37,7 @@ const (
 
 var (
 	ClusterWaitTimeout   = DefaultClusterWaitTimeout
+	StartForwards        = true
 	ConfigurationOptions = config.NewConfigurationOptions()
 )
 
@@ -51,13 +51,26 @@ func NewStartCommand() *cobra.Command {
 	}
 	flags := startCmd.Flags()
 
-	flags.StringVarP(&rootfs.TarFilePath, "root", "r", rootfs.DefaultTarFilePath, "The root file system to install")
+	flags.StringVarP(&rootfs.TarFilePath, "root", "r", "", "The root file system to install: tar.gz, tar.zst or tar.xz file, OCI layout directory or oci:// image reference (default is the current cached one)")
+	flags.StringVar(&RootFSVersion, "rootfs-version", RootFSVersion, "The cached root file system version to install")
 	flags.IntVarP(&ClusterWaitTimeout, "timeout", "t", DefaultClusterWaitTimeout, "The time (in seconds) to wait for the cluster to settle")
+	flags.BoolVar(&StartForwards, "forwards", StartForwards, "Start the configured port forwards in the background")
 	AddConfigurationFlags(flags, ConfigurationOptions)
+	AddWorkloadFilterFlags(flags, WorkloadFilter)
+	AddWaitFlags(flags)
 
 	return startCmd
 }
 
+// AddWaitFlags adds the flags controlling the failure detection and the
+// diagnostics made when the cluster doesn't become ready.
+func AddWaitFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&cluster.FailFast, "fail-fast", cluster.FailFast, "Stop waiting when containers keep crashing or failing to pull their image")
+	flags.IntVar(&cluster.FailureThreshold, "failure-threshold", cluster.FailureThreshold, "Number of restarts, or of consecutive checks with image pull errors, after which a container is considered failed")
+	flags.StringVar(&cluster.DiagnosticsFile, "diagnostics-file", cluster.DiagnosticsFile, "File where to save the details of the diagnostics when the cluster doesn't become ready (default none)")
+	flags.Int64Var(&cluster.DiagnosticsLogLines, "diagnostics-log-lines", cluster.DiagnosticsLogLines, "Number of log lines to collect for each failing container")
+}
+
 func AddConfigurationFlags(flags *pflag.FlagSet, options *config.ConfigurationOptions) {
 
 	flags.StringVar(&options.AgeKeyFile, "age-key-file", options.AgeKeyFile, "The path to the age key file")
@@ -66,30 +79,34 @@ func AddConfigurationFlags(flags *pflag.FlagSet, options *config.ConfigurationOp
 	flags.StringVar(&options.PersistentIPAddress, "ip-address", options.PersistentIPAddress, "The persistent IP address to use for the WSL distribution")
 	flags.StringArrayVar(&options.DomainNames, "domain-name", options.DomainNames, "Domain names to associate locally with the cluster")
 	flags.StringArrayVar(&options.SshHosts, "ssh-hosts", options.SshHosts, "Hosts to add to the ~/.ssh/known_hosts file")
+	flags.BoolVar(&options.DomainsFromIngresses, "domains-from-ingresses", options.DomainsFromIngresses, "Bind the hosts of the cluster Ingresses and HTTPRoutes once the cluster is ready")
+	flags.StringArrayVar(&options.DomainSuffixes, "domain-suffix", options.DomainSuffixes, "Only bind the cluster hosts ending with this domain")
 }
 
 func performStart(cmd *cobra.Command, args []string) {
-	status, err := cluster.GetClusterStatus(DistributionName)
+	state, err := cluster.GetClusterState(DistributionName)
 	cobra.CheckErr(err)
-	if status != cluster.Started {
-		if status == cluster.Uninstalled {
-			if rootfs.TarFilePath == "" {
-				rootfs.TarFilePath = rootfs.DefaultTarFilePath
-				cobra.CheckErr(rootfs.EnsureRootFS(rootfs.TarFilePath, &UpdateRootFSFields))
-			} else {
-				// Check if rootfs.TarFilePath is a valid file path
-				if _, err := os.Stat(rootfs.TarFilePath); os.IsNotExist(err) {
-					cobra.CheckErr(errors.Wrapf(err, "rootfs file %s does not exist", rootfs.TarFilePath))
-				}
-			}
+	switch state.Phase {
+	case cluster.Stopping:
+		cobra.CheckErr(fmt.Errorf("cluster %s is stopping, retry once it is stopped", DistributionName))
+	case cluster.Error:
+		log.WithField("distrib_name", DistributionName).Warnf("Cluster %s has crashed, restarting it", DistributionName)
+	case cluster.Starting, cluster.Ready, cluster.Degraded:
+		log.WithField("distrib_name", DistributionName).Infof("Cluster %s is already %v", DistributionName, state.Phase)
+	}
+	var record *cluster.StartRecord
+	if !state.Phase.IsUp() {
+		record = &cluster.StartRecord{Started: time.Now()}
+		if state.Status == cluster.Uninstalled {
+			tarFilePath, checksum, err := resolveRootFS()
+			cobra.CheckErr(err)
+			tarFilePath, err = customizeRootFS(tarFilePath, checksum)
+			cobra.CheckErr(err)
 
 			installationDir, err := rootfs.EnsureWSLDirectory(rootfs.HomeDir, DistributionName)
 			cobra.CheckErr(err)
-			cobra.CheckErr(wsl.RegisterDistribution(DistributionName, rootfs.TarFilePath, installationDir))
-			status = cluster.Installed
-		}
-		if status != cluster.Installed {
-			log.Fatalf("Cluster %s in bad status: %v", DistributionName, status)
+			cobra.CheckErr(wsl.RegisterDistribution(DistributionName, tarFilePath, installationDir))
+			recordInstalledRootFS(checksum)
 		}
 		cobra.CheckErr(config.Configure(DistributionName, ConfigurationOptions))
 		cobra.CheckErr(cluster.StartCluster(DistributionName, LogLevel))
@@ -97,12 +114,33 @@ func performStart(cmd *cobra.Command, args []string) {
 	}
 	if ClusterWaitTimeout > 0 {
 		runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
-		err = cluster.WaitForCluster(DistributionName, time.Second*time.Duration(ClusterWaitTimeout))
-		if err != nil {
+		err = cluster.WaitForCluster(DistributionName, workloadFilter(), time.Second*time.Duration(ClusterWaitTimeout))
+		if _, failed := err.(*cluster.PodFailureError); failed {
+			log.WithError(err).WithField("distrib_name", DistributionName).Infof("Fix the failing containers or use --fail-fast=false to keep waiting. To see the current state, issue the following command: %s status -w", commandName)
+		} else if err != nil {
 			log.WithError(err).WithField("distrib_name", DistributionName).Infof("To continue waiting, issue the following command: %s status -w", commandName)
+		} else {
+			recordStart(record)
+			configureIngressDomainsIfEnabled()
 		}
 	} else {
 		log.WithField("distrib_name", DistributionName).Info("No wait for cluster settling")
 	}
+	if StartForwards {
+		if err = startForwardSupervisor(); err != nil {
+			log.WithError(err).WithFields(ForwardFields).Warn("Port forwards not started")
+		}
+	}
+}
 
+// recordStart saves the time record took to be ready for serve-metrics.
+// record is nil when the cluster was already started.
+func recordStart(record *cluster.StartRecord) {
+	if record == nil {
+		return
+	}
+	record.ReadyAt = time.Now()
+	if err := record.Save(startRecordFile()); err != nil {
+		log.WithError(err).WithField("distrib_name", DistributionName).Warn("Couldn't record the start")
+	}
 }
@@ -18,12 +18,16 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/kaweezle/kaweezle/pkg/cluster"
 	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/pkg/errors"
 	"github.com/pterm/pterm"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 	"k8s.io/apimachinery/pkg/util/runtime"
 )
 
@@ -35,58 +39,160 @@ func NewStatusCommand() *cobra.Command {
 		Long: `Gives the status of the cluster. Example:
 	
 	> kaweezle status
+	
+	With --wait, the workloads are shown grouped by namespace in a table that
+	is redrawn in place until they are all ready. Workloads that become
+	unready after being ready are highlighted in red.
+
+	The workloads considered can be restricted with --namespace, --selector,
+	--kinds and --exclude. Workloads matching the readiness.ignore patterns of
+	the configuration are shown but don't prevent the cluster from being
+	ready. The health of custom resources can be defined with the
+	readiness.rules of the configuration (see kaweezle health validate).
+
+	With --usage, the memory used by the cluster is compared to the memory of
+	the distribution and to the .wslconfig limit (see kaweezle top).
 	`,
 		Run: performStatus,
 	}
 
-	statusCmd.Flags().BoolVarP(&waitReadiness, "wait", "w", waitReadiness, "Wait n seconds for all pods to settle")
+	statusCmd.Flags().BoolVarP(&waitReadiness, "wait", "w", waitReadiness, "Wait for all workloads to be ready, showing their state live")
+	statusCmd.Flags().BoolVar(&showUsage, "usage", showUsage, "Show the resource usage of the node and of the distribution")
+	AddWorkloadFilterFlags(statusCmd.Flags(), WorkloadFilter)
 	return statusCmd
 }
 
-// statusCmd represents the status command
+// ReadinessIgnoreKey is the configuration key of the workloads that don't
+// prevent the cluster from being ready.
+const ReadinessIgnoreKey = "readiness.ignore"
 
-var waitReadiness = false
+// ReadinessRulesKey is the configuration key of the health rules of custom
+// resources.
+const ReadinessRulesKey = "readiness.rules"
 
-var callbackCount = 0
+var WorkloadFilter = &cluster.WorkloadFilter{}
 
-func callback(ok bool, count int, ready []*cluster.WorkloadState, unready []*cluster.WorkloadState) {
-	if callbackCount == 0 {
-		fmt.Printf("\n%d workloads, %d ready, %d unready\n", count, len(ready), len(unready))
-		for _, state := range ready {
-			fmt.Println(state.LongString())
-		}
-	} else {
-		if len(unready) > 0 {
-			fmt.Printf("\n%d unready workloads remaining:\n", len(unready))
-		} else {
-			fmt.Printf("\n🎉 All workloads (%d) ready:\n", count)
-			for _, state := range ready {
-				fmt.Println(state.LongString())
-			}
-		}
+func AddWorkloadFilterFlags(flags *pflag.FlagSet, filter *cluster.WorkloadFilter) {
+	flags.StringVar(&filter.Namespace, "namespace", filter.Namespace, "Only consider the workloads of this namespace (default all)")
+	flags.StringVar(&filter.Selector, "selector", filter.Selector, "Label selector of the workloads to consider (e.g. app.kubernetes.io/part-of=argocd)")
+	flags.StringSliceVar(&filter.Kinds, "kinds", filter.Kinds, "Kinds of workloads to consider, e.g. jobs or persistentvolumeclaims (default deployments, statefulsets, daemonsets, applications and the Flux and cert-manager kinds)")
+	flags.StringArrayVar(&filter.Exclude, "exclude", filter.Exclude, "Workloads to exclude, as <namespace>/<kind>/<name> glob patterns (e.g. demo/deployments/*)")
+}
+
+// healthRules returns the health rules of the configuration.
+func healthRules() (rules []*cluster.HealthRule, err error) {
+	if err = viper.UnmarshalKey(ReadinessRulesKey, &rules); err != nil {
+		err = errors.Wrap(err, "while reading health rules")
 	}
+	return
+}
 
-	for _, state := range unready {
+// workloadFilter returns the filter given by the flags, completed with the
+// workloads ignored in the configuration. The health rules of the
+// configuration are also loaded.
+func workloadFilter() *cluster.WorkloadFilter {
+	rules, err := healthRules()
+	cobra.CheckErr(err)
+	cobra.CheckErr(cluster.SetHealthRules(rules))
+	WorkloadFilter.Ignore = viper.GetStringSlice(ReadinessIgnoreKey)
+	cobra.CheckErr(WorkloadFilter.Validate())
+	return WorkloadFilter
+}
+
+var (
+	waitReadiness = false
+	showUsage     = false
+)
+
+// printWorkloads prints the workloads states once and exits.
+func printWorkloads(ok bool, count int, ready []*cluster.WorkloadState, unready []*cluster.WorkloadState) {
+	fmt.Printf("\n%d workloads, %d ready, %d unready\n", count, len(ready), len(unready))
+	for _, state := range ready {
 		fmt.Println(state.LongString())
 	}
-
-	if !waitReadiness {
-		os.Exit(0)
+	for _, state := range unready {
+		fmt.Println(state.LongString())
 	}
-	callbackCount++
+	os.Exit(0)
 }
 
 func performStatus(cmd *cobra.Command, args []string) {
-	status, err := cluster.GetClusterStatus(DistributionName)
+	state, err := cluster.GetClusterState(DistributionName)
 	cobra.CheckErr(err)
-	log.Infof("Cluster %s is %v.", pterm.Bold.Sprint(DistributionName), pterm.Bold.Sprint(status))
-	if status == cluster.Started {
+	if state.Status == cluster.Uninstalled {
+		log.Infof("Cluster %s is %v.", pterm.Bold.Sprint(DistributionName), pterm.Bold.Sprint(state.Status))
+		return
+	}
+	log.Infof("Cluster %s is %v.", pterm.Bold.Sprint(DistributionName), pterm.Bold.Sprint(state.Phase))
+	printClusterState(state)
+	if state.Status == cluster.Started {
 		runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
 
 		var client *k8s.RESTClientGetter
 
 		client, err = k8s.NewRESTClientForDistribution(DistributionName)
 		cobra.CheckErr(err)
-		cluster.WaitForWorkloads(client, 0, callback)
+		filter := workloadFilter()
+		if !waitReadiness {
+			cobra.CheckErr(cluster.WaitForWorkloads(client, filter, 0, printWorkloads))
+			return
+		}
+
+		var booted time.Time
+		if state.Uptime > 0 {
+			booted = time.Now().Add(-state.Uptime)
+		}
+		dashboard, err := newStatusDashboard(booted)
+		cobra.CheckErr(err)
+		err = cluster.WaitForWorkloads(client, filter, 0, dashboard.callback)
+		dashboard.Stop()
+		cobra.CheckErr(err)
+	}
+}
+
+func printClusterState(state *cluster.ClusterState) {
+	if !state.Running {
+		return
+	}
+	data := pterm.TableData{
+		{"Phase", state.Phase.String()},
+		{"iknite", state.IkniteVersion},
+		{"Kubernetes", state.KubernetesVersion},
+		{"IP address", state.IPAddress},
+		{"Uptime", state.Uptime.String()},
+	}
+	if state.Message != "" {
+		data = append(data, []string{"Message", state.Message})
+	}
+	if state.APIReachable {
+		failing := 0
+		for _, check := range state.ReadyzChecks {
+			if !check.Ok {
+				failing++
+				data = append(data, []string{"API " + check.Name, fmt.Sprintf("%s %s", cluster.OkString(false), check.Message)})
+			}
+		}
+		if failing == 0 {
+			data = append(data, []string{"API server", fmt.Sprintf("%s %d checks ok", cluster.OkString(true), len(state.ReadyzChecks))})
+		}
+		for _, condition := range state.NodeConditions {
+			data = append(data, []string{"Node " + condition.Type, fmt.Sprintf("%s %s", cluster.OkString(condition.Ok), condition.Message)})
+		}
+	}
+	if showUsage {
+		var usage *cluster.ClusterUsage
+		if state.APIReachable {
+			var err error
+			if usage, err = clusterUsage(""); err != nil {
+				data = append(data, []string{"Resource usage", fmt.Sprintf("%s %v", cluster.OkString(false), err)})
+			}
+		}
+		data = append(data, usageRows(usage)...)
+	}
+	if forwards, err := configuredForwards(); err != nil {
+		data = append(data, []string{"Forwards", fmt.Sprintf("%s %v", cluster.OkString(false), err)})
+	} else {
+		data = append(data, forwardRows(forwards)...)
 	}
+	cobra.CheckErr(pterm.DefaultTable.WithData(data).Render())
 }
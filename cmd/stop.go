@@ -16,7 +16,7 @@ limitations under the License.
 package cmd
 
 import (
-	"os"
+	"fmt"
 
 	"github.com/kaweezle/kaweezle/pkg/cluster"
 	log "github.com/sirupsen/logrus"
@@ -30,11 +30,17 @@ func NewStopCommand() *cobra.Command {
 		Short: "Stop the cluster and the WSL distribution",
 		Long:  `Currently this stops abruptly the distribution.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			status, err := cluster.GetClusterStatus(DistributionName)
+			state, err := cluster.GetClusterState(DistributionName)
 			cobra.CheckErr(err)
-			if status != cluster.Started {
-				log.Fatalf("Cluster %s in bad status: %v", DistributionName, status)
-				os.Exit(1)
+			if state.Status == cluster.Uninstalled {
+				cobra.CheckErr(fmt.Errorf("distribution %s is not installed", DistributionName))
+			}
+			if err = stopForwardSupervisor(); err != nil {
+				log.WithError(err).WithFields(ForwardFields).Warn("Port forwards not stopped")
+			}
+			if !state.Running {
+				log.Infof("Cluster %s is already stopped", DistributionName)
+				return
 			}
 
 			cobra.CheckErr(cluster.StopCluster(DistributionName))
@@ -0,0 +1,191 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/support"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	DefaultSupportLogLines = 2000
+	supportBundleTimeout   = time.Minute
+)
+
+var (
+	SupportBundleFile     string
+	SupportBundleLogLines = DefaultSupportLogLines
+)
+
+var SupportBundleFields = log.Fields{
+	logger.TaskKey: "Support bundle",
+}
+
+// NewSupportBundleCommand creates a new support-bundle command
+func NewSupportBundleCommand() *cobra.Command {
+	supportBundleCmd := &cobra.Command{
+		Use:   "support-bundle",
+		Args:  cobra.ExactArgs(0),
+		Short: "Collect a diagnostics archive to share in support requests",
+		Long: `Collect in a zip archive the information needed to troubleshoot the
+	cluster: kaweezle version and configuration, WSL distributions and
+	.wslconfig, iknite configuration, iknite and kubelet logs, cluster state,
+	workloads, events, nodes descriptions and the kaweezle log file.
+
+	Secrets like private keys, age keys, tokens and passwords are redacted. The
+	manifest.json file of the archive lists what was collected.`,
+		Run: performSupportBundle,
+	}
+
+	flags := supportBundleCmd.Flags()
+	flags.StringVarP(&SupportBundleFile, "output", "o", SupportBundleFile, "Path of the archive (default kaweezle-support-<date>.zip)")
+	flags.IntVar(&SupportBundleLogLines, "log-lines", SupportBundleLogLines, "Number of lines collected from each guest log")
+	return supportBundleCmd
+}
+
+func collectJSON(value interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(value, "", "  ")
+}
+
+func performSupportBundle(cmd *cobra.Command, args []string) {
+	path := SupportBundleFile
+	if path == "" {
+		path = fmt.Sprintf("kaweezle-support-%s.zip", time.Now().Format("20060102-150405"))
+	}
+	file, err := os.Create(path)
+	cobra.CheckErr(err)
+	defer file.Close()
+
+	bundle := support.NewBundle(file, cmd.Root().Version)
+	collect := func(name string, description string, f support.CollectFunc) {
+		log.WithFields(SupportBundleFields).Debugf("Collecting %s", name)
+		_, err := bundle.Collect(name, description, f)
+		cobra.CheckErr(err)
+	}
+	notRunning := func() ([]byte, error) {
+		return nil, fmt.Errorf("distribution %s is not running", DistributionName)
+	}
+
+	collect("version.txt", "kaweezle version", func() ([]byte, error) {
+		return []byte(fmt.Sprintf("kaweezle %s\n%s %s/%s\n", cmd.Root().Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)), nil
+	})
+	collect("config.yaml", "kaweezle configuration (configure print)", printedConfig)
+	collect("wsl-list.txt", "wsl --list --verbose", wsl.ListVerbose)
+	collect("wslconfig.txt", "WSL global configuration (.wslconfig)", func() ([]byte, error) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.Join(home, ".wslconfig"))
+	})
+	collect("kaweezle.log", "kaweezle log file", func() ([]byte, error) {
+		if LogFile == "" {
+			return nil, fmt.Errorf("no log file, use --logfile to keep one")
+		}
+		return os.ReadFile(LogFile)
+	})
+
+	state, err := cluster.GetClusterState(DistributionName)
+	collect("cluster/state.json", "Cluster state (status)", func() ([]byte, error) {
+		return collectJSON(state, err)
+	})
+	running := err == nil && state.Running
+
+	guest := func(script string) support.CollectFunc {
+		if !running {
+			return notRunning
+		}
+		return func() ([]byte, error) {
+			return wsl.WslCommand(DistributionName, "/bin/sh", "-c", script)
+		}
+	}
+	collect("guest/iknite.conf", "iknite configuration (/etc/conf.d/iknite)", guest("cat /etc/conf.d/iknite"))
+	for _, source := range []string{"iknite", "kubelet"} {
+		script, err := cluster.LogCommand(source, SupportBundleLogLines, false)
+		cobra.CheckErr(err)
+		collect(fmt.Sprintf("guest/%s.log", source), fmt.Sprintf("Last %d lines of the %s log", SupportBundleLogLines, source), guest(script))
+	}
+
+	var clientset kubernetes.Interface
+	var restClient *k8s.RESTClientGetter
+	if running && state.APIReachable {
+		var cs *kubernetes.Clientset
+		if cs, err = k8s.ClientSetForDistribution(DistributionName); err == nil {
+			restClient, err = k8s.NewRESTClientForDistribution(DistributionName)
+		}
+		if err == nil {
+			clientset = cs
+		} else {
+			log.WithError(err).WithFields(SupportBundleFields).Warn("Couldn't connect to the cluster")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), supportBundleTimeout)
+	defer cancel()
+	kubernetesCollect := func(f func() ([]byte, error)) support.CollectFunc {
+		if clientset == nil {
+			return func() ([]byte, error) {
+				return nil, fmt.Errorf("kubernetes API not reachable")
+			}
+		}
+		return f
+	}
+	collect("cluster/workloads.txt", "Workloads states", kubernetesCollect(func() ([]byte, error) {
+		states, err := cluster.AllWorkloadStates(restClient, nil)
+		var buffer bytes.Buffer
+		for _, state := range states {
+			fmt.Fprintln(&buffer, state.LongString())
+		}
+		return buffer.Bytes(), err
+	}))
+	collect("cluster/events.txt", "Events of all namespaces", kubernetesCollect(func() ([]byte, error) {
+		return support.Events(ctx, clientset)
+	}))
+	collect("cluster/nodes.txt", "Nodes descriptions", kubernetesCollect(func() ([]byte, error) {
+		return support.NodeDescriptions(ctx, clientset)
+	}))
+
+	cobra.CheckErr(bundle.Close())
+
+	failed := 0
+	data := pterm.TableData{{"", "ITEM", "SIZE", "REDACTED", "ERROR"}}
+	for _, entry := range bundle.Manifest.Entries {
+		if entry.Error != "" {
+			failed++
+		}
+		data = append(data, []string{cluster.OkString(entry.Error == ""), entry.Name, fmt.Sprint(entry.Size), fmt.Sprint(entry.Redactions), entry.Error})
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+	log.WithFields(SupportBundleFields).Infof("Support bundle saved in %s (%d items, %d not collected)", pterm.Bold.Sprint(path), len(bundle.Manifest.Entries), failed)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+)
+
+const DefaultSyncWaitTimeout = 300
+
+var (
+	SyncNamespace   = cluster.DefaultApplicationsNamespace
+	SyncRefreshOnly = false
+	SyncHardRefresh = false
+	SyncPrune       = false
+	SyncWaitTimeout = DefaultSyncWaitTimeout
+)
+
+var SyncFields = log.Fields{
+	logger.TaskKey: "Sync applications",
+}
+
+// NewSyncCommand creates a new sync command
+func NewSyncCommand() *cobra.Command {
+	syncCmd := &cobra.Command{
+		Use:   "sync [application...]",
+		Short: "Sync the Argo CD applications",
+		Long: `Sync the given Argo CD applications, or all of them, and wait for them
+	to be synced and healthy. Example:
+
+	> kaweezle sync demo --prune
+
+	With --refresh, the applications are only refreshed, i.e. compared again
+	with their source, and synced only if their sync policy is automated.
+	--hard also invalidates the manifests cache.
+
+	Applications still out of sync are shown with their out of sync resources
+	(see also kaweezle status).
+	`,
+		Run: performSync,
+	}
+
+	flags := syncCmd.Flags()
+	flags.StringVar(&SyncNamespace, "namespace", SyncNamespace, "Namespace of the applications")
+	flags.BoolVar(&SyncRefreshOnly, "refresh", SyncRefreshOnly, "Only refresh the applications instead of syncing them")
+	flags.BoolVar(&SyncHardRefresh, "hard", SyncHardRefresh, "Make a hard refresh, invalidating the manifests cache (implies --refresh)")
+	flags.BoolVar(&SyncPrune, "prune", SyncPrune, "Delete the resources no longer in the source of the applications")
+	flags.IntVarP(&SyncWaitTimeout, "timeout", "t", SyncWaitTimeout, "The time (in seconds) to wait for the applications to be synced and healthy (0 for no wait)")
+	return syncCmd
+}
+
+func performSync(cmd *cobra.Command, args []string) {
+	state, err := cluster.GetClusterState(DistributionName)
+	cobra.CheckErr(err)
+	if state.Status != cluster.Started {
+		cobra.CheckErr(fmt.Errorf("cluster %s is not started", DistributionName))
+	}
+	runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
+
+	client, err := k8s.NewRESTClientForDistribution(DistributionName)
+	cobra.CheckErr(err)
+	has, err := cluster.HasApplications(client)
+	cobra.CheckErr(err)
+	if !has {
+		cobra.CheckErr(fmt.Errorf("argo CD is not installed in cluster %s", DistributionName))
+	}
+	config, err := client.ToRESTConfig()
+	cobra.CheckErr(err)
+	dynamicClient, err := dynamic.NewForConfig(config)
+	cobra.CheckErr(err)
+
+	ctx := context.Background()
+	applications, err := cluster.SelectApplications(ctx, dynamicClient, SyncNamespace, args)
+	cobra.CheckErr(err)
+	if len(applications) == 0 {
+		log.WithFields(SyncFields).Warnf("No application in namespace %s", SyncNamespace)
+		return
+	}
+
+	refresh := SyncRefreshOnly || SyncHardRefresh
+	for _, application := range applications {
+		cobra.CheckErr(syncApplication(ctx, dynamicClient, application, refresh))
+	}
+
+	if SyncWaitTimeout <= 0 {
+		return
+	}
+	dashboard, err := newStatusDashboard(time.Time{})
+	cobra.CheckErr(err)
+	err = cluster.WaitForWorkloads(client, cluster.ApplicationsFilter(SyncNamespace, args), time.Second*time.Duration(SyncWaitTimeout), dashboard.callback)
+	dashboard.Stop()
+	cobra.CheckErr(err)
+}
+
+func syncApplication(ctx context.Context, client dynamic.Interface, application *unstructured.Unstructured, refresh bool) error {
+	fields := log.Fields{"application": application.GetName()}
+	if refresh {
+		log.WithFields(SyncFields).WithFields(fields).Infof("Refreshing %s...", pterm.Bold.Sprint(application.GetName()))
+		return cluster.RefreshApplication(ctx, client, application, SyncHardRefresh)
+	}
+	log.WithFields(SyncFields).WithFields(fields).Infof("Syncing %s...", pterm.Bold.Sprint(application.GetName()))
+	return cluster.SyncApplication(ctx, client, application, SyncPrune)
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pterm/pterm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+const (
+	DefaultTopLimit = 20
+	usageTimeout    = 10 * time.Second
+	// lowMemoryPercent is the percentage of available guest memory under
+	// which the cluster is considered starving the VM.
+	lowMemoryPercent = 10
+)
+
+var (
+	TopSortBy    = "memory"
+	TopNamespace string
+	TopLimit     = DefaultTopLimit
+)
+
+// NewTopCommand creates a new top command
+func NewTopCommand() *cobra.Command {
+	topCmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show the resource usage of the cluster",
+		Long: `Show the CPU and memory used by the node, the namespaces and the pods
+	of the cluster, as reported by metrics-server. The memory used is compared
+	to the memory of the distribution and to the memory limit of .wslconfig.
+
+	Examples:
+
+	> kaweezle top
+	> kaweezle top --sort-by cpu --namespace argocd --limit 0
+	`,
+		Args: cobra.ExactArgs(0),
+		Run:  performTop,
+	}
+
+	flags := topCmd.Flags()
+	flags.StringVar(&TopSortBy, "sort-by", TopSortBy, fmt.Sprintf("Sort the namespaces and pods by %s", strings.Join(cluster.UsageSortKeys, ", ")))
+	flags.StringVar(&TopNamespace, "namespace", TopNamespace, "Only show the pods of this namespace (default all)")
+	flags.IntVar(&TopLimit, "limit", TopLimit, "Maximum number of pods to show (0 for all)")
+	return topCmd
+}
+
+// formatCPU formats millicores like kubectl top.
+func formatCPU(millicores int64) string {
+	return fmt.Sprintf("%dm", millicores)
+}
+
+func formatMemory(size int64) string {
+	return humanize.IBytes(uint64(size))
+}
+
+func formatRatio(value int64, total int64, format func(int64) string) string {
+	if total == 0 {
+		return format(value)
+	}
+	return fmt.Sprintf("%s / %s (%d%%)", format(value), format(total), value*100/total)
+}
+
+// guestMemory returns the memory of the distribution from /proc/meminfo.
+func guestMemory() (*cluster.MemInfo, error) {
+	out, err := wsl.WslCommand(DistributionName, "/bin/cat", "/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	return cluster.ParseMemInfo(bytes.NewReader(out))
+}
+
+// wslConfigMemory returns the memory limit of the user .wslconfig file.
+func wslConfigMemory() (int64, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return 0, err
+	}
+	return cluster.WSLConfigMemory(filepath.Join(home, ".wslconfig"))
+}
+
+// clusterUsage returns the resource usage given by the metrics API of the
+// cluster.
+func clusterUsage(namespace string) (usage *cluster.ClusterUsage, err error) {
+	var client *k8s.RESTClientGetter
+	if client, err = k8s.NewRESTClientForDistribution(DistributionName); err != nil {
+		return
+	}
+	config, err := client.ToRESTConfig()
+	if err != nil {
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return
+	}
+	metricsClient, err := metrics.NewForConfig(config)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), usageTimeout)
+	defer cancel()
+	return cluster.GetClusterUsage(ctx, clientset, metricsClient, namespace)
+}
+
+// usageRows returns the rows comparing the memory used by the cluster to
+// the memory of the distribution and to the .wslconfig limit. usage may be
+// nil when the metrics are not available.
+func usageRows(usage *cluster.ClusterUsage) (data pterm.TableData) {
+	limit, err := wslConfigMemory()
+	switch {
+	case err != nil:
+		data = append(data, []string{".wslconfig memory", fmt.Sprintf("%s %v", cluster.OkString(false), err)})
+	case limit == 0:
+		data = append(data, []string{".wslconfig memory", "not set (WSL default)"})
+	default:
+		data = append(data, []string{".wslconfig memory", formatMemory(limit)})
+	}
+
+	info, err := guestMemory()
+	if err != nil {
+		data = append(data, []string{"Guest memory", fmt.Sprintf("%s %v", cluster.OkString(false), err)})
+	} else {
+		starving := info.Available*100/info.Total < lowMemoryPercent
+		message := formatRatio(info.Total-info.Available, info.Total, formatMemory) + " used"
+		if starving {
+			message += ", the cluster is starving the distribution"
+		}
+		data = append(data, []string{"Guest memory", fmt.Sprintf("%s %s", cluster.OkString(!starving), message)})
+	}
+
+	if usage != nil {
+		for _, node := range usage.Nodes {
+			data = append(data,
+				[]string{"Node " + node.Name + " CPU", formatRatio(node.CPU, node.Allocatable.CPU, formatCPU)},
+				[]string{"Node " + node.Name + " memory", formatRatio(node.Memory, node.Allocatable.Memory, formatMemory)})
+		}
+	}
+	return
+}
+
+func performTop(cmd *cobra.Command, args []string) {
+	if !slices.Contains(cluster.UsageSortKeys, TopSortBy) {
+		cobra.CheckErr(fmt.Errorf("unknown sort key %s, should be one of %s", TopSortBy, strings.Join(cluster.UsageSortKeys, ", ")))
+	}
+	state, err := cluster.GetClusterState(DistributionName)
+	cobra.CheckErr(err)
+	if !state.Running {
+		cobra.CheckErr(fmt.Errorf("distribution %s is not running", DistributionName))
+	}
+
+	var usage *cluster.ClusterUsage
+	if state.APIReachable {
+		usage, err = clusterUsage(TopNamespace)
+		if err == cluster.ErrMetricsUnavailable {
+			log.Warnf("Resource usage not available: %v. Only the distribution memory is shown.", err)
+		} else {
+			cobra.CheckErr(err)
+		}
+	} else {
+		log.Warnf("Kubernetes API of %s not reachable. Only the distribution memory is shown.", DistributionName)
+	}
+	cobra.CheckErr(pterm.DefaultTable.WithData(usageRows(usage)).Render())
+	if usage == nil {
+		return
+	}
+
+	namespaces := usage.Namespaces()
+	cobra.CheckErr(cluster.SortNamespaceUsages(namespaces, TopSortBy))
+	data := pterm.TableData{{"NAMESPACE", "PODS", "CPU", "MEMORY"}}
+	for _, namespace := range namespaces {
+		data = append(data, []string{namespace.Name, fmt.Sprint(namespace.Pods), formatCPU(namespace.CPU), formatMemory(namespace.Memory)})
+	}
+	fmt.Println()
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+
+	pods := usage.Pods
+	cobra.CheckErr(cluster.SortPodUsages(pods, TopSortBy))
+	if TopLimit > 0 && len(pods) > TopLimit {
+		pods = pods[:TopLimit]
+	}
+	data = pterm.TableData{{"NAMESPACE", "POD", "CPU", "MEMORY"}}
+	for _, pod := range pods {
+		data = append(data, []string{pod.Namespace, pod.Name, formatCPU(pod.CPU), formatMemory(pod.Memory)})
+	}
+	fmt.Println()
+	cobra.CheckErr(pterm.DefaultTable.WithHasHeader().WithData(data).Render())
+	if len(pods) < len(usage.Pods) {
+		fmt.Printf("%d of %d pods shown, use --limit 0 to show all\n", len(pods), len(usage.Pods))
+	}
+}
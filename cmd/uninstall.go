@@ -53,6 +53,7 @@ func performUninstall(cmd *cobra.Command, args []string) {
 		"distrib_name": DistributionName,
 	}).Infof("Uninstall %s WSL distribution", pterm.Bold.Sprint(DistributionName))
 	cobra.CheckErr(wsllib.WslUnregisterDistribution(DistributionName))
+	recordInstalledRootFS("")
 	log.WithFields(log.Fields{
 		"distrib_name": DistributionName,
 	}).Infof("Remove %s kube context", pterm.Bold.Sprint(DistributionName))
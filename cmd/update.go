@@ -16,26 +16,168 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bitfield/script"
 	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/release"
 	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/pterm/pterm"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// UpdateAvailableExitCode is the exit code of update --check when a newer
+// root file system is available. It exits with 0 when up to date and 1 on
+// error.
+const UpdateAvailableExitCode = 2
+
 var UpdateRootFSFields = log.Fields{
 	logger.TaskKey: "Update Root FS",
 }
 
+var (
+	UpdateCheck bool
+	UpdateList  bool
+)
+
 func NewUpdateCommand() *cobra.Command {
 	updateCmd := &cobra.Command{
 		Use:   "update",
 		Short: "Update the root file system",
-		Long:  `Check and download the last version of the file system.`,
-		Run: func(cmd *cobra.Command, args []string) {
-			cobra.CheckErr(rootfs.EnsureRootFS(rootfs.TarFilePath, &log.Fields{}))
-		},
+		Long: `Check and download the last version of the file system.
+
+	The version is the latest release of the channel given by --channel:
+	stable (default), prerelease or edge. The downloaded file system is added
+	to the cache and becomes the current one. When --root is given, the file
+	at this path is updated instead.
+
+	With --check, nothing is downloaded. The command exits with code 0 if the
+	root file system is up to date and 2 if a newer one is available.`,
+		Example: `kaweezle update
+kaweezle update --channel prerelease
+kaweezle update --check || echo "update available"
+kaweezle update --list`,
+		Run: performUpdate,
 	}
-	updateCmd.Flags().StringVarP(&rootfs.TarFilePath, "root", "r", rootfs.DefaultTarFilePath, "The root file system to install")
+	flags := updateCmd.Flags()
+	flags.StringVarP(&rootfs.TarFilePath, "root", "r", "", "The root file system file to update (default is the cache)")
+	flags.BoolVar(&UpdateCheck, "check", false, "Only check if a newer root file system is available")
+	flags.BoolVar(&UpdateList, "list", false, "List the available releases")
 
 	return updateCmd
 }
+
+func performUpdate(cmd *cobra.Command, args []string) {
+	if UpdateList {
+		cobra.CheckErr(listReleases())
+		return
+	}
+	if UpdateCheck {
+		available, err := checkRootFSUpdate()
+		cobra.CheckErr(err)
+		if available {
+			os.Exit(UpdateAvailableExitCode)
+		}
+		return
+	}
+
+	if rootfs.TarFilePath != "" {
+		cobra.CheckErr(rootfs.EnsureRootFS(rootfs.TarFilePath, &log.Fields{}))
+		return
+	}
+	latest, err := rootfs.LatestRootFSRelease(rootfs.Channel)
+	cobra.CheckErr(err)
+
+	cache := openRootFSCache()
+	previous := cache.CurrentEntry()
+	entry, err := rootfs.EnsureReleaseRootFS(cache, latest, &UpdateRootFSFields)
+	cobra.CheckErr(err)
+	if previous == nil || previous.Checksum != entry.Checksum {
+		printReleaseNotes(latest.Release)
+	}
+	if previous != nil && previous.Checksum != entry.Checksum {
+		printRootFSChanges(cache, previous, entry)
+	}
+}
+
+// checkRootFSUpdate tells if the latest release of the channel differs from
+// the current root file system.
+func checkRootFSUpdate() (available bool, err error) {
+	var latest *rootfs.RootFSRelease
+	if latest, err = rootfs.LatestRootFSRelease(rootfs.Channel); err != nil {
+		return
+	}
+
+	var currentChecksum, currentVersion string
+	if rootfs.TarFilePath != "" {
+		if _, statErr := os.Stat(rootfs.TarFilePath); statErr == nil {
+			if currentChecksum, err = script.File(rootfs.TarFilePath).SHA256Sum(); err != nil {
+				return
+			}
+		}
+		currentVersion = rootfs.TarFilePath
+	} else if entry := openRootFSCache().CurrentEntry(); entry != nil {
+		currentChecksum, currentVersion = entry.Checksum, entry.Version
+	}
+
+	if currentChecksum == latest.Checksum {
+		pterm.Success.Printfln("Root FS %s is up to date (%s channel)", latest.TagName, rootfs.Channel)
+		return
+	}
+
+	available = true
+	if currentVersion == "" {
+		pterm.Info.Printfln("Root FS %s is available (%s channel)", latest.TagName, rootfs.Channel)
+	} else {
+		pterm.Info.Printfln("Root FS %s is available (%s channel), current is %s", latest.TagName, rootfs.Channel, currentVersion)
+	}
+	printReleaseNotes(latest.Release)
+	return
+}
+
+func printReleaseNotes(r *release.Release) {
+	notes := strings.TrimSpace(r.Body)
+	if notes == "" {
+		return
+	}
+	pterm.DefaultBox.WithTitle(fmt.Sprintf("%s release notes", r.TagName)).Println(notes)
+}
+
+func listReleases() (err error) {
+	var client *release.Client
+	if client, err = release.NewClient(); err != nil {
+		return
+	}
+	var releases []*release.Release
+	if releases, err = client.ListReleases(rootfs.ReleasesRepository); err != nil {
+		return
+	}
+
+	latest := release.Latest(releases, rootfs.Channel)
+	cache := openRootFSCache()
+	data := pterm.TableData{{"", "VERSION", "CHANNEL", "PUBLISHED", "CACHED"}}
+	for _, r := range releases {
+		if r.Draft || r.Asset(rootfs.RemoteTarFilename) == nil {
+			continue
+		}
+		marker := ""
+		if r == latest {
+			marker = "*"
+		}
+		cached := ""
+		if cache.Find(r.TagName) != nil {
+			cached = "yes"
+		}
+		data = append(data, []string{
+			marker,
+			r.TagName,
+			string(r.Kind()),
+			r.PublishedAt.Format("2006-01-02 15:04"),
+			cached,
+		})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
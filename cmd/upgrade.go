@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const (
+	DefaultUpgradeWaitTimeout = 300
+	BackupDirName             = "backups"
+)
+
+var (
+	UpgradeWaitTimeout = DefaultUpgradeWaitTimeout
+	KeepPaths          = cluster.DefaultKeepPaths
+	KeepSnapshot       = false
+)
+
+func NewUpgradeCommand() *cobra.Command {
+	upgradeCmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade the distribution to a new root file system",
+		Long: `Replace the root file system of the distribution while keeping its state.
+
+	The distribution is snapshotted, the paths to keep are saved, the new root
+	file system is imported and the saved paths are restored before the
+	cluster is configured and started. If the cluster doesn't become ready,
+	the distribution is restored from the snapshot.
+
+	By default, the latest released root file system is used.
+
+	Examples:
+
+	> kaweezle upgrade
+	> kaweezle upgrade --rootfs-version v0.2.1
+	`,
+		Args: cobra.ExactArgs(0),
+		Run:  performUpgrade,
+	}
+
+	flags := upgradeCmd.Flags()
+	flags.StringVarP(&rootfs.TarFilePath, "root", "r", "", "The root file system to upgrade to: tar.gz, tar.zst or tar.xz file, OCI layout directory or oci:// image reference (default is the latest release)")
+	flags.StringVar(&RootFSVersion, "rootfs-version", RootFSVersion, "The cached root file system version to upgrade to")
+	flags.StringArrayVar(&KeepPaths, "keep-paths", KeepPaths, "Paths of the distribution to keep across the upgrade")
+	flags.BoolVar(&KeepSnapshot, "keep-snapshot", KeepSnapshot, "Keep the distribution snapshot after a successful upgrade")
+	flags.IntVarP(&UpgradeWaitTimeout, "timeout", "t", DefaultUpgradeWaitTimeout, "The time (in seconds) to wait for the upgraded cluster to be ready before rolling back")
+	AddConfigurationFlags(flags, ConfigurationOptions)
+	AddWaitFlags(flags)
+
+	return upgradeCmd
+}
+
+func performUpgrade(cmd *cobra.Command, args []string) {
+	if rootfs.TarFilePath == "" && RootFSVersion == "" {
+		_, err := rootfs.EnsureCachedRootFS(openRootFSCache(), &UpdateRootFSFields)
+		cobra.CheckErr(err)
+	}
+	tarFilePath, checksum, err := resolveRootFS()
+	cobra.CheckErr(err)
+	tarFilePath, err = customizeRootFS(tarFilePath, checksum)
+	cobra.CheckErr(err)
+
+	installationDir, err := rootfs.EnsureWSLDirectory(rootfs.HomeDir, DistributionName)
+	cobra.CheckErr(err)
+
+	runtime.ErrorHandlers = runtime.ErrorHandlers[:0]
+	cobra.CheckErr(cluster.UpgradeCluster(DistributionName, &cluster.UpgradeOptions{
+		RootFS:        tarFilePath,
+		InstallDir:    installationDir,
+		BackupDir:     filepath.Join(rootfs.HomeDir, BackupDirName),
+		KeepPaths:     KeepPaths,
+		KeepSnapshot:  KeepSnapshot,
+		LogLevel:      LogLevel,
+		Timeout:       time.Second * time.Duration(UpgradeWaitTimeout),
+		Filter:        workloadFilter(),
+		Configuration: ConfigurationOptions,
+	}))
+	recordInstalledRootFS(checksum)
+	configureIngressDomainsIfEnabled()
+}
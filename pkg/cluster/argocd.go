@@ -0,0 +1,120 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// DefaultApplicationsNamespace is the namespace of the Argo CD applications.
+const DefaultApplicationsNamespace = "argocd"
+
+// RefreshAnnotation makes Argo CD refresh the application. Argo CD removes
+// it once the refresh is done.
+const RefreshAnnotation = "argocd.argoproj.io/refresh"
+
+// syncInitiator is the user name recorded in the sync operations.
+const syncInitiator = "kaweezle"
+
+var ApplicationsResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+
+// SelectApplications returns the applications of namespace named names, or
+// all of them if names is empty.
+func SelectApplications(ctx context.Context, client dynamic.Interface, namespace string, names []string) (result []*unstructured.Unstructured, err error) {
+	applications := client.Resource(ApplicationsResource).Namespace(namespace)
+	if len(names) == 0 {
+		var list *unstructured.UnstructuredList
+		if list, err = applications.List(ctx, metav1.ListOptions{}); err != nil {
+			return nil, errors.Wrap(err, "while listing applications")
+		}
+		for i := range list.Items {
+			result = append(result, &list.Items[i])
+		}
+		return
+	}
+	for _, name := range names {
+		var application *unstructured.Unstructured
+		if application, err = applications.Get(ctx, name, metav1.GetOptions{}); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, fmt.Errorf("application %s not found in namespace %s", name, namespace)
+			}
+			return nil, err
+		}
+		result = append(result, application)
+	}
+	return
+}
+
+func patchApplication(ctx context.Context, client dynamic.Interface, application *unstructured.Unstructured, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = client.Resource(ApplicationsResource).Namespace(application.GetNamespace()).
+		Patch(ctx, application.GetName(), types.MergePatchType, data, metav1.PatchOptions{})
+	return errors.Wrapf(err, "while patching application %s", application.GetName())
+}
+
+// RefreshApplication asks Argo CD to compare application with its source
+// again. A hard refresh also invalidates the cached manifests.
+func RefreshApplication(ctx context.Context, client dynamic.Interface, application *unstructured.Unstructured, hard bool) error {
+	refresh := "normal"
+	if hard {
+		refresh = "hard"
+	}
+	return patchApplication(ctx, client, application, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{RefreshAnnotation: refresh},
+		},
+	})
+}
+
+// SyncApplication creates a sync operation on application to its target
+// revision. With prune, the resources no longer in the source are deleted.
+// It fails if an operation is already in progress.
+func SyncApplication(ctx context.Context, client dynamic.Interface, application *unstructured.Unstructured, prune bool) error {
+	if _, found, _ := unstructured.NestedMap(application.Object, "operation"); found {
+		return fmt.Errorf("another operation is already in progress on application %s", application.GetName())
+	}
+	return patchApplication(ctx, client, application, map[string]interface{}{
+		"operation": map[string]interface{}{
+			"initiatedBy": map[string]interface{}{"username": syncInitiator},
+			"sync": map[string]interface{}{
+				"prune":        prune,
+				"syncStrategy": map[string]interface{}{"hook": map[string]interface{}{}},
+			},
+		},
+	})
+}
+
+// ApplicationsFilter returns the filter selecting the applications of
+// namespace named names, or all of them if names is empty.
+func ApplicationsFilter(namespace string, names []string) *WorkloadFilter {
+	filter := &WorkloadFilter{Namespace: namespace, Kinds: []string{ApplicationsResource.GroupResource().String()}}
+	for _, name := range names {
+		filter.Include = append(filter.Include, fmt.Sprintf("%s/%s/%s", namespace, ApplicationsResource.Resource, name))
+	}
+	return filter
+}
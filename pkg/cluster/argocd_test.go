@@ -0,0 +1,82 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSyncApplications(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeDynamicClient(testApplication("apps", "Healthy"), testApplication("demo", "Degraded"))
+
+	applications, err := SelectApplications(ctx, client, "argocd", nil)
+	require.NoError(t, err)
+	assert.Len(t, applications, 2)
+	_, err = SelectApplications(ctx, client, "argocd", []string{"demo", "missing"})
+	assert.EqualError(t, err, "application missing not found in namespace argocd")
+	applications, err = SelectApplications(ctx, client, "argocd", []string{"demo"})
+	require.NoError(t, err)
+	require.Len(t, applications, 1)
+
+	require.NoError(t, RefreshApplication(ctx, client, applications[0], true))
+	require.NoError(t, SyncApplication(ctx, client, applications[0], true))
+	demo, err := client.Resource(ApplicationsResource).Namespace("argocd").Get(ctx, "demo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "hard", demo.GetAnnotations()[RefreshAnnotation])
+	prune, _, _ := unstructured.NestedBool(demo.Object, "operation", "sync", "prune")
+	assert.True(t, prune)
+
+	assert.Error(t, SyncApplication(ctx, client, demo, false), "an operation is in progress")
+
+	_, ok, err := (&ApplicationStatusViewer{}).Status(demo, 0)
+	require.NoError(t, err)
+	assert.False(t, ok, "a pending refresh makes the status stale")
+}
+
+func TestApplicationOutOfSync(t *testing.T) {
+	application := testApplication("demo", "Healthy")
+	status := application.Object["status"].(map[string]interface{})
+	status["sync"] = map[string]interface{}{"status": "OutOfSync"}
+	resources := []interface{}{
+		map[string]interface{}{"kind": "Namespace", "name": "demo", "status": "Synced"},
+		map[string]interface{}{"group": "apps", "kind": "Deployment", "namespace": "demo", "name": "web", "status": "OutOfSync"},
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		resources = append(resources, map[string]interface{}{"kind": "ConfigMap", "namespace": "demo", "name": name, "status": "OutOfSync"})
+	}
+	status["resources"] = resources
+	status["operationState"] = map[string]interface{}{"phase": "Failed", "message": "one or more objects failed to apply"}
+
+	message, ok, err := (&ApplicationStatusViewer{}).Status(application, 0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, `application "demo" sync status: OutOfSync, health status: Healthy, out of sync: Deployment/demo/web, ConfigMap/demo/a, ConfigMap/demo/b, ConfigMap/demo/c, ConfigMap/demo/d, and 1 more, operation Failed: one or more objects failed to apply`, message)
+}
+
+func TestApplicationsFilter(t *testing.T) {
+	filter := ApplicationsFilter("argocd", []string{"demo"})
+	require.NoError(t, filter.Validate())
+	assert.Equal(t, []string{"applications.argoproj.io"}, filter.Kinds)
+	assert.False(t, filter.Excludes(&WorkloadState{Namespace: "argocd", Name: "applications/demo"}))
+	assert.True(t, filter.Excludes(&WorkloadState{Namespace: "argocd", Name: "applications/apps"}))
+	assert.Empty(t, ApplicationsFilter("argocd", nil).Include)
+}
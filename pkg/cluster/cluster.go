@@ -16,26 +16,25 @@ limitations under the License.
 package cluster
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/kaweezle/kaweezle/pkg/k8s"
 	"github.com/kaweezle/kaweezle/pkg/logger"
 	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/yuk7/wsllib-go"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 )
 
-type ClusterStatus int16
+const apiProbeTimeout = 5 * time.Second
 
-const (
-	Undefined ClusterStatus = iota
-	Uninstalled
-	Installed
-	Started
-)
+const diagnoseTimeout = 30 * time.Second
 
 var startClusterFields = log.Fields{
 	logger.TaskKey: "Start Cluster",
@@ -49,19 +48,8 @@ var waitClusterFields = log.Fields{
 	logger.TaskKey: "Wait for cluster to settle",
 }
 
-func (s ClusterStatus) String() (r string) {
-
-	switch s {
-	case Undefined:
-		r = "undefined"
-	case Uninstalled:
-		r = "uninstalled"
-	case Installed:
-		r = "installed"
-	case Started:
-		r = "started"
-	}
-	return
+var diagnoseClusterFields = log.Fields{
+	logger.TaskKey: "Diagnose cluster",
 }
 
 func GetClusterStatus(distributionName string) (status ClusterStatus, err error) {
@@ -95,6 +83,90 @@ func GetClusterStatus(distributionName string) (status ClusterStatus, err error)
 	return
 }
 
+// GetClusterState returns the detailed state of the cluster. The guest is
+// only probed when the distribution is running in order to avoid booting it.
+func GetClusterState(distributionName string) (state *ClusterState, err error) {
+	state = &ClusterState{Name: distributionName, Status: Uninstalled}
+	if !wsllib.WslIsDistributionRegistered(distributionName) {
+		state.UpdatePhase()
+		return
+	}
+	state.Status = Installed
+
+	var distribution wsl.DistributionInformation
+	if distribution, err = wsl.GetDistribution(distributionName); err != nil {
+		return
+	}
+	state.Running = distribution.State == wsl.Running
+	if state.Running {
+		var output []byte
+		if output, err = wsl.WslCommand(distributionName, "/bin/sh", "-c", guestProbeScript); err != nil {
+			err = errors.Wrapf(err, "while probing distribution %s", distributionName)
+			return
+		}
+		state.GuestState = ParseGuestProbe(string(output))
+		if state.Service == ServiceStarted {
+			state.Status = Started
+			if probeErr := probeKubernetes(state); probeErr != nil {
+				log.WithError(probeErr).WithField("distribution_name", distributionName).Debug("Kubernetes API not available")
+			}
+		}
+	}
+	state.UpdatePhase()
+	log.WithFields(log.Fields{
+		"distribution_name": distributionName,
+		"phase":             state.Phase,
+	}).Trace("Cluster state")
+	return
+}
+
+// diagnoseCluster logs a triage summary of the unready workloads and saves
+// the details in DiagnosticsFile if set.
+func diagnoseCluster(distributionName string, unready []*WorkloadState) {
+	client, err := k8s.ClientSetForDistribution(distributionName)
+	if err != nil {
+		log.WithError(err).WithFields(diagnoseClusterFields).Warn("Couldn't diagnose the cluster")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	diagnostics, err := Diagnose(ctx, client, unready, DiagnosticsLogLines)
+	if err != nil {
+		log.WithError(err).WithFields(diagnoseClusterFields).Warn("Couldn't diagnose the cluster")
+		return
+	}
+	for _, line := range diagnostics.Summary() {
+		log.WithFields(diagnoseClusterFields).Warn(line)
+	}
+
+	if DiagnosticsFile == "" {
+		return
+	}
+	var file *os.File
+	if file, err = os.Create(DiagnosticsFile); err == nil {
+		err = diagnostics.Write(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.WithError(err).WithFields(diagnoseClusterFields).Warnf("Couldn't save the diagnostics in %s", DiagnosticsFile)
+	} else {
+		log.WithFields(diagnoseClusterFields).Infof("Diagnostics saved in %s", DiagnosticsFile)
+	}
+}
+
+func probeKubernetes(state *ClusterState) (err error) {
+	var client *kubernetes.Clientset
+	if client, err = k8s.ClientSetForDistribution(state.Name); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiProbeTimeout)
+	defer cancel()
+	return state.ProbeKubernetes(ctx, client)
+}
+
 func StartCluster(distributionName string, logLevel string) (err error) {
 	startCommand := fmt.Sprintf("/sbin/iknite '--json' -v %s '--cluster-name' %s start", logLevel, distributionName)
 	log.WithFields(startClusterFields).WithFields(log.Fields{
@@ -142,30 +214,8 @@ func StopCluster(distributionName string) (err error) {
 	return
 }
 
-func arePodsReady(c kubernetes.Interface, fields *log.Fields) wait.ConditionFunc {
-	return func() (bool, error) {
-
-		active, unready, stopped, err := k8s.GetPodStatus(c)
-		if err != nil {
-			return false, err
-		}
-		log.WithFields(*fields).WithFields(log.Fields{
-			"active":  len(active),
-			"unready": len(unready),
-			"stopped": len(stopped),
-		}).Infof("active: %d, unready: %d, stopped:%d", len(active), len(unready), len(stopped))
-		if len(stopped) > 0 {
-			return false, fmt.Errorf("stopped pods: %d", len(stopped))
-		}
-		return len(active) > 0 && len(unready) == 0, nil
-	}
-}
-
-func waitForPodsReady(c kubernetes.Interface, timeout time.Duration, fields *log.Fields) error {
-	return wait.PollImmediate(time.Second, timeout, arePodsReady(c, fields))
-}
-
-func WaitForCluster(distributionName string, timeout time.Duration) (err error) {
+// WaitForCluster waits for the workloads selected by filter to be ready.
+func WaitForCluster(distributionName string, filter *WorkloadFilter, timeout time.Duration) (err error) {
 	log.WithFields(waitClusterFields).WithFields(log.Fields{
 		"distribution_name": distributionName,
 	}).Info("Wait for kubernetes...")
@@ -175,16 +225,49 @@ func WaitForCluster(distributionName string, timeout time.Duration) (err error)
 		return
 	}
 
-	err = WaitForWorkloads(client, timeout, func(state bool, total int, ready, unready []*WorkloadState) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	var unready []*WorkloadState
+	var failure error
+	if FailFast {
+		var clientset *kubernetes.Clientset
+		if clientset, err = k8s.ClientSetForDistribution(distributionName); err != nil {
+			return
+		}
+		go func() {
+			if err := watchPodFailures(ctx, clientset, filter, FailureThreshold, failFastInterval, &waitClusterFields); err != nil && ctx.Err() == nil {
+				mutex.Lock()
+				failure = err
+				mutex.Unlock()
+				cancel()
+			}
+		}()
+	}
+
+	err = WaitForWorkloadsContext(ctx, client, filter, timeout, func(state bool, total int, ready, notReady []*WorkloadState) {
+		mutex.Lock()
+		// Ignored workloads are not worth a diagnosis
+		unready = BlockingWorkloadStates(notReady)
+		mutex.Unlock()
 		log.WithFields(waitClusterFields).WithFields(log.Fields{
 			"total":   total,
 			"ready":   len(ready),
-			"unready": len(unready),
-		}).Infof("Workloads total: %d, ready: %d, unready: %d", total, len(ready), len(unready))
+			"unready": len(notReady),
+		}).Infof("Workloads total: %d, ready: %d, unready: %d", total, len(ready), len(notReady))
 	})
 
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err != nil && failure != nil {
+		err = failure
+	}
 	if err != nil {
 		log.WithError(err).WithFields(waitClusterFields).Error("Kubernetes not ready")
+		if _, failed := err.(*PodFailureError); failed || err == wait.ErrWaitTimeout {
+			diagnoseCluster(distributionName, unready)
+		}
 	} else {
 		log.WithError(err).WithFields(waitClusterFields).Info("Cluster ready")
 	}
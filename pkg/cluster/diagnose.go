@@ -0,0 +1,318 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultDiagnosticsLogLines is the number of log lines kept for each
+// failing container.
+const DefaultDiagnosticsLogLines = 20
+
+var (
+	// DiagnosticsFile is the file where the details of the diagnostics are
+	// saved when the cluster doesn't become ready. Empty means not saved.
+	DiagnosticsFile string
+	// DiagnosticsLogLines is the number of log lines kept for each failing
+	// container.
+	DiagnosticsLogLines int64 = DefaultDiagnosticsLogLines
+)
+
+// benignWaitingReasons are the waiting reasons of containers that are simply
+// starting.
+var benignWaitingReasons = map[string]bool{
+	"ContainerCreating": true,
+	"PodInitializing":   true,
+}
+
+// ContainerDiagnostic describes a failing container.
+type ContainerDiagnostic struct {
+	Name string
+	// Reason is the waiting or termination reason, e.g. CrashLoopBackOff.
+	Reason       string
+	Message      string
+	RestartCount int32
+	// Logs are the last lines of the container, or of its previous instance
+	// if it has restarted.
+	Logs []string
+}
+
+// PodDiagnostic describes a pod of an unready workload.
+type PodDiagnostic struct {
+	Name       string
+	Phase      v1.PodPhase
+	Containers []*ContainerDiagnostic
+}
+
+// WorkloadDiagnostic gathers the information about an unready workload.
+type WorkloadDiagnostic struct {
+	*WorkloadState
+	Pods []*PodDiagnostic
+	// Events are the recent warning events of the workload and its pods.
+	Events []string
+}
+
+// Diagnostics is the result of the triage of a cluster that doesn't become
+// ready.
+type Diagnostics struct {
+	Workloads      []*WorkloadDiagnostic
+	NodeConditions []NodeCondition
+	ReadyzChecks   []ReadyzCheck
+}
+
+// podSelector returns the selector of the pods of the workload, or nil if the
+// workload has no pods.
+func podSelector(ctx context.Context, client kubernetes.Interface, namespace string, resource string, name string) (selector labels.Selector, err error) {
+	var labelSelector *metav1.LabelSelector
+	switch resource {
+	case "deployments":
+		deployment, e := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = e; err == nil {
+			labelSelector = deployment.Spec.Selector
+		}
+	case "statefulsets":
+		statefulSet, e := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = e; err == nil {
+			labelSelector = statefulSet.Spec.Selector
+		}
+	case "daemonsets":
+		daemonSet, e := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = e; err == nil {
+			labelSelector = daemonSet.Spec.Selector
+		}
+	case "jobs":
+		job, e := client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = e; err == nil {
+			labelSelector = job.Spec.Selector
+		}
+	}
+	if err != nil || labelSelector == nil {
+		return
+	}
+	return metav1.LabelSelectorAsSelector(labelSelector)
+}
+
+func containerLogs(ctx context.Context, client kubernetes.Interface, pod *v1.Pod, container string, previous bool, lines int64) []string {
+	stream, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &v1.PodLogOptions{
+		Container: container,
+		Previous:  previous,
+		TailLines: &lines,
+	}).Stream(ctx)
+	if err != nil {
+		return []string{fmt.Sprintf("<logs not available: %v>", err)}
+	}
+	defer stream.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		result = append(result, scanner.Text())
+	}
+	return result
+}
+
+func diagnosePod(ctx context.Context, client kubernetes.Interface, pod *v1.Pod, logLines int64) *PodDiagnostic {
+	result := &PodDiagnostic{Name: pod.Name, Phase: pod.Status.Phase}
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		container := &ContainerDiagnostic{Name: status.Name, RestartCount: status.RestartCount}
+		switch {
+		case status.State.Waiting != nil && !benignWaitingReasons[status.State.Waiting.Reason]:
+			container.Reason = status.State.Waiting.Reason
+			container.Message = status.State.Waiting.Message
+		case status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+			container.Reason = status.State.Terminated.Reason
+			container.Message = status.State.Terminated.Message
+		case status.RestartCount > 0 && !status.Ready:
+			container.Reason = "Restarting"
+		default:
+			continue
+		}
+		if logLines > 0 {
+			container.Logs = containerLogs(ctx, client, pod, status.Name, status.RestartCount > 0, logLines)
+		}
+		result.Containers = append(result.Containers, container)
+	}
+	return result
+}
+
+func warningEvents(events []v1.Event, names map[string]bool) (result []string) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LastTimestamp.Before(&events[j].LastTimestamp)
+	})
+	for _, event := range events {
+		if event.Type != v1.EventTypeWarning || !names[event.InvolvedObject.Name] {
+			continue
+		}
+		line := fmt.Sprintf("%s %s/%s: %s", event.Reason, strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, strings.TrimSpace(event.Message))
+		if event.Count > 1 {
+			line += fmt.Sprintf(" (x%d)", event.Count)
+		}
+		result = append(result, line)
+	}
+	return
+}
+
+// Diagnose collects the pods, containers, logs and warning events of the
+// unready workloads, along with the conditions of the nodes. logLines is the
+// number of log lines to keep for each failing container.
+func Diagnose(ctx context.Context, client kubernetes.Interface, unready []*WorkloadState, logLines int64) (diagnostics *Diagnostics, err error) {
+	diagnostics = &Diagnostics{}
+
+	state := &ClusterState{}
+	if err = state.ProbeKubernetes(ctx, client); err != nil {
+		return
+	}
+	diagnostics.NodeConditions = state.NodeConditions
+	for _, check := range state.ReadyzChecks {
+		if !check.Ok {
+			diagnostics.ReadyzChecks = append(diagnostics.ReadyzChecks, check)
+		}
+	}
+
+	events := make(map[string][]v1.Event)
+	for _, workload := range unready {
+		diagnostic := &WorkloadDiagnostic{WorkloadState: workload}
+		diagnostics.Workloads = append(diagnostics.Workloads, diagnostic)
+
+		resource, name, _ := strings.Cut(workload.Name, "/")
+		names := map[string]bool{name: true}
+
+		var selector labels.Selector
+		if selector, err = podSelector(ctx, client, workload.Namespace, resource, name); err != nil {
+			diagnostic.Events = append(diagnostic.Events, fmt.Sprintf("<workload not available: %v>", err))
+			err = nil
+			continue
+		}
+		if selector != nil {
+			var pods *v1.PodList
+			if pods, err = client.CoreV1().Pods(workload.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()}); err != nil {
+				return
+			}
+			for i := range pods.Items {
+				pod := &pods.Items[i]
+				names[pod.Name] = true
+				diagnostic.Pods = append(diagnostic.Pods, diagnosePod(ctx, client, pod, logLines))
+			}
+		}
+
+		namespaceEvents, ok := events[workload.Namespace]
+		if !ok {
+			var list *v1.EventList
+			if list, err = client.CoreV1().Events(workload.Namespace).List(ctx, metav1.ListOptions{FieldSelector: "type=Warning"}); err != nil {
+				return
+			}
+			namespaceEvents = list.Items
+			events[workload.Namespace] = namespaceEvents
+		}
+		diagnostic.Events = warningEvents(namespaceEvents, names)
+	}
+	return
+}
+
+// Reason returns the most relevant reason of the workload being unready: the
+// first failing container, then the last warning event and finally the
+// workload status message.
+func (d *WorkloadDiagnostic) Reason() string {
+	for _, pod := range d.Pods {
+		for _, container := range pod.Containers {
+			reason := fmt.Sprintf("pod %s container %s %s", pod.Name, container.Name, container.Reason)
+			if container.RestartCount > 0 {
+				reason += fmt.Sprintf(" (%d restarts)", container.RestartCount)
+			}
+			if container.Message != "" {
+				reason += ": " + container.Message
+			}
+			return reason
+		}
+	}
+	if len(d.Events) > 0 {
+		return d.Events[len(d.Events)-1]
+	}
+	for _, pod := range d.Pods {
+		if pod.Phase != v1.PodRunning {
+			return fmt.Sprintf("pod %s is %s", pod.Name, pod.Phase)
+		}
+	}
+	return d.Message
+}
+
+// Summary returns one triage line per unready workload and per failing node
+// condition or API server check.
+func (d *Diagnostics) Summary() (lines []string) {
+	for _, workload := range d.Workloads {
+		lines = append(lines, fmt.Sprintf("%s/%s: %s", workload.Namespace, workload.Name, workload.Reason()))
+	}
+	for _, condition := range d.NodeConditions {
+		if !condition.Ok {
+			lines = append(lines, fmt.Sprintf("node %s: %s", condition.Type, condition.Message))
+		}
+	}
+	for _, check := range d.ReadyzChecks {
+		lines = append(lines, fmt.Sprintf("API server check %s: %s", check.Name, check.Message))
+	}
+	return
+}
+
+// Write writes the detailed diagnostics to w.
+func (d *Diagnostics) Write(w io.Writer) (err error) {
+	p := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	p("# Node conditions\n\n")
+	for _, condition := range d.NodeConditions {
+		p("%s %s %s\n", OkString(condition.Ok), condition.Type, condition.Message)
+	}
+	for _, check := range d.ReadyzChecks {
+		p("%s API server check %s %s\n", OkString(false), check.Name, check.Message)
+	}
+
+	for _, workload := range d.Workloads {
+		p("\n# %s/%s\n\n%s\n", workload.Namespace, workload.Name, workload.Message)
+		for _, pod := range workload.Pods {
+			p("\n## Pod %s (%s)\n", pod.Name, pod.Phase)
+			for _, container := range pod.Containers {
+				p("\n### Container %s: %s (%d restarts)\n", container.Name, container.Reason, container.RestartCount)
+				if container.Message != "" {
+					p("%s\n", container.Message)
+				}
+				for _, line := range container.Logs {
+					p("    %s\n", line)
+				}
+			}
+		}
+		if len(workload.Events) > 0 {
+			p("\n## Warning events\n\n")
+			for _, event := range workload.Events {
+				p("%s\n", event)
+			}
+		}
+	}
+	return
+}
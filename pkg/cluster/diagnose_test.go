@@ -0,0 +1,108 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiagnose(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	client := fake.NewSimpleClientset(
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node"},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+				{Type: v1.NodeDiskPressure, Status: v1.ConditionTrue, Message: "disk full"},
+			}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: labels}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1", Labels: labels},
+			Status: v1.PodStatus{
+				Phase: v1.PodRunning,
+				ContainerStatuses: []v1.ContainerStatus{
+					{Name: "sidecar", Ready: true},
+					{Name: "web", RestartCount: 4, State: v1.ContainerState{
+						Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off 40s"},
+					}},
+				},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"},
+			Status:     v1.PodStatus{Phase: v1.PodPending},
+		},
+		&v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e1"},
+			InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "web-1"},
+			Type:           v1.EventTypeWarning,
+			Reason:         "BackOff",
+			Message:        "Back-off restarting failed container",
+			Count:          3,
+		},
+		&v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e2"},
+			InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "other"},
+			Type:           v1.EventTypeWarning,
+			Reason:         "FailedScheduling",
+		},
+		&v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "argocd", Name: "e3"},
+			InvolvedObject: v1.ObjectReference{Kind: "Application", Name: "apps"},
+			Type:           v1.EventTypeWarning,
+			Reason:         "OperationFailed",
+			Message:        "sync failed",
+		},
+	)
+
+	diagnostics, err := Diagnose(context.Background(), client, []*WorkloadState{
+		{Namespace: "default", Name: "deployments/web", Message: "0 of 1 updated replicas are available"},
+		{Namespace: "argocd", Name: "applications/apps", Message: "health status: Degraded"},
+	}, 5)
+	require.NoError(t, err)
+
+	require.Len(t, diagnostics.Workloads, 2)
+	web := diagnostics.Workloads[0]
+	require.Len(t, web.Pods, 1)
+	require.Len(t, web.Pods[0].Containers, 1, "only the failing container should be reported")
+	container := web.Pods[0].Containers[0]
+	assert.Equal(t, "CrashLoopBackOff", container.Reason)
+	assert.Equal(t, []string{"fake logs"}, container.Logs)
+	assert.Equal(t, []string{"BackOff pod/web-1: Back-off restarting failed container (x3)"}, web.Events)
+
+	assert.Equal(t, []string{
+		"default/deployments/web: pod web-1 container web CrashLoopBackOff (4 restarts): back-off 40s",
+		"argocd/applications/apps: OperationFailed application/apps: sync failed",
+		"node DiskPressure: disk full",
+	}, diagnostics.Summary())
+
+	var buffer bytes.Buffer
+	require.NoError(t, diagnostics.Write(&buffer))
+	assert.Contains(t, buffer.String(), "    fake logs\n")
+	assert.Contains(t, buffer.String(), "# argocd/applications/apps\n")
+}
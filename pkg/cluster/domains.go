@@ -0,0 +1,115 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var HTTPRoutesResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+
+// normalizeDomain lower cases domain and removes its leading and trailing
+// dots.
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// MatchesDomainSuffix tells if host is one of suffixes or a sub domain of
+// one of them. An empty suffixes matches all hosts.
+func MatchesDomainSuffix(host string, suffixes []string) bool {
+	if len(suffixes) == 0 {
+		return true
+	}
+	host = normalizeDomain(host)
+	for _, suffix := range suffixes {
+		suffix = normalizeDomain(suffix)
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterHostnames returns the sorted host names of the Ingresses and of the
+// Gateway API HTTPRoutes of the cluster that match suffixes. Wildcard hosts
+// are skipped as they can't be put in a hosts file. HTTPRoutes are ignored
+// when the Gateway API is not installed.
+func ClusterHostnames(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, suffixes []string) ([]string, error) {
+	hosts := sets.New[string]()
+	add := func(host string) {
+		host = normalizeDomain(host)
+		if host != "" && !strings.Contains(host, "*") && MatchesDomainSuffix(host, suffixes) {
+			hosts.Insert(host)
+		}
+	}
+
+	ingresses, err := client.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "while listing ingresses")
+	}
+	for _, ingress := range ingresses.Items {
+		for _, rule := range ingress.Spec.Rules {
+			add(rule.Host)
+		}
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				add(host)
+			}
+		}
+	}
+
+	routes, err := dynamicClient.Resource(HTTPRoutesResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "while listing HTTP routes")
+	}
+	if err == nil {
+		for _, route := range routes.Items {
+			hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+			for _, host := range hostnames {
+				add(host)
+			}
+		}
+	}
+	return sets.List(hosts), nil
+}
+
+// StaleDomains returns the domains of current that match suffixes and are
+// neither in wanted nor in kept. These are the host names that were mapped
+// from routes that don't exist anymore.
+func StaleDomains(current, wanted, kept, suffixes []string) []string {
+	known := sets.New[string]()
+	for _, domain := range append(append([]string{}, wanted...), kept...) {
+		known.Insert(normalizeDomain(domain))
+	}
+	var stale []string
+	for _, domain := range current {
+		if !known.Has(normalizeDomain(domain)) && MatchesDomainSuffix(domain, suffixes) {
+			stale = append(stale, domain)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testIngress(name string, hosts ...string) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	for _, host := range hosts {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{Host: host})
+	}
+	return ingress
+}
+
+func testHTTPRoute(name string, hostnames ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]interface{}{"namespace": "default", "name": name},
+		"spec":       map[string]interface{}{"hostnames": hostnames},
+	}}
+}
+
+func TestClusterHostnames(t *testing.T) {
+	ctx := context.Background()
+	tls := testIngress("argocd", "argocd.localhost", "")
+	tls.Spec.TLS = []networkingv1.IngressTLS{{Hosts: []string{"ArgoCD.localhost", "*.apps.localhost"}}}
+	client := fake.NewSimpleClientset(tls, testIngress("grafana", "grafana.example.com"))
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		HTTPRoutesResource: "HTTPRouteList",
+	}, testHTTPRoute("web", "web.localhost", "argocd.localhost"))
+
+	hosts, err := ClusterHostnames(ctx, client, dynamicClient, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"argocd.localhost", "grafana.example.com", "web.localhost"}, hosts)
+
+	hosts, err = ClusterHostnames(ctx, client, dynamicClient, []string{".localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"argocd.localhost", "web.localhost"}, hosts)
+
+	// Without the Gateway API, only the ingresses are listed
+	dynamicClient.PrependReactor("list", "httproutes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(HTTPRoutesResource.GroupResource(), "")
+	})
+	hosts, err = ClusterHostnames(ctx, client, dynamicClient, []string{"localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"argocd.localhost"}, hosts)
+}
+
+func TestStaleDomains(t *testing.T) {
+	assert.True(t, MatchesDomainSuffix("localhost", []string{"localhost"}))
+	assert.False(t, MatchesDomainSuffix("mylocalhost", []string{"localhost"}))
+
+	current := []string{"old.localhost", "argocd.localhost", "manual.localhost", "other.example.com"}
+	assert.Equal(t, []string{"old.localhost"},
+		StaleDomains(current, []string{"argocd.localhost"}, []string{"manual.localhost"}, []string{"localhost"}))
+	assert.Equal(t, []string{"old.localhost", "other.example.com"},
+		StaleDomains(current, []string{"argocd.localhost"}, []string{"Manual.localhost"}, nil))
+}
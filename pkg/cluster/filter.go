@@ -0,0 +1,127 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// WorkloadFilter restricts the workloads considered for readiness.
+//
+// Include, Exclude and Ignore contain glob patterns matched against
+// <namespace>/<resource>/<name>, for instance demo/deployments/* or
+// argocd/applications/demo-*. A pattern without slash matches a namespace.
+// When Include is set, only the matching workloads are tracked. Excluded
+// workloads are not tracked at all while ignored ones are shown but don't
+// prevent the cluster from being ready.
+type WorkloadFilter struct {
+	// Namespace is the only namespace to look into. Empty means all.
+	Namespace string
+	// Selector is a label selector, e.g. app.kubernetes.io/part-of=argocd.
+	Selector string
+	// Kinds are the resources to track, e.g. deployments or applications.
+	// Empty means the default workload kinds.
+	Kinds   []string
+	Include []string
+	Exclude []string
+	Ignore  []string
+}
+
+// Validate checks the selector and the patterns.
+func (f *WorkloadFilter) Validate() (err error) {
+	if f == nil {
+		return
+	}
+	if _, err = labels.Parse(f.Selector); err != nil {
+		return errors.Wrapf(err, "bad selector %s", f.Selector)
+	}
+	for _, pattern := range append(append(append([]string{}, f.Include...), f.Exclude...), f.Ignore...) {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "bad workload pattern %s", pattern)
+		}
+	}
+	return
+}
+
+func matchWorkload(patterns []string, state *WorkloadState) bool {
+	target := fmt.Sprintf("%s/%s", state.Namespace, state.Name)
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, state.Namespace); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Excludes tells if the workload must not be tracked.
+func (f *WorkloadFilter) Excludes(state *WorkloadState) bool {
+	if f == nil {
+		return false
+	}
+	if len(f.Include) > 0 && !matchWorkload(f.Include, state) {
+		return true
+	}
+	return matchWorkload(f.Exclude, state)
+}
+
+// Ignores tells if the workload readiness must not be waited for.
+func (f *WorkloadFilter) Ignores(state *WorkloadState) bool {
+	return f != nil && matchWorkload(f.Ignore, state)
+}
+
+func (f *WorkloadFilter) namespace() string {
+	if f == nil {
+		return ""
+	}
+	return f.Namespace
+}
+
+func (f *WorkloadFilter) selector() string {
+	if f == nil {
+		return ""
+	}
+	return f.Selector
+}
+
+func (f *WorkloadFilter) kinds() []string {
+	if f == nil {
+		return nil
+	}
+	return f.Kinds
+}
+
+// apply removes the excluded workloads from states and marks the ignored
+// ones.
+func (f *WorkloadFilter) apply(states []*WorkloadState) (result []*WorkloadState) {
+	for _, state := range states {
+		if f.Excludes(state) {
+			continue
+		}
+		state.Ignored = f.Ignores(state)
+		result = append(result, state)
+	}
+	return
+}
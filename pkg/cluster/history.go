@@ -0,0 +1,102 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WorkloadEntry is the state of a workload along with its last transition.
+type WorkloadEntry struct {
+	*WorkloadState
+	// Since is the time of the last readiness change, or of the first time
+	// the workload was seen.
+	Since time.Time
+	// Regressed tells that the workload became unready after being ready.
+	Regressed bool
+}
+
+// WorkloadHistory follows the readiness transitions of workloads over
+// successive updates.
+type WorkloadHistory struct {
+	// Started is the time of the history creation.
+	Started time.Time
+	// ReadyAt is the time at which all the workloads became ready, zero if
+	// they are not.
+	ReadyAt time.Time
+	// Regressions counts the workloads that became unready after being
+	// ready.
+	Regressions int
+
+	entries map[string]*WorkloadEntry
+	now     func() time.Time
+}
+
+func NewWorkloadHistory() *WorkloadHistory {
+	return newWorkloadHistory(time.Now)
+}
+
+func newWorkloadHistory(now func() time.Time) *WorkloadHistory {
+	return &WorkloadHistory{
+		Started: now(),
+		entries: make(map[string]*WorkloadEntry),
+		now:     now,
+	}
+}
+
+// Update records the new states of the workloads. ready is the overall
+// readiness of the states.
+func (h *WorkloadHistory) Update(ready bool, states []*WorkloadState) {
+	now := h.now()
+	entries := make(map[string]*WorkloadEntry, len(states))
+	for _, state := range states {
+		key := fmt.Sprintf("%s/%s", state.Namespace, state.Name)
+		entry := &WorkloadEntry{WorkloadState: state, Since: now}
+		if previous, ok := h.entries[key]; ok {
+			if previous.Ok == state.Ok {
+				entry.Since = previous.Since
+				entry.Regressed = previous.Regressed
+			} else if !state.Ok {
+				entry.Regressed = true
+				h.Regressions++
+			}
+		}
+		entries[key] = entry
+	}
+	h.entries = entries
+
+	if !ready {
+		h.ReadyAt = time.Time{}
+	} else if h.ReadyAt.IsZero() {
+		h.ReadyAt = now
+	}
+}
+
+// Entries returns the workload entries sorted by namespace and name.
+func (h *WorkloadHistory) Entries() []*WorkloadEntry {
+	result := make([]*WorkloadEntry, 0, len(h.entries))
+	for _, entry := range h.entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadHistory(t *testing.T) {
+	start := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	now := start
+	history := newWorkloadHistory(func() time.Time { return now })
+
+	history.Update(false, []*WorkloadState{
+		{Namespace: "kube-system", Name: "deployments/coredns", Ok: true},
+		{Namespace: "default", Name: "deployments/app"},
+	})
+	entries := history.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "default", entries[0].Namespace, "entries should be sorted by namespace")
+	assert.Equal(t, start, entries[0].Since)
+	assert.True(t, history.ReadyAt.IsZero())
+
+	now = start.Add(time.Minute)
+	history.Update(true, []*WorkloadState{
+		{Namespace: "kube-system", Name: "deployments/coredns", Ok: true},
+		{Namespace: "default", Name: "deployments/app", Ok: true},
+	})
+	entries = history.Entries()
+	assert.Equal(t, now, entries[0].Since, "transition time should change")
+	assert.Equal(t, start, entries[1].Since, "transition time shouldn't change without transition")
+	assert.Equal(t, now, history.ReadyAt)
+
+	now = start.Add(2 * time.Minute)
+	history.Update(false, []*WorkloadState{
+		{Namespace: "kube-system", Name: "deployments/coredns"},
+		{Namespace: "default", Name: "deployments/app", Ok: true},
+	})
+	entries = history.Entries()
+	assert.True(t, entries[1].Regressed)
+	assert.False(t, entries[0].Regressed)
+	assert.Equal(t, 1, history.Regressions)
+	assert.True(t, history.ReadyAt.IsZero())
+
+	now = start.Add(3 * time.Minute)
+	history.Update(false, []*WorkloadState{
+		{Namespace: "kube-system", Name: "deployments/coredns"},
+	})
+	entries = history.Entries()
+	require.Len(t, entries, 1, "deleted workloads should be removed")
+	assert.True(t, entries[0].Regressed, "regression should be kept while unready")
+}
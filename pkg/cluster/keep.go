@@ -0,0 +1,106 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultKeepPaths are the paths of the distribution that survive an
+// upgrade: the keys and configuration set by config.Configure, the local
+// persistent volumes and the etcd data with the certificates it relies on.
+var DefaultKeepPaths = []string{
+	"/root/.config/sops",
+	"/root/.ssh",
+	"/etc/conf.d/iknite",
+	"/etc/kubernetes/pki",
+	"/var/lib/etcd",
+	"/opt/local-path-provisioner",
+}
+
+// backupPathsScript archives the existing paths given as positional
+// arguments. Passing the paths as arguments avoids quoting them.
+const backupPathsScript = `cd /
+for p do
+	shift
+	[ -e "${p#/}" ] && set -- "$@" "${p#/}"
+done
+[ $# -gt 0 ] && tar czf - "$@"
+exit 0
+`
+
+// CleanKeepPaths checks that paths are absolute paths of the distribution
+// and returns them cleaned, without duplicates.
+func CleanKeepPaths(paths []string) (result []string, err error) {
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if !path.IsAbs(p) {
+			return nil, fmt.Errorf("path to keep %q is not absolute", p)
+		}
+		cleaned := path.Clean(p)
+		if cleaned == "/" {
+			return nil, fmt.Errorf("the root directory can't be kept")
+		}
+		if !seen[cleaned] {
+			seen[cleaned] = true
+			result = append(result, cleaned)
+		}
+	}
+	return
+}
+
+// backupPathsCommand returns the command archiving paths to the standard
+// output.
+func backupPathsCommand(paths []string) ([]string, error) {
+	cleaned, err := CleanKeepPaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{"/bin/sh", "-c", backupPathsScript, "sh"}, cleaned...), nil
+}
+
+// upgradeStep is a step of an upgrade. The failure of a step that modifies
+// the distribution triggers a rollback.
+type upgradeStep struct {
+	name     string
+	run      func() error
+	rollback bool
+}
+
+// runUpgradeSteps runs steps in order. When a step needing a rollback fails,
+// rollback restores the snapshot and restart starts the restored cluster.
+// The restart failure is only reported by restart as the upgrade error
+// matters more.
+func runUpgradeSteps(steps []upgradeStep, snapshot string, rollback func() error, restart func()) error {
+	for _, step := range steps {
+		err := step.run()
+		if err == nil {
+			continue
+		}
+		err = errors.Wrapf(err, "while %s", step.name)
+		if !step.rollback {
+			return err
+		}
+		if rollbackErr := rollback(); rollbackErr != nil {
+			return errors.Wrapf(err, "rollback failed (%v), snapshot kept in %s", rollbackErr, snapshot)
+		}
+		restart()
+		return errors.Wrap(err, "upgrade rolled back")
+	}
+	return nil
+}
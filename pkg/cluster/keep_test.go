@@ -0,0 +1,139 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanKeepPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		expected []string
+		err      string
+	}{
+		{"defaults", DefaultKeepPaths, DefaultKeepPaths, ""},
+		{"cleaned and deduplicated", []string{"/root/.ssh/", "/root/../root/.ssh", "/var/lib//etcd"}, []string{"/root/.ssh", "/var/lib/etcd"}, ""},
+		{"quotes kept", []string{"/data/it's here"}, []string{"/data/it's here"}, ""},
+		{"relative", []string{"root/.ssh"}, nil, `path to keep "root/.ssh" is not absolute`},
+		{"root", []string{"/etc/.."}, nil, "the root directory can't be kept"},
+		{"empty", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := CleanKeepPaths(tt.paths)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestBackupPathsCommand(t *testing.T) {
+	command, err := backupPathsCommand([]string{"/etc/conf.d/iknite", "/data/it's; rm -rf ~"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bin/sh", "-c", backupPathsScript, "sh", "/etc/conf.d/iknite", "/data/it's; rm -rf ~"}, command)
+	assert.NotContains(t, command[2], "it's", "the paths are not in the script")
+
+	_, err = backupPathsCommand([]string{"etc"})
+	assert.Error(t, err)
+}
+
+// TestBackupPathsScript runs the backup script in a temporary directory
+// standing for the root of the distribution.
+func TestBackupPathsScript(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "data", "it's here"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "data", "it's here", "file"), []byte("kept"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "keys.txt"), []byte("key"), 0o600))
+
+	run := func(paths ...string) []string {
+		script := strings.Replace(backupPathsScript, "cd /", "cd '"+root+"'", 1)
+		output, err := exec.Command("sh", append([]string{"-c", script, "sh"}, paths...)...).Output()
+		require.NoError(t, err)
+		if len(output) == 0 {
+			return nil
+		}
+		gz, err := gzip.NewReader(strings.NewReader(string(output)))
+		require.NoError(t, err)
+		var names []string
+		reader := tar.NewReader(gz)
+		for {
+			header, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, header.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"data/it's here/", "data/it's here/file", "keys.txt"}, run("/data/it's here", "/missing", "/keys.txt"))
+	assert.Nil(t, run("/missing"), "nothing is archived when no path exists")
+}
+
+func TestRunUpgradeSteps(t *testing.T) {
+	failure := errors.New("boom")
+	succeed := func() error { return nil }
+	fail := func() error { return failure }
+
+	tests := []struct {
+		name        string
+		steps       []upgradeStep
+		rollbackErr error
+		rolledBack  bool
+		err         string
+	}{
+		{"success", []upgradeStep{{"saving", succeed, false}, {"importing", succeed, true}}, nil, false, ""},
+		{"failure before import", []upgradeStep{{"saving", fail, false}, {"importing", succeed, true}}, nil, false, "while saving: boom"},
+		{"failure after import", []upgradeStep{{"saving", succeed, false}, {"starting", fail, true}}, nil, true, "upgrade rolled back: while starting: boom"},
+		{"rollback failure", []upgradeStep{{"starting", fail, true}}, errors.New("no snapshot"), true, "rollback failed (no snapshot), snapshot kept in snapshot.tar: while starting: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rolledBack, restarted := false, false
+			err := runUpgradeSteps(tt.steps, "snapshot.tar", func() error {
+				rolledBack = true
+				return tt.rollbackErr
+			}, func() { restarted = true })
+			assert.Equal(t, tt.rolledBack, rolledBack)
+			assert.Equal(t, tt.rolledBack && tt.rollbackErr == nil, restarted)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
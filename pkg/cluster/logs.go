@@ -0,0 +1,123 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultLogSource is the log source shown when none is given.
+const DefaultLogSource = "iknite"
+
+// LogSources are the log files of the guest services, by order of
+// preference.
+var LogSources = map[string][]string{
+	"iknite":     {"/var/log/iknite.log", "/var/log/iknite/iknite.log"},
+	"kubelet":    {"/var/log/kubelet/kubelet.log", "/var/log/kubelet.log"},
+	"containerd": {"/var/log/containerd/containerd.log", "/var/log/containerd.log"},
+	"openrc":     {"/var/log/rc.log"},
+}
+
+// LogSourceNames returns the sorted names of the log sources.
+func LogSourceNames() (names []string) {
+	for name := range LogSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// LogCommand returns the shell script printing the last lines of the log of
+// source. A negative lines value prints the whole log. With follow, the
+// script keeps printing the new lines.
+func LogCommand(source string, lines int, follow bool) (string, error) {
+	files, ok := LogSources[source]
+	if !ok {
+		return "", fmt.Errorf("unknown log source %s, should be one of %s", source, strings.Join(LogSourceNames(), ", "))
+	}
+	count := "+1"
+	if lines >= 0 {
+		count = fmt.Sprint(lines)
+	}
+	tail := "tail -n " + count
+	if follow {
+		tail += " -F"
+	}
+	return fmt.Sprintf(`for f in %s; do if [ -e "$f" ]; then exec %s "$f"; fi; done; echo "no %s log found" >&2; exit 1`,
+		strings.Join(files, " "), tail, source), nil
+}
+
+var (
+	logfmtTimeRegexp = regexp.MustCompile(`(?:^|\s)time="?([^"\s]+)"?`)
+	klogTimeRegexp   = regexp.MustCompile(`^[IWEF](\d{4} \d{2}:\d{2}:\d{2}\.\d+)`)
+)
+
+// lineTime returns the time at which line was logged. JSON, logfmt, klog and
+// lines starting with a RFC3339 timestamp are supported. klog lines don't
+// have the year, so year is used. Times without zone are UTC.
+func lineTime(line string, year int) (t time.Time, ok bool) {
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Time string `json:"time"`
+		}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Time != "" {
+			t, err := time.Parse(time.RFC3339Nano, entry.Time)
+			return t, err == nil
+		}
+	}
+	if match := logfmtTimeRegexp.FindStringSubmatch(line); match != nil {
+		t, err := time.Parse(time.RFC3339Nano, match[1])
+		return t, err == nil
+	}
+	if match := klogTimeRegexp.FindStringSubmatch(line); match != nil {
+		t, err := time.Parse("0102 15:04:05.000000", match[1])
+		if err != nil {
+			return t, false
+		}
+		return t.AddDate(year, 0, 0), true
+	}
+	first, _, _ := strings.Cut(line, " ")
+	t, err := time.Parse(time.RFC3339Nano, first)
+	return t, err == nil
+}
+
+// FilterSince copies to w the lines of r logged at or after since. Lines
+// without time, like stack traces, follow the decision made for the previous
+// line.
+func FilterSince(r io.Reader, w io.Writer, since time.Time) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	keep := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t, ok := lineTime(line, since.Year()); ok {
+			keep = !t.Before(since)
+		}
+		if !keep {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
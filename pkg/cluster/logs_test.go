@@ -0,0 +1,70 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogCommand(t *testing.T) {
+	script, err := LogCommand("kubelet", 50, true)
+	require.NoError(t, err)
+	assert.Equal(t, `for f in /var/log/kubelet/kubelet.log /var/log/kubelet.log; do if [ -e "$f" ]; then exec tail -n 50 -F "$f"; fi; done; echo "no kubelet log found" >&2; exit 1`, script)
+
+	script, err = LogCommand("openrc", -1, false)
+	require.NoError(t, err)
+	assert.Contains(t, script, `exec tail -n +1 "$f"`)
+
+	_, err = LogCommand("unknown", 10, false)
+	assert.ErrorContains(t, err, "containerd, iknite, kubelet, openrc")
+}
+
+func TestLineTime(t *testing.T) {
+	expected := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+	for _, line := range []string{
+		`{"level":"info","msg":"Starting","time":"2022-06-01T10:00:00Z"}`,
+		`time="2022-06-01T10:00:00.000000000Z" level=info msg="starting containerd"`,
+		`I0601 10:00:00.000000    1234 server.go:417] "Kubelet version"`,
+		`2022-06-01T10:00:00Z INFO started`,
+	} {
+		actual, ok := lineTime(line, 2022)
+		require.True(t, ok, line)
+		assert.True(t, expected.Equal(actual), "%s: %s", line, actual)
+	}
+	_, ok := lineTime("	at main.go:12", 2022)
+	assert.False(t, ok)
+}
+
+func TestFilterSince(t *testing.T) {
+	input := strings.Join([]string{
+		`I0601 09:59:00.000000 1 old.go:1] old`,
+		`  old continuation`,
+		`I0601 10:00:00.000000 1 new.go:1] new`,
+		`  new continuation`,
+		`time="2022-06-01T10:01:00Z" level=info msg=newer`,
+	}, "\n")
+	var output bytes.Buffer
+	require.NoError(t, FilterSince(strings.NewReader(input), &output, time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)))
+	assert.Equal(t, `I0601 10:00:00.000000 1 new.go:1] new
+  new continuation
+time="2022-06-01T10:01:00Z" level=info msg=newer
+`, output.String())
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// workloadAliases maps the names accepted for the workloads with pods to
+// their resource.
+var workloadAliases = map[string]string{
+	"deploy":       "deployments",
+	"deployment":   "deployments",
+	"deployments":  "deployments",
+	"sts":          "statefulsets",
+	"statefulset":  "statefulsets",
+	"statefulsets": "statefulsets",
+	"ds":           "daemonsets",
+	"daemonset":    "daemonsets",
+	"daemonsets":   "daemonsets",
+}
+
+// WorkloadPodSelector returns the selector of the pods of workload, given as
+// <kind>/<name>, e.g. deploy/web or statefulsets/db. A name alone is a
+// deployment.
+func WorkloadPodSelector(ctx context.Context, client kubernetes.Interface, namespace string, workload string) (labels.Selector, error) {
+	kind, name, found := strings.Cut(workload, "/")
+	if !found {
+		kind, name = "deployments", workload
+	}
+	resource, ok := workloadAliases[strings.ToLower(kind)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported workload kind %s, should be a deployment, statefulset or daemonset", kind)
+	}
+	return podSelector(ctx, client, namespace, resource, name)
+}
+
+// PodLogsOptions tells which container logs to stream.
+type PodLogsOptions struct {
+	Namespace string
+	// Selector selects the pods. nil selects all the pods of the namespace.
+	Selector labels.Selector
+	// Container is a glob pattern of the container names. Empty means all.
+	Container string
+	// Since only shows the lines logged since this duration, if not zero.
+	Since time.Duration
+	// Tail is the number of lines to show from the end of the logs. A
+	// negative value shows all the lines.
+	Tail int64
+	// Follow keeps streaming the logs, including the ones of the pods
+	// created afterwards.
+	Follow bool
+}
+
+// PodLogLine is a line of log of a container.
+type PodLogLine struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Message   string `json:"message"`
+}
+
+// PodLogLineFunc is called for each line of log. The calls are serialized.
+type PodLogLineFunc func(line *PodLogLine)
+
+type podLogTailer struct {
+	client  kubernetes.Interface
+	options *PodLogsOptions
+	output  PodLogLineFunc
+
+	mutex   sync.Mutex
+	streams map[string]bool
+	wg      sync.WaitGroup
+}
+
+func (t *podLogTailer) matches(container string) bool {
+	if t.options.Container == "" {
+		return true
+	}
+	ok, _ := path.Match(t.options.Container, container)
+	return ok
+}
+
+// tail starts streaming the logs of the started containers of pod that are
+// not already streamed. The restart count is part of the stream key so a
+// restarted container is streamed again.
+func (t *podLogTailer) tail(ctx context.Context, pod *v1.Pod) {
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if !t.matches(status.Name) || (status.State.Running == nil && status.State.Terminated == nil) {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s/%d", pod.UID, status.Name, status.RestartCount)
+		t.mutex.Lock()
+		started := t.streams[key]
+		t.streams[key] = true
+		t.mutex.Unlock()
+		if started {
+			continue
+		}
+		t.wg.Add(1)
+		go t.stream(ctx, pod.Namespace, pod.Name, status.Name)
+	}
+}
+
+func (t *podLogTailer) stream(ctx context.Context, namespace string, pod string, container string) {
+	defer t.wg.Done()
+
+	options := &v1.PodLogOptions{Container: container, Follow: t.options.Follow}
+	if t.options.Since > 0 {
+		seconds := int64(t.options.Since.Seconds())
+		options.SinceSeconds = &seconds
+	}
+	if t.options.Tail >= 0 {
+		options.TailLines = &t.options.Tail
+	}
+	stream, err := t.client.CoreV1().Pods(namespace).GetLogs(pod, options).Stream(ctx)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"pod": pod, "container": container}).Warn("Couldn't get logs")
+		return
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		t.mutex.Lock()
+		t.output(&PodLogLine{Namespace: namespace, Pod: pod, Container: container, Message: scanner.Text()})
+		t.mutex.Unlock()
+	}
+}
+
+// TailPodLogs streams the logs of the containers of the pods selected by
+// options to output. Without Follow, it returns once the current logs have
+// been read. With Follow, the new pods and restarted containers are
+// streamed as they start until ctx is done.
+func TailPodLogs(ctx context.Context, client kubernetes.Interface, options *PodLogsOptions, output PodLogLineFunc) error {
+	tailer := &podLogTailer{
+		client:  client,
+		options: options,
+		output:  output,
+		streams: make(map[string]bool),
+	}
+	selector := labels.Everything()
+	if options.Selector != nil {
+		selector = options.Selector
+	}
+
+	if !options.Follow {
+		pods, err := client.CoreV1().Pods(options.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			tailer.tail(ctx, &pods.Items[i])
+		}
+		tailer.wg.Wait()
+		return nil
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(options.Namespace),
+		informers.WithTweakListOptions(func(listOptions *metav1.ListOptions) {
+			listOptions.LabelSelector = selector.String()
+		}))
+	informer := factory.Core().V1().Pods().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				tailer.tail(ctx, pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				tailer.tail(ctx, pod)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	tailer.wg.Wait()
+	return nil
+}
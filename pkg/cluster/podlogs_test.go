@@ -0,0 +1,127 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func runningPod(name string, labels map[string]string, containers ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name), Labels: labels},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	for _, container := range containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, v1.ContainerStatus{
+			Name:  container,
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+		})
+	}
+	return pod
+}
+
+type lineRecorder struct {
+	sync.Mutex
+	lines []string
+}
+
+func (r *lineRecorder) record(line *PodLogLine) {
+	r.Lock()
+	defer r.Unlock()
+	r.lines = append(r.lines, line.Pod+"/"+line.Container+" "+line.Message)
+}
+
+func (r *lineRecorder) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	result := append([]string{}, r.lines...)
+	sort.Strings(result)
+	return result
+}
+
+func TestWorkloadPodSelector(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: labels}},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+		},
+	)
+	ctx := context.Background()
+
+	for workload, expected := range map[string]string{"web": "app=web", "deploy/web": "app=web", "sts/db": "app=db"} {
+		selector, err := WorkloadPodSelector(ctx, client, "default", workload)
+		require.NoError(t, err, workload)
+		assert.Equal(t, expected, selector.String(), workload)
+	}
+	_, err := WorkloadPodSelector(ctx, client, "default", "jobs/migrate")
+	assert.Error(t, err)
+	_, err = WorkloadPodSelector(ctx, client, "default", "deploy/missing")
+	assert.Error(t, err)
+}
+
+func TestTailPodLogs(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	client := fake.NewSimpleClientset(
+		runningPod("web-1", labels, "web", "sidecar"),
+		runningPod("other", nil, "other"),
+	)
+	selector, err := WorkloadPodSelector(context.Background(), fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: labels}},
+	}), "default", "web")
+	require.NoError(t, err)
+
+	recorder := &lineRecorder{}
+	options := &PodLogsOptions{Namespace: "default", Selector: selector, Container: "w*", Tail: -1}
+	require.NoError(t, TailPodLogs(context.Background(), client, options, recorder.record))
+	assert.Equal(t, []string{"web-1/web fake logs"}, recorder.get())
+
+	recorder = &lineRecorder{}
+	options.Container = ""
+	options.Follow = true
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- TailPodLogs(ctx, client, options, recorder.record) }()
+
+	require.Eventually(t, func() bool { return len(recorder.get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	pending := runningPod("web-2", labels)
+	_, err = client.CoreV1().Pods("default").Create(ctx, pending, metav1.CreateOptions{})
+	require.NoError(t, err)
+	started := runningPod("web-2", labels, "web")
+	_, err = client.CoreV1().Pods("default").UpdateStatus(ctx, started, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(recorder.get()) == 3 }, 5*time.Second, 10*time.Millisecond, "new pods should be streamed once started")
+	cancel()
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"web-1/sidecar fake logs", "web-1/web fake logs", "web-2/web fake logs"}, recorder.get())
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultFailureThreshold is the number of restarts, or of consecutive
+// checks with image pull errors, after which a container is considered
+// failed.
+const DefaultFailureThreshold = 3
+
+// failFastInterval is the interval between two pod failure checks.
+const failFastInterval = 5 * time.Second
+
+var (
+	// FailFast makes the wait for the cluster abort when containers keep
+	// failing instead of waiting for the timeout.
+	FailFast = true
+	// FailureThreshold is the threshold used when failing fast.
+	FailureThreshold = DefaultFailureThreshold
+)
+
+var (
+	// crashReasons are the waiting reasons of crashing containers.
+	crashReasons = map[string]bool{
+		"CrashLoopBackOff":  true,
+		"RunContainerError": true,
+	}
+	// imagePullReasons are the waiting reasons of containers whose image
+	// can't be pulled. They can be transient.
+	imagePullReasons = map[string]bool{
+		"ErrImagePull":     true,
+		"ImagePullBackOff": true,
+	}
+	// fatalReasons are the waiting reasons that won't fix themselves.
+	fatalReasons = map[string]bool{
+		"InvalidImageName":           true,
+		"ErrImageNeverPull":          true,
+		"CreateContainerConfigError": true,
+	}
+)
+
+// ContainerFailure describes a failing container.
+type ContainerFailure struct {
+	Namespace string
+	Pod       string
+	Container string
+	Reason    string
+	Message   string
+	Restarts  int32
+	// Fatal failures don't depend on the threshold.
+	Fatal bool
+}
+
+func (f *ContainerFailure) String() string {
+	result := fmt.Sprintf("%s/%s %s %s", f.Namespace, f.Pod, f.Container, f.Reason)
+	if f.Restarts > 0 {
+		result += fmt.Sprintf(" (%d restarts)", f.Restarts)
+	}
+	return result
+}
+
+// classifyContainer returns the failure of the container, or nil if it is
+// not failing.
+func classifyContainer(pod *v1.Pod, status *v1.ContainerStatus) *ContainerFailure {
+	failure := &ContainerFailure{
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: status.Name,
+		Restarts:  status.RestartCount,
+	}
+	switch waiting := status.State.Waiting; {
+	case waiting != nil && (crashReasons[waiting.Reason] || imagePullReasons[waiting.Reason]):
+		failure.Reason, failure.Message = waiting.Reason, waiting.Message
+	case waiting != nil && fatalReasons[waiting.Reason]:
+		failure.Reason, failure.Message = waiting.Reason, waiting.Message
+		failure.Fatal = true
+	case status.RestartCount > 0 && !status.Ready && status.LastTerminationState.Terminated != nil:
+		terminated := status.LastTerminationState.Terminated
+		failure.Reason = terminated.Reason
+		if failure.Reason == "" {
+			failure.Reason = fmt.Sprintf("exit code %d", terminated.ExitCode)
+		}
+		failure.Message = terminated.Message
+	default:
+		return nil
+	}
+	return failure
+}
+
+// FailureDetector finds the containers that keep failing across checks.
+// Crashing containers fail once they have restarted Threshold times since
+// the detector first saw them, as the restarts before the wait, e.g. the
+// ones of a previous boot of the distribution, don't tell anything. Image
+// pull errors fail once they are seen in Threshold consecutive checks.
+type FailureDetector struct {
+	Threshold int
+	pulls     map[string]int
+	// restarts are the restart counts of the containers when first seen.
+	restarts map[string]int32
+}
+
+func NewFailureDetector(threshold int) *FailureDetector {
+	return &FailureDetector{Threshold: threshold, pulls: make(map[string]int), restarts: make(map[string]int32)}
+}
+
+// Check returns the failed containers of pods.
+func (d *FailureDetector) Check(pods []*v1.Pod) (failed []*ContainerFailure) {
+	pulls := make(map[string]int)
+	for _, pod := range pods {
+		statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for i := range statuses {
+			key := fmt.Sprintf("%s/%s/%s/%s", pod.Namespace, pod.Name, pod.UID, statuses[i].Name)
+			initial, seen := d.restarts[key]
+			if !seen {
+				initial = statuses[i].RestartCount
+				d.restarts[key] = initial
+			}
+			failure := classifyContainer(pod, &statuses[i])
+			switch {
+			case failure == nil:
+				continue
+			case imagePullReasons[failure.Reason]:
+				pulls[key] = d.pulls[key] + 1
+				if pulls[key] >= d.Threshold {
+					failed = append(failed, failure)
+				}
+			case failure.Fatal || int(failure.Restarts-initial) >= d.Threshold:
+				failed = append(failed, failure)
+			}
+		}
+	}
+	d.pulls = pulls
+	sort.SliceStable(failed, func(i, j int) bool {
+		return failed[i].String() < failed[j].String()
+	})
+	return
+}
+
+// PodFailureError is returned when containers keep failing while waiting for
+// the cluster.
+type PodFailureError struct {
+	Failures []*ContainerFailure
+}
+
+func (e *PodFailureError) Error() string {
+	failures := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		failures = append(failures, failure.String())
+	}
+	return fmt.Sprintf("%d containers keep failing: %s", len(e.Failures), strings.Join(failures, ", "))
+}
+
+// podWorkload returns the workload owning pod, named as the workload states
+// are. The Deployment of a ReplicaSet is found through the pod template hash.
+func podWorkload(pod *v1.Pod) *WorkloadState {
+	resource, name := "pods", pod.Name
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		switch owner.Kind {
+		case "ReplicaSet":
+			resource, name = "replicasets", owner.Name
+			if hash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok && strings.HasSuffix(owner.Name, "-"+hash) {
+				resource, name = "deployments", strings.TrimSuffix(owner.Name, "-"+hash)
+			}
+		default:
+			resource, name = strings.ToLower(owner.Kind)+"s", owner.Name
+		}
+	}
+	return &WorkloadState{Namespace: pod.Namespace, Name: fmt.Sprintf("%s/%s", resource, name)}
+}
+
+// filteredPods returns the pods selected by filter whose workload is neither
+// excluded nor ignored.
+func filteredPods(c kubernetes.Interface, filter *WorkloadFilter) (result []v1.Pod, err error) {
+	var list *v1.PodList
+	if list, err = c.CoreV1().Pods(filter.namespace()).List(context.TODO(), metav1.ListOptions{LabelSelector: filter.selector()}); err != nil {
+		return
+	}
+	for _, pod := range list.Items {
+		workload := podWorkload(&pod)
+		if filter.Excludes(workload) || filter.Ignores(workload) {
+			continue
+		}
+		result = append(result, pod)
+	}
+	return
+}
+
+// arePodsReady returns a condition that is done when all the pods selected
+// by filter are ready. It fails with a PodFailureError when detector finds
+// failed containers in the unready pods.
+func arePodsReady(c kubernetes.Interface, filter *WorkloadFilter, detector *FailureDetector, fields *log.Fields) wait.ConditionFunc {
+	return func() (bool, error) {
+
+		pods, err := filteredPods(c, filter)
+		if err != nil {
+			return false, err
+		}
+		active, unready, stopped := k8s.GetPodsSeparatedByStatus(pods)
+		log.WithFields(*fields).WithFields(log.Fields{
+			"active":  len(active),
+			"unready": len(unready),
+			"stopped": len(stopped),
+		}).Debugf("active: %d, unready: %d, stopped:%d", len(active), len(unready), len(stopped))
+		if failures := detector.Check(unready); len(failures) > 0 {
+			return false, &PodFailureError{Failures: failures}
+		}
+		return len(active) > 0 && len(unready) == 0, nil
+	}
+}
+
+// watchPodFailures checks the pods of the workloads selected by filter until
+// ctx is done or containers keep failing. In the latter case, a
+// PodFailureError is returned.
+func watchPodFailures(ctx context.Context, c kubernetes.Interface, filter *WorkloadFilter, threshold int, interval time.Duration, fields *log.Fields) error {
+	condition := arePodsReady(c, filter, NewFailureDetector(threshold), fields)
+	return wait.PollUntilContextCancel(ctx, interval, true, func(context.Context) (bool, error) {
+		// Pods can become unready again, so the watch goes on
+		_, err := condition()
+		if err != nil {
+			if _, ok := err.(*PodFailureError); !ok {
+				log.WithError(err).WithFields(*fields).Debug("Couldn't check pods")
+				err = nil
+			}
+		}
+		return false, err
+	})
+}
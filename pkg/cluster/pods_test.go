@@ -0,0 +1,169 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(name string, statuses ...v1.ContainerStatus) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, ContainerStatuses: statuses},
+	}
+}
+
+func waiting(name string, reason string, restarts int32) v1.ContainerStatus {
+	return v1.ContainerStatus{
+		Name:         name,
+		RestartCount: restarts,
+		State:        v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}},
+	}
+}
+
+func TestFailureDetector(t *testing.T) {
+	detector := NewFailureDetector(3)
+	pods := []*v1.Pod{
+		testPod("starting", waiting("app", "ContainerCreating", 0)),
+		testPod("crashing", waiting("app", "CrashLoopBackOff", 0)),
+		testPod("pulling", waiting("app", "ImagePullBackOff", 0)),
+	}
+	assert.Empty(t, detector.Check(pods))
+	pods[1] = testPod("crashing", waiting("app", "CrashLoopBackOff", 2))
+	assert.Empty(t, detector.Check(pods))
+
+	pods[1] = testPod("crashing", waiting("app", "CrashLoopBackOff", 3))
+	failed := detector.Check(pods)
+	require.Len(t, failed, 2, "threshold should be reached for both failures")
+	assert.Equal(t, "default/crashing app CrashLoopBackOff (3 restarts)", failed[0].String())
+	assert.Equal(t, "default/pulling app ImagePullBackOff", failed[1].String())
+
+	pods[2] = testPod("pulling", v1.ContainerStatus{Name: "app", Ready: true})
+	failed = detector.Check(pods)
+	require.Len(t, failed, 1)
+	assert.Empty(t, detector.Check([]*v1.Pod{testPod("pulling", waiting("app", "ErrImagePull", 0))}), "pull count should restart")
+
+	failed = NewFailureDetector(3).Check([]*v1.Pod{testPod("config", waiting("app", "CreateContainerConfigError", 0))})
+	require.Len(t, failed, 1, "fatal failures shouldn't wait for the threshold")
+	assert.True(t, failed[0].Fatal)
+}
+
+func TestFailureDetectorPreviousRestarts(t *testing.T) {
+	restarted := func(restarts int32) *v1.Pod {
+		return testPod("restarted", v1.ContainerStatus{
+			Name:                 "app",
+			RestartCount:         restarts,
+			State:                v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+			LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+		})
+	}
+	detector := NewFailureDetector(3)
+	// As after a reboot of the distribution
+	assert.Empty(t, detector.Check([]*v1.Pod{restarted(7)}), "restarts before the wait shouldn't count")
+	assert.Empty(t, detector.Check([]*v1.Pod{restarted(9)}))
+
+	failed := detector.Check([]*v1.Pod{restarted(10)})
+	require.Len(t, failed, 1, "unready containers restarted since the wait should be failing")
+	assert.Equal(t, "Error", failed[0].Reason)
+
+	recreated := restarted(10)
+	recreated.UID = "other"
+	assert.Empty(t, detector.Check([]*v1.Pod{recreated}), "a new pod has its own restart count")
+}
+
+// crashOnList makes the crashing containers of client restart each time the
+// pods are listed.
+func crashOnList(t *testing.T, client *fake.Clientset) *fake.Clientset {
+	podsResource := v1.SchemeGroupVersion.WithResource("pods")
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		list, err := client.Tracker().List(podsResource, v1.SchemeGroupVersion.WithKind("Pod"), "")
+		require.NoError(t, err)
+		for _, pod := range list.(*v1.PodList).Items {
+			for i, status := range pod.Status.ContainerStatuses {
+				if status.State.Waiting != nil && crashReasons[status.State.Waiting.Reason] {
+					pod.Status.ContainerStatuses[i].RestartCount++
+				}
+			}
+			require.NoError(t, client.Tracker().Update(podsResource, &pod, pod.Namespace))
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func TestWatchPodFailures(t *testing.T) {
+	client := crashOnList(t, fake.NewSimpleClientset(
+		testPod("crashing", waiting("app", "CrashLoopBackOff", 4)),
+		testPod("ok", v1.ContainerStatus{Name: "app", Ready: true}),
+	))
+	fields := log.Fields{}
+
+	err := watchPodFailures(context.Background(), client, nil, 3, 10*time.Millisecond, &fields)
+	require.Error(t, err)
+	failure, ok := err.(*PodFailureError)
+	require.True(t, ok, "error should be a PodFailureError")
+	require.Len(t, failure.Failures, 1)
+	assert.Equal(t, "1 containers keep failing: default/crashing app CrashLoopBackOff (8 restarts)", err.Error())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = watchPodFailures(ctx, client, nil, 10, 10*time.Millisecond, &fields)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "watch should go on until ctx is done")
+}
+
+func TestWatchPodFailuresFilter(t *testing.T) {
+	controller := true
+	crashing := testPod("web-7d9f8-x2k4p", waiting("app", "CrashLoopBackOff", 4))
+	crashing.Labels = map[string]string{"pod-template-hash": "7d9f8", "tier": "front"}
+	crashing.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-7d9f8", Controller: &controller}}
+	demo := testPod("demo-0", waiting("app", "CrashLoopBackOff", 4))
+	demo.Namespace = "demo"
+	demo.Labels = map[string]string{"tier": "front"}
+	demo.OwnerReferences = []metav1.OwnerReference{{Kind: "StatefulSet", Name: "demo", Controller: &controller}}
+	client := crashOnList(t, fake.NewSimpleClientset(crashing, demo, testPod("ok", v1.ContainerStatus{Name: "app", Ready: true})))
+	fields := log.Fields{}
+
+	assert.Equal(t, "deployments/web", podWorkload(crashing).Name)
+	assert.Equal(t, "statefulsets/demo", podWorkload(demo).Name)
+
+	for name, filter := range map[string]*WorkloadFilter{
+		"ignored namespace":  {Ignore: []string{"demo"}, Exclude: []string{"default/deployments/web"}},
+		"excluded workloads": {Exclude: []string{"*/deployments/*", "*/statefulsets/demo"}},
+		"other namespace":    {Namespace: "other"},
+		"selector":           {Selector: "tier=back"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := watchPodFailures(ctx, client, filter, 3, 10*time.Millisecond, &fields)
+			assert.ErrorIs(t, err, context.DeadlineExceeded, "the filtered out pods shouldn't abort the wait")
+		})
+	}
+
+	err := watchPodFailures(context.Background(), client, &WorkloadFilter{Ignore: []string{"demo"}}, 3, 10*time.Millisecond, &fields)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 containers keep failing: default/web-7d9f8-x2k4p app CrashLoopBackOff")
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/config"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/yuk7/wsllib-go"
+)
+
+var resetClusterFields = log.Fields{
+	logger.TaskKey: "Reset Cluster",
+}
+
+type ResetOptions struct {
+	// KeepImages keeps the containerd image cache.
+	KeepImages bool
+	LogLevel   string
+	// Timeout is the time to wait for the workloads. Zero doesn't wait.
+	Timeout time.Duration
+	// Filter selects the workloads waited for after the start.
+	Filter *WorkloadFilter
+	// Configuration is applied to the distribution before starting.
+	Configuration *config.ConfigurationOptions
+}
+
+// ResetCluster rebuilds the Kubernetes cluster of the distribution without
+// re-importing it. The cluster is stopped, its state is removed with
+// kubeadm and the cluster is configured and started again.
+func ResetCluster(distributionName string, options *ResetOptions) (err error) {
+	fields := log.Fields{
+		"distribution_name": distributionName,
+		"keep_images":       options.KeepImages,
+	}
+
+	if !wsllib.WslIsDistributionRegistered(distributionName) {
+		return fmt.Errorf("distribution %s is not installed", distributionName)
+	}
+
+	if err = StopCluster(distributionName); err != nil {
+		return
+	}
+
+	log.WithFields(resetClusterFields).WithFields(fields).Info("Removing the Kubernetes state...")
+	if err = wsl.WslPipe(ResetScript(options.KeepImages), distributionName, "/bin/sh", "-s"); err != nil {
+		return errors.Wrapf(err, "while resetting distribution %s", distributionName)
+	}
+	// Restart from a clean network and services state
+	if err = wsl.StopDistribution(distributionName); err != nil {
+		return
+	}
+
+	if err = config.Configure(distributionName, options.Configuration); err != nil {
+		return
+	}
+	if options.Timeout > 0 {
+		err = startAndWait(distributionName, options.LogLevel, options.Filter, options.Timeout)
+	} else if err = StartCluster(distributionName, options.LogLevel); err == nil {
+		err = k8s.MergeKubernetesConfig(distributionName)
+	}
+	if err != nil {
+		return
+	}
+	log.WithFields(resetClusterFields).WithFields(fields).Info("Cluster reset")
+	return
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import "fmt"
+
+// resetScript removes the Kubernetes state of the distribution. containerd
+// is started so kubeadm can remove the containers. The keys and the
+// configuration in /etc/conf.d are left untouched. The parameter is the
+// command removing the images.
+const resetScript = `export CONTAINER_RUNTIME_ENDPOINT=unix:///run/containerd/containerd.sock
+rc-service kubelet stop >/dev/null 2>&1
+rc-service containerd start || exit 1
+kubeadm reset --force --cri-socket "$CONTAINER_RUNTIME_ENDPOINT" || exit 1
+%s
+rc-service containerd stop
+rm -rf /etc/kubernetes/manifests /etc/kubernetes/pki /etc/kubernetes/*.conf \
+	/var/lib/etcd /var/lib/kubelet/pki /var/lib/kubelet/config.yaml \
+	/etc/cni/net.d/* /var/lib/cni
+for link in cni0 flannel.1 kube-ipvs0; do
+	ip link delete "$link" >/dev/null 2>&1
+done
+for table in filter nat mangle; do
+	iptables -t "$table" -F && iptables -t "$table" -X
+done
+exit 0
+`
+
+const removeImagesCommand = `crictl rmi --all || exit 1`
+
+// ResetScript returns the script removing the Kubernetes state. The
+// containerd images are removed unless keepImages is true.
+func ResetScript(keepImages bool) string {
+	removeImages := ""
+	if !keepImages {
+		removeImages = removeImagesCommand
+	}
+	return fmt.Sprintf(resetScript, removeImages)
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// removedPaths returns the arguments of the rm commands of script.
+func removedPaths(script string) (result []string) {
+	for _, command := range strings.Split(strings.ReplaceAll(script, "\\\n", " "), "\n") {
+		fields := strings.Fields(command)
+		if len(fields) == 0 || fields[0] != "rm" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				result = append(result, field)
+			}
+		}
+	}
+	return
+}
+
+func TestResetScript(t *testing.T) {
+	assert.Contains(t, ResetScript(false), "crictl rmi --all")
+	assert.NotContains(t, ResetScript(true), "crictl rmi", "the images are kept")
+
+	// Paths written by config.Configure
+	preserved := []string{"/etc/conf.d/iknite", "/root/.ssh/id_rsa", "/root/.ssh/known_hosts", "/root/.config/sops/age/keys.txt"}
+	for _, keepImages := range []bool{false, true} {
+		script := ResetScript(keepImages)
+		removed := removedPaths(script)
+		assert.Contains(t, removed, "/var/lib/etcd")
+		for _, p := range preserved {
+			assert.NotContains(t, script, path.Dir(p))
+			for _, r := range removed {
+				matched, err := path.Match(r, p)
+				assert.NoError(t, err)
+				assert.False(t, matched || strings.HasPrefix(p, strings.TrimSuffix(r, "*")), "%s removes %s", r, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// DefaultHealthRuleValue is the JSONPath result expected by default.
+const DefaultHealthRuleValue = "True"
+
+// HealthRule tells how to assess the health of a custom resource. Exactly
+// one of JSONPath and CEL must be given. Example:
+//
+//	readiness:
+//	  rules:
+//	    - group: example.com
+//	      kind: Widget
+//	      jsonPath: '{.status.phase}'
+//	      value: Running
+//	      message: 'widget is {.status.phase}'
+type HealthRule struct {
+	Group string `mapstructure:"group"`
+	Kind  string `mapstructure:"kind"`
+	// JSONPath is evaluated on the object, e.g.
+	// {.status.conditions[?(@.type=="Synced")].status}. The object is
+	// healthy when the result equals Value.
+	JSONPath string `mapstructure:"jsonPath"`
+	// Value is the expected JSONPath result. Defaults to True.
+	Value string `mapstructure:"value"`
+	// CEL is a boolean expression on object, e.g.
+	// object.status.readyReplicas == object.spec.replicas.
+	CEL string `mapstructure:"cel"`
+	// Message is a JSONPath template giving the status message, e.g.
+	// {.status.readyReplicas} of {.spec.replicas} ready.
+	Message string `mapstructure:"message"`
+}
+
+func (r *HealthRule) GroupKind() schema.GroupKind {
+	return schema.GroupKind{Group: r.Group, Kind: r.Kind}
+}
+
+func (r *HealthRule) String() string {
+	return r.GroupKind().String()
+}
+
+// Expression returns the JSONPath or CEL expression of the rule.
+func (r *HealthRule) Expression() string {
+	if r.CEL != "" {
+		return r.CEL
+	}
+	return r.JSONPath
+}
+
+// RuleStatusViewer is the status viewer of a health rule.
+type RuleStatusViewer struct {
+	Rule     *HealthRule
+	jsonPath *jsonpath.JSONPath
+	program  cel.Program
+	message  *jsonpath.JSONPath
+}
+
+func parseJSONPath(name string, template string) (*jsonpath.JSONPath, error) {
+	parser := jsonpath.New(name).AllowMissingKeys(true)
+	if err := parser.Parse(template); err != nil {
+		return nil, errors.Wrapf(err, "bad %s %s", name, template)
+	}
+	return parser, nil
+}
+
+// NewRuleStatusViewer compiles rule.
+func NewRuleStatusViewer(rule *HealthRule) (viewer *RuleStatusViewer, err error) {
+	if rule.Kind == "" {
+		return nil, fmt.Errorf("missing kind")
+	}
+	if (rule.JSONPath == "") == (rule.CEL == "") {
+		return nil, fmt.Errorf("rule %s needs either a jsonPath or a cel expression", rule)
+	}
+
+	viewer = &RuleStatusViewer{Rule: rule}
+	if rule.JSONPath != "" {
+		if viewer.jsonPath, err = parseJSONPath("jsonPath", rule.JSONPath); err != nil {
+			return nil, err
+		}
+	} else {
+		var env *cel.Env
+		if env, err = cel.NewEnv(cel.Variable("object", cel.DynType)); err != nil {
+			return nil, err
+		}
+		ast, issues := env.Compile(rule.CEL)
+		if issues.Err() != nil {
+			return nil, errors.Wrapf(issues.Err(), "bad cel expression %s", rule.CEL)
+		}
+		if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+			return nil, fmt.Errorf("cel expression %s returns %s instead of bool", rule.CEL, t)
+		}
+		if viewer.program, err = env.Program(ast); err != nil {
+			return nil, errors.Wrapf(err, "bad cel expression %s", rule.CEL)
+		}
+	}
+	if rule.Message != "" {
+		if viewer.message, err = parseJSONPath("message", rule.Message); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (s *RuleStatusViewer) healthy(content map[string]interface{}) (bool, string, error) {
+	if s.program != nil {
+		out, _, err := s.program.Eval(map[string]interface{}{"object": content})
+		if err != nil {
+			return false, "", err
+		}
+		result, ok := out.Value().(bool)
+		if !ok {
+			return false, "", fmt.Errorf("%s returned %v", s.Rule.CEL, out.Value())
+		}
+		return result, fmt.Sprintf("%s is %t", s.Rule.CEL, result), nil
+	}
+
+	var buffer bytes.Buffer
+	if err := s.jsonPath.Execute(&buffer, content); err != nil {
+		return false, "", err
+	}
+	value := s.Rule.Value
+	if value == "" {
+		value = DefaultHealthRuleValue
+	}
+	result := strings.TrimSpace(buffer.String())
+	return result == value, fmt.Sprintf("%s is %q", s.Rule.JSONPath, result), nil
+}
+
+// Status evaluates the rule. An evaluation error, for instance on a missing
+// field, makes the object unhealthy.
+func (s *RuleStatusViewer) Status(obj runtime.Unstructured, revision int64) (string, bool, error) {
+	content := obj.UnstructuredContent()
+	description := objectDescription(content)
+
+	ok, msg, err := s.healthy(content)
+	if err != nil {
+		return fmt.Sprintf("%s health rule failed: %v", description, err), false, nil
+	}
+	if s.message != nil {
+		var buffer bytes.Buffer
+		if err = s.message.Execute(&buffer, content); err == nil {
+			msg = buffer.String()
+		}
+	}
+	return fmt.Sprintf("%s %s", description, msg), ok, nil
+}
+
+// ruleViewers are the status viewers of the configured health rules.
+var ruleViewers = map[schema.GroupKind]*RuleStatusViewer{}
+
+// SetHealthRules compiles rules and uses them in place of the built-in status
+// viewers of their kinds. The kinds of the rules are also tracked.
+func SetHealthRules(rules []*HealthRule) error {
+	viewers := make(map[schema.GroupKind]*RuleStatusViewer, len(rules))
+	for _, rule := range rules {
+		viewer, err := NewRuleStatusViewer(rule)
+		if err != nil {
+			return errors.Wrapf(err, "invalid health rule %s", rule)
+		}
+		if _, ok := viewers[rule.GroupKind()]; ok {
+			return fmt.Errorf("duplicate health rule %s", rule)
+		}
+		viewers[rule.GroupKind()] = viewer
+	}
+	ruleViewers = viewers
+	return nil
+}
+
+// trackedKinds returns the workload kinds followed by the kinds of the
+// health rules.
+func trackedKinds() []schema.GroupKind {
+	result := append([]schema.GroupKind{}, workloadKinds...)
+	known := make(map[schema.GroupKind]bool, len(workloadKinds))
+	for _, kind := range workloadKinds {
+		known[kind] = true
+	}
+	var extra []schema.GroupKind
+	for kind := range ruleViewers {
+		if !known[kind] {
+			extra = append(extra, kind)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		return extra[i].String() < extra[j].String()
+	})
+	return append(result, extra...)
+}
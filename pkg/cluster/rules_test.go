@@ -0,0 +1,94 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestHealthRules(t *testing.T) {
+	t.Cleanup(func() { require.NoError(t, SetHealthRules(nil)) })
+	require.NoError(t, SetHealthRules([]*HealthRule{
+		{Group: "example.com", Kind: "Widget", JSONPath: "{.status.phase}", Value: "Running", Message: "phase {.status.phase}"},
+		{Group: "example.com", Kind: "Gadget", CEL: "object.status.ready == object.spec.replicas"},
+		{Group: "batch", Kind: "Job", JSONPath: `{.status.conditions[?(@.type=="Complete")].status}`},
+	}))
+
+	widget := testObject("example.com/v1", "Widget", "w", map[string]interface{}{"phase": "Running"})
+	viewer, err := StatusViewerFor(widget.GroupVersionKind().GroupKind())
+	require.NoError(t, err)
+	msg, ready, err := viewer.Status(widget, 0)
+	require.NoError(t, err)
+	assert.True(t, ready)
+	assert.Equal(t, `widget "w" phase Running`, msg)
+
+	widget = testObject("example.com/v1", "Widget", "w", map[string]interface{}{})
+	_, ready, err = viewer.Status(widget, 0)
+	require.NoError(t, err)
+	assert.False(t, ready, "Missing field shouldn't match")
+
+	gadget := testObject("example.com/v1", "Gadget", "g", map[string]interface{}{"ready": int64(2)})
+	gadget.Object["spec"] = map[string]interface{}{"replicas": int64(2)}
+	viewer, err = StatusViewerFor(gadget.GroupVersionKind().GroupKind())
+	require.NoError(t, err)
+	_, ready, err = viewer.Status(gadget, 0)
+	require.NoError(t, err)
+	assert.True(t, ready)
+
+	delete(gadget.Object, "spec")
+	msg, ready, err = viewer.Status(gadget, 0)
+	require.NoError(t, err, "Evaluation errors make the object unhealthy")
+	assert.False(t, ready)
+	assert.Contains(t, msg, "health rule failed")
+
+	job := testObject("batch/v1", "Job", "migrate", map[string]interface{}{
+		"conditions": []interface{}{condition("Complete", "True", "")},
+	})
+	viewer, err = StatusViewerFor(job.GroupVersionKind().GroupKind())
+	require.NoError(t, err)
+	assert.IsType(t, &RuleStatusViewer{}, viewer, "Rules should replace built-in viewers")
+	_, ready, err = viewer.Status(job, 0)
+	require.NoError(t, err)
+	assert.True(t, ready)
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Group: "example.com", Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, meta.RESTScopeNamespace)
+	resources, err := resourcesFor(mapper, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{{Group: "example.com", Version: "v1", Resource: "widgets"}}, resources)
+}
+
+func TestInvalidHealthRules(t *testing.T) {
+	for name, rule := range map[string]*HealthRule{
+		"no kind":         {JSONPath: "{.status.phase}"},
+		"no expression":   {Kind: "Widget"},
+		"two expressions": {Kind: "Widget", JSONPath: "{.status.phase}", CEL: "true"},
+		"bad jsonpath":    {Kind: "Widget", JSONPath: "{.status.phase"},
+		"bad cel":         {Kind: "Widget", CEL: "object.status.phase =="},
+		"not bool":        {Kind: "Widget", CEL: "'ready'"},
+		"bad message":     {Kind: "Widget", CEL: "true", Message: "{.status"},
+	} {
+		_, err := NewRuleStatusViewer(rule)
+		assert.Error(t, err, name)
+	}
+
+	rule := &HealthRule{Kind: "Widget", CEL: "true"}
+	assert.Error(t, SetHealthRules([]*HealthRule{rule, rule}), "duplicates should be rejected")
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// StartRecord records how long the last start of the cluster took to be
+// ready.
+type StartRecord struct {
+	Started time.Time `json:"started"`
+	// ReadyAt is the time at which all the workloads became ready.
+	ReadyAt time.Time `json:"ready_at"`
+}
+
+// TimeToReady returns the time the cluster took to be ready.
+func (r *StartRecord) TimeToReady() time.Duration {
+	return r.ReadyAt.Sub(r.Started)
+}
+
+// Save saves the record in the file at path.
+func (r *StartRecord) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// ReadStartRecord reads the record saved at path. It returns nil if no
+// start has been recorded.
+func ReadStartRecord(path string) (*StartRecord, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &StartRecord{}
+	if err = json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("bad start record %s: %w", path, err)
+	}
+	return record, nil
+}
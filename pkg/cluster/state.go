@@ -0,0 +1,289 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type ClusterStatus int16
+
+const (
+	Undefined ClusterStatus = iota
+	Uninstalled
+	Installed
+	Started
+)
+
+func (s ClusterStatus) String() (r string) {
+
+	switch s {
+	case Undefined:
+		r = "undefined"
+	case Uninstalled:
+		r = "uninstalled"
+	case Installed:
+		r = "installed"
+	case Started:
+		r = "started"
+	}
+	return
+}
+
+type ClusterPhase int16
+
+const (
+	// Stopped: the distribution is not running or kubernetes is not started.
+	Stopped ClusterPhase = iota
+	// Booting: the distribution is running but OpenRC hasn't finished booting.
+	Booting
+	// Starting: the iknite service is starting or the API server doesn't
+	// answer yet.
+	Starting
+	// Ready: the API server and the node are healthy.
+	Ready
+	// Degraded: the API server answers but some of its checks fail or the
+	// node is not ready or under pressure.
+	Degraded
+	// Stopping: the iknite service is stopping.
+	Stopping
+	// Error: the iknite service has crashed.
+	Error
+)
+
+func (p ClusterPhase) String() (r string) {
+	switch p {
+	case Stopped:
+		r = "stopped"
+	case Booting:
+		r = "booting"
+	case Starting:
+		r = "starting"
+	case Ready:
+		r = "ready"
+	case Degraded:
+		r = "degraded"
+	case Stopping:
+		r = "stopping"
+	case Error:
+		r = "error"
+	}
+	return
+}
+
+// IsUp tells if kubernetes is started or on its way.
+func (p ClusterPhase) IsUp() bool {
+	return p == Starting || p == Ready || p == Degraded
+}
+
+// The iknite service states, as found in /run/openrc.
+const (
+	ServiceStopped  = ""
+	ServiceStarting = "starting"
+	ServiceStarted  = "started"
+	ServiceStopping = "stopping"
+	ServiceFailed   = "failed"
+)
+
+// guestProbeScript gathers the state of the guest in one call. It outputs
+// key=value lines parsed by ParseGuestProbe.
+const guestProbeScript = `[ -e /run/openrc/softlevel ] && echo booted=yes
+for s in started starting stopping failed; do [ -e /run/openrc/$s/iknite ] && echo service=$s; done
+echo uptime=$(cut -d' ' -f1 /proc/uptime)
+echo ip=$(ip -4 -o addr show dev eth0 2>/dev/null | awk '{print $4}' | cut -d/ -f1 | head -n 1)
+echo iknite_version=$(/sbin/iknite --version 2>/dev/null | awk '{print $NF}')
+echo kubernetes_version=$(kubelet --version 2>/dev/null | awk '{print $NF}')
+`
+
+// GuestState is the state of the distribution as seen from inside.
+type GuestState struct {
+	Booted            bool
+	Service           string
+	Uptime            time.Duration
+	IPAddress         string
+	IkniteVersion     string
+	KubernetesVersion string
+}
+
+// ParseGuestProbe reads the output of guestProbeScript.
+func ParseGuestProbe(output string) (state GuestState) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "booted":
+			state.Booted = value == "yes"
+		case "service":
+			state.Service = value
+		case "uptime":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				state.Uptime = time.Duration(seconds * float64(time.Second)).Round(time.Second)
+			}
+		case "ip":
+			state.IPAddress = value
+		case "iknite_version":
+			state.IkniteVersion = value
+		case "kubernetes_version":
+			state.KubernetesVersion = value
+		}
+	}
+	return
+}
+
+// NodeCondition is a condition of the node, like MemoryPressure.
+type NodeCondition struct {
+	Type    string
+	Ok      bool
+	Message string
+}
+
+// ReadyzCheck is one of the checks of the API server /readyz endpoint.
+type ReadyzCheck struct {
+	Name    string
+	Ok      bool
+	Message string
+}
+
+// ClusterState gives a detailed view of the cluster, beyond its installation
+// status.
+type ClusterState struct {
+	Name   string
+	Status ClusterStatus
+	Phase  ClusterPhase
+	// Running tells if the WSL distribution is running.
+	Running bool
+	GuestState
+	// APIReachable tells if the API server answered.
+	APIReachable   bool
+	NodeConditions []NodeCondition
+	ReadyzChecks   []ReadyzCheck
+	// Message explains why the cluster is not ready.
+	Message string
+}
+
+// ParseReadyz reads the output of /readyz?verbose. Lines look like
+// "[+]ping ok" or "[-]etcd failed: reason withheld".
+func ParseReadyz(output string) (checks []ReadyzCheck) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 3 || line[0] != '[' || line[2] != ']' {
+			continue
+		}
+		name, message, _ := strings.Cut(line[3:], " ")
+		checks = append(checks, ReadyzCheck{Name: name, Ok: line[1] == '+', Message: message})
+	}
+	return
+}
+
+// nodeConditionTypes are the conditions reported in the state. Ready is
+// expected true, the others false.
+var nodeConditionTypes = []v1.NodeConditionType{
+	v1.NodeReady,
+	v1.NodeMemoryPressure,
+	v1.NodeDiskPressure,
+	v1.NodePIDPressure,
+	v1.NodeNetworkUnavailable,
+}
+
+// ProbeKubernetes fills the kubernetes part of the state: the /readyz checks
+// of the API server and the conditions of the nodes.
+func (s *ClusterState) ProbeKubernetes(ctx context.Context, client kubernetes.Interface) (err error) {
+	s.APIReachable = false
+	s.ReadyzChecks = nil
+	s.NodeConditions = nil
+
+	if restClient := client.Discovery().RESTClient(); restClient != nil {
+		// /readyz answers 500 with the details when a check fails
+		body, _ := restClient.Get().AbsPath("/readyz").Param("verbose", "").DoRaw(ctx)
+		s.ReadyzChecks = ParseReadyz(string(body))
+	}
+
+	var nodes *v1.NodeList
+	if nodes, err = client.CoreV1().Nodes().List(ctx, metav1.ListOptions{}); err != nil {
+		return
+	}
+	s.APIReachable = true
+
+	for _, node := range nodes.Items {
+		for _, conditionType := range nodeConditionTypes {
+			for _, condition := range node.Status.Conditions {
+				if condition.Type != conditionType {
+					continue
+				}
+				ok := condition.Status == v1.ConditionFalse
+				if conditionType == v1.NodeReady {
+					ok = condition.Status == v1.ConditionTrue
+				}
+				name := string(conditionType)
+				if len(nodes.Items) > 1 {
+					name = fmt.Sprintf("%s/%s", node.Name, conditionType)
+				}
+				s.NodeConditions = append(s.NodeConditions, NodeCondition{Type: name, Ok: ok, Message: condition.Message})
+			}
+		}
+	}
+	return
+}
+
+// UpdatePhase computes the phase from the installation status, the guest
+// state and the kubernetes probes.
+func (s *ClusterState) UpdatePhase() {
+	s.Message = ""
+	switch {
+	case s.Status == Uninstalled || !s.Running:
+		s.Phase = Stopped
+	case s.Service == ServiceFailed:
+		s.Phase = Error
+		s.Message = "iknite service has crashed"
+	case s.Service == ServiceStopping:
+		s.Phase = Stopping
+	case !s.Booted:
+		s.Phase = Booting
+	case s.Service == ServiceStopped:
+		s.Phase = Stopped
+	case s.Service == ServiceStarting || !s.APIReachable:
+		s.Phase = Starting
+	default:
+		s.Phase = Ready
+		var failing []string
+		for _, check := range s.ReadyzChecks {
+			if !check.Ok {
+				failing = append(failing, check.Name)
+			}
+		}
+		for _, condition := range s.NodeConditions {
+			if !condition.Ok {
+				failing = append(failing, condition.Type)
+			}
+		}
+		if len(failing) > 0 {
+			s.Phase = Degraded
+			s.Message = "failing: " + strings.Join(failing, ", ")
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestParseGuestProbe(t *testing.T) {
+	state := ParseGuestProbe(`booted=yes
+service=started
+uptime=3725.42
+ip=192.168.99.2
+iknite_version=v0.2.1
+kubernetes_version=v1.30.2
+`)
+	assert.Equal(t, GuestState{
+		Booted:            true,
+		Service:           ServiceStarted,
+		Uptime:            3725 * time.Second,
+		IPAddress:         "192.168.99.2",
+		IkniteVersion:     "v0.2.1",
+		KubernetesVersion: "v1.30.2",
+	}, state)
+}
+
+const readyzFailure = `[+]ping ok
+[+]log ok
+[-]etcd failed: reason withheld
+readyz check failed
+`
+
+func TestParseReadyz(t *testing.T) {
+	checks := ParseReadyz(readyzFailure)
+	require.Len(t, checks, 3)
+	assert.Equal(t, ReadyzCheck{Name: "ping", Ok: true, Message: "ok"}, checks[0])
+	assert.Equal(t, ReadyzCheck{Name: "etcd", Ok: false, Message: "failed: reason withheld"}, checks[2])
+}
+
+func TestUpdatePhase(t *testing.T) {
+	tests := []struct {
+		name  string
+		state ClusterState
+		phase ClusterPhase
+	}{
+		{"uninstalled", ClusterState{Status: Uninstalled}, Stopped},
+		{"not running", ClusterState{Status: Installed}, Stopped},
+		{"booting", ClusterState{Status: Installed, Running: true}, Booting},
+		{"service stopped", ClusterState{Status: Installed, Running: true, GuestState: GuestState{Booted: true}}, Stopped},
+		{"crashed", ClusterState{Status: Installed, Running: true, GuestState: GuestState{Booted: true, Service: ServiceFailed}}, Error},
+		{"stopping", ClusterState{Status: Started, Running: true, GuestState: GuestState{Booted: true, Service: ServiceStopping}}, Stopping},
+		{"starting", ClusterState{Status: Installed, Running: true, GuestState: GuestState{Booted: true, Service: ServiceStarting}}, Starting},
+		{"api down", ClusterState{Status: Started, Running: true, GuestState: GuestState{Booted: true, Service: ServiceStarted}}, Starting},
+		{"ready", ClusterState{Status: Started, Running: true, APIReachable: true, GuestState: GuestState{Booted: true, Service: ServiceStarted},
+			NodeConditions: []NodeCondition{{Type: "Ready", Ok: true}}}, Ready},
+		{"pressure", ClusterState{Status: Started, Running: true, APIReachable: true, GuestState: GuestState{Booted: true, Service: ServiceStarted},
+			NodeConditions: []NodeCondition{{Type: "Ready", Ok: true}, {Type: "DiskPressure"}}}, Degraded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.state.UpdatePhase()
+			assert.Equal(t, test.phase, test.state.Phase)
+		})
+	}
+}
+
+func TestProbeKubernetes(t *testing.T) {
+	nodes := &v1.NodeList{
+		TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"},
+		Items: []v1.Node{{
+			ObjectMeta: metav1.ObjectMeta{Name: "kaweezle"},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+				{Type: v1.NodeMemoryPressure, Status: v1.ConditionTrue, Message: "kubelet has insufficient memory available"},
+				{Type: v1.NodeDiskPressure, Status: v1.ConditionFalse},
+			}},
+		}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(readyzFailure))
+	})
+	mux.HandleFunc("/api/v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodes)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	state := &ClusterState{Status: Started, Running: true, GuestState: GuestState{Booted: true, Service: ServiceStarted}}
+	require.NoError(t, state.ProbeKubernetes(context.Background(), client))
+	assert.True(t, state.APIReachable)
+	assert.Len(t, state.ReadyzChecks, 3)
+	assert.Equal(t, []NodeCondition{
+		{Type: "Ready", Ok: true},
+		{Type: "MemoryPressure", Ok: false, Message: "kubelet has insufficient memory available"},
+		{Type: "DiskPressure", Ok: true},
+	}, state.NodeConditions)
+
+	state.UpdatePhase()
+	assert.Equal(t, Degraded, state.Phase)
+	assert.Equal(t, "failing: etcd, MemoryPressure", state.Message)
+}
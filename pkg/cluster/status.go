@@ -15,19 +15,24 @@
 package cluster
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/kubectl/pkg/polymorphichelpers"
 )
 
@@ -36,6 +41,10 @@ type WorkloadState struct {
 	Name      string
 	Ok        bool
 	Message   string
+	// Ignored workloads don't prevent the cluster from being ready.
+	Ignored bool
+	// Created is the creation time of the workload.
+	Created time.Time
 }
 
 func OkString(b bool) string {
@@ -47,7 +56,11 @@ func OkString(b bool) string {
 
 func (r *WorkloadState) LongString() string {
 
-	return fmt.Sprintf("%s %-20s %-54s %s", OkString(r.Ok), r.Namespace, r.Name, r.Message)
+	message := r.Message
+	if r.Ignored {
+		message += " (ignored)"
+	}
+	return fmt.Sprintf("%s %-20s %-54s %s", OkString(r.Ok), r.Namespace, r.Name, message)
 }
 
 func (r *WorkloadState) String() string {
@@ -68,26 +81,66 @@ type HealthStatus struct {
 	Message string `json:"message,omitempty" protobuf:"bytes,2,opt,name=message"`
 }
 
+// ResourceStatus is the status of a resource managed by an application.
+type ResourceStatus struct {
+	Group     string        `json:"group,omitempty" protobuf:"bytes,1,opt,name=group"`
+	Kind      string        `json:"kind,omitempty" protobuf:"bytes,3,opt,name=kind"`
+	Namespace string        `json:"namespace,omitempty" protobuf:"bytes,4,opt,name=namespace"`
+	Name      string        `json:"name,omitempty" protobuf:"bytes,5,opt,name=name"`
+	Status    string        `json:"status,omitempty" protobuf:"bytes,6,opt,name=status"`
+	Health    *HealthStatus `json:"health,omitempty" protobuf:"bytes,7,opt,name=health"`
+}
+
+func (r *ResourceStatus) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s/%s", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// OperationState is the state of the current or last sync operation of an
+// application.
+type OperationState struct {
+	Phase   string `json:"phase" protobuf:"bytes,2,opt,name=phase"`
+	Message string `json:"message,omitempty" protobuf:"bytes,3,opt,name=message"`
+}
+
 type ApplicationStatus struct {
-	Sync   SyncStatus   `json:"sync,omitempty" protobuf:"bytes,2,opt,name=sync"`
-	Health HealthStatus `json:"health,omitempty" protobuf:"bytes,3,opt,name=health"`
+	Resources      []ResourceStatus `json:"resources,omitempty" protobuf:"bytes,1,opt,name=resources"`
+	Sync           SyncStatus       `json:"sync,omitempty" protobuf:"bytes,2,opt,name=sync"`
+	Health         HealthStatus     `json:"health,omitempty" protobuf:"bytes,3,opt,name=health"`
+	OperationState *OperationState  `json:"operationState,omitempty" protobuf:"bytes,7,opt,name=operationState"`
+}
+
+// maxOutOfSyncShown is the number of out of sync resources listed in the
+// status of an application.
+const maxOutOfSyncShown = 5
+
+// OutOfSync returns the resources of the application that are not synced.
+func (s *ApplicationStatus) OutOfSync() (result []ResourceStatus) {
+	for _, resource := range s.Resources {
+		if resource.Status == "OutOfSync" {
+			result = append(result, resource)
+		}
+	}
+	return
+}
+
+// Operation is the operation requested on an application. It is removed by
+// Argo CD once processed.
+type Operation struct {
+	Sync map[string]interface{} `json:"sync,omitempty" protobuf:"bytes,1,opt,name=sync"`
 }
 
 type Application struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata" protobuf:"bytes,1,opt,name=metadata"`
 	Status            ApplicationStatus `json:"status,omitempty" protobuf:"bytes,3,opt,name=status"`
+	Operation         *Operation        `json:"operation,omitempty" protobuf:"bytes,4,opt,name=operation"`
 }
 
 type ApplicationStatusViewer struct{}
 
-func StatusViewerFor(kind schema.GroupKind) (polymorphichelpers.StatusViewer, error) {
-	if kind == ApplicationSchemaGroupVersionKind.GroupKind() {
-		return &ApplicationStatusViewer{}, nil
-	}
-	return polymorphichelpers.StatusViewerFor(kind)
-}
-
 func (s *ApplicationStatusViewer) Status(obj runtime.Unstructured, revision int64) (string, bool, error) {
 	application := &Application{}
 
@@ -100,7 +153,31 @@ func (s *ApplicationStatusViewer) Status(obj runtime.Unstructured, revision int6
 	syncStatusString := application.Status.Sync.Status
 
 	msg := fmt.Sprintf("application \"%s\" sync status: %s, health status: %s", application.Name, syncStatusString, healthStatusString)
-	return msg, healthStatusString == "Healthy" && syncStatusString == "Synced", nil
+	ok := healthStatusString == "Healthy" && syncStatusString == "Synced"
+	// The status is stale until the requested refresh or sync is processed
+	if _, refreshing := application.Annotations[RefreshAnnotation]; refreshing {
+		msg += ", refresh pending"
+		ok = false
+	} else if application.Operation != nil {
+		msg += ", sync in progress"
+		ok = false
+	}
+	if !ok {
+		if outOfSync := application.Status.OutOfSync(); len(outOfSync) > 0 {
+			names := make([]string, 0, maxOutOfSyncShown)
+			for i := 0; i < len(outOfSync) && i < maxOutOfSyncShown; i++ {
+				names = append(names, outOfSync[i].String())
+			}
+			if len(outOfSync) > maxOutOfSyncShown {
+				names = append(names, fmt.Sprintf("and %d more", len(outOfSync)-maxOutOfSyncShown))
+			}
+			msg += fmt.Sprintf(", out of sync: %s", strings.Join(names, ", "))
+		}
+		if operation := application.Status.OperationState; operation != nil && (operation.Phase == "Failed" || operation.Phase == "Error") {
+			msg += fmt.Sprintf(", operation %s: %s", operation.Phase, operation.Message)
+		}
+	}
+	return msg, ok, nil
 }
 
 func HasApplications(client *k8s.RESTClientGetter) (has bool, err error) {
@@ -122,50 +199,120 @@ func HasApplications(client *k8s.RESTClientGetter) (has bool, err error) {
 	return
 }
 
-func AllWorkloadStates(client *k8s.RESTClientGetter) (result []*WorkloadState, err error) {
-	var _result []*WorkloadState
+// unstructuredWorkloadState computes the state of obj with the status viewer
+// of its kind. resource is the plural name of the kind.
+func unstructuredWorkloadState(resource string, obj *unstructured.Unstructured) (state *WorkloadState, err error) {
+	var v polymorphichelpers.StatusViewer
+	if v, err = StatusViewerFor(obj.GroupVersionKind().GroupKind()); err != nil {
+		return
+	}
 
-	var resourceTypes = "deployments,statefulsets,daemonsets"
-	var hasApplications bool
-	if hasApplications, err = HasApplications(client); err != nil {
+	var msg string
+	var ok bool
+	if msg, ok, err = v.Status(obj, 0); err != nil {
 		return
 	}
-	if hasApplications {
-		resourceTypes += ",applications"
+	state = &WorkloadState{
+		Namespace: obj.GetNamespace(),
+		Name:      fmt.Sprintf("%s/%s", resource, obj.GetName()),
+		Ok:        ok,
+		Message:   strings.TrimSuffix(msg, "\n"),
+		Created:   obj.GetCreationTimestamp().Time,
 	}
+	return
+}
 
-	r := resource.NewBuilder(client).
-		Unstructured().
-		AllNamespaces(true).
-		ResourceTypeOrNameArgs(true, resourceTypes).
-		ContinueOnError().
-		Flatten().
-		Do()
-
-	var infos []*resource.Info
-	if infos, err = r.Infos(); err != nil {
+// TrackedResources returns the resources of the workload and health rule
+// kinds present in the cluster, or the ones of the filter kinds if any.
+func TrackedResources(client *k8s.RESTClientGetter, filter *WorkloadFilter) (resources []schema.GroupVersionResource, err error) {
+	var mapper meta.RESTMapper
+	if mapper, err = client.ToRESTMapper(); err != nil {
 		return
 	}
+	var discoveryClient discovery.CachedDiscoveryInterface
+	if discoveryClient, err = client.ToDiscoveryClient(); err != nil {
+		return
+	}
+	return resourcesFor(restmapper.NewShortcutExpander(mapper, discoveryClient, nil), filter)
+}
 
-	for _, info := range infos {
-		var u map[string]interface{}
-
-		if u, err = runtime.DefaultUnstructuredConverter.ToUnstructured(info.Object); err != nil {
-			return
+// resourcesFor resolves the resources to track with mapper. Cluster scoped
+// resources are skipped when the filter restricts the namespace.
+func resourcesFor(mapper meta.RESTMapper, filter *WorkloadFilter) (resources []schema.GroupVersionResource, err error) {
+	var mappings []*meta.RESTMapping
+	if kinds := filter.kinds(); len(kinds) > 0 {
+		for _, kind := range kinds {
+			var gvk schema.GroupVersionKind
+			partial := schema.ParseGroupResource(strings.ToLower(kind)).WithVersion("")
+			if gvk, err = mapper.KindFor(partial); err != nil {
+				err = errors.Wrapf(err, "unknown kind %s", kind)
+				return
+			}
+			var mapping *meta.RESTMapping
+			if mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+				return
+			}
+			mappings = append(mappings, mapping)
+		}
+	} else {
+		for _, kind := range trackedKinds() {
+			var mapping *meta.RESTMapping
+			if mapping, err = mapper.RESTMapping(kind); err != nil {
+				if meta.IsNoMatchError(err) {
+					err = nil
+					continue
+				}
+				return
+			}
+			mappings = append(mappings, mapping)
 		}
+	}
 
-		var v polymorphichelpers.StatusViewer
-		if v, err = /* polymorphichelpers. */ StatusViewerFor(info.Object.GetObjectKind().GroupVersionKind().GroupKind()); err != nil {
-			return
+	for _, mapping := range mappings {
+		if filter.namespace() != "" && mapping.Scope.Name() == meta.RESTScopeNameRoot {
+			continue
 		}
+		resources = append(resources, mapping.Resource)
+	}
+	return
+}
 
-		var msg string
-		var ok bool
-		if msg, ok, err = v.Status(&unstructured.Unstructured{Object: u}, 0); err != nil {
-			return
+// AllWorkloadStates returns the states of the workloads selected by filter.
+// A nil filter selects the default workload kinds in all namespaces.
+func AllWorkloadStates(client *k8s.RESTClientGetter, filter *WorkloadFilter) (result []*WorkloadState, err error) {
+	var config *rest.Config
+	if config, err = client.ToRESTConfig(); err != nil {
+		return
+	}
+	var dynamicClient dynamic.Interface
+	if dynamicClient, err = dynamic.NewForConfig(config); err != nil {
+		return
+	}
+	var resources []schema.GroupVersionResource
+	if resources, err = TrackedResources(client, filter); err != nil {
+		return
+	}
+	return WorkloadStatesFor(context.Background(), dynamicClient, resources, filter)
+}
+
+// WorkloadStatesFor returns the states of the objects of resources selected
+// by filter, sorted.
+func WorkloadStatesFor(ctx context.Context, client dynamic.Interface, resources []schema.GroupVersionResource, filter *WorkloadFilter) (result []*WorkloadState, err error) {
+	var _result []*WorkloadState
+	for _, gvr := range resources {
+		var list *unstructured.UnstructuredList
+		if list, err = client.Resource(gvr).Namespace(filter.namespace()).List(ctx, metav1.ListOptions{LabelSelector: filter.selector()}); err != nil {
+			return nil, errors.Wrapf(err, "while listing %s", gvr.GroupResource())
+		}
+		for i := range list.Items {
+			var state *WorkloadState
+			if state, err = unstructuredWorkloadState(gvr.Resource, &list.Items[i]); err != nil {
+				return nil, err
+			}
+			_result = append(_result, state)
 		}
-		_result = append(_result, &WorkloadState{info.Namespace, info.ObjectName(), ok, strings.TrimSuffix(msg, "\n")})
 	}
+	_result = filter.apply(_result)
 	sort.SliceStable(_result, func(i, j int) bool {
 		return _result[i].String() < _result[j].String()
 	})
@@ -173,24 +320,43 @@ func AllWorkloadStates(client *k8s.RESTClientGetter) (result []*WorkloadState, e
 	return
 }
 
+// SplitWorkloadStates separates the ready workloads from the unready ones.
+// The result is true when all the workloads not ignored are ready.
+func SplitWorkloadStates(states []*WorkloadState) (result bool, ready []*WorkloadState, unready []*WorkloadState) {
+	result = true
+	for _, state := range states {
+		if !state.Ok {
+			if !state.Ignored {
+				result = false
+			}
+			unready = append(unready, state)
+		} else {
+			ready = append(ready, state)
+		}
+	}
+	return
+}
+
+// BlockingWorkloadStates returns the unready workloads that are not ignored,
+// i.e. the ones preventing the cluster from being ready.
+func BlockingWorkloadStates(unready []*WorkloadState) (result []*WorkloadState) {
+	for _, state := range unready {
+		if !state.Ok && !state.Ignored {
+			result = append(result, state)
+		}
+	}
+	return
+}
+
 type WorkloadStateCallbackFunc func(state bool, total int, ready []*WorkloadState, unready []*WorkloadState)
 
-func AreWorkloadsReady(client *k8s.RESTClientGetter, callback WorkloadStateCallbackFunc) wait.ConditionFunc {
+func AreWorkloadsReady(client *k8s.RESTClientGetter, filter *WorkloadFilter, callback WorkloadStateCallbackFunc) wait.ConditionFunc {
 	return func() (bool, error) {
-		states, err := AllWorkloadStates(client)
+		states, err := AllWorkloadStates(client, filter)
 		if err != nil {
 			return false, err
 		}
-		var result bool = true
-		var ready, unready []*WorkloadState
-		for _, state := range states {
-			if !state.Ok {
-				result = false
-				unready = append(unready, state)
-			} else {
-				ready = append(ready, state)
-			}
-		}
+		result, ready, unready := SplitWorkloadStates(states)
 
 		if callback != nil {
 			callback(result, len(states), ready, unready)
@@ -200,6 +366,27 @@ func AreWorkloadsReady(client *k8s.RESTClientGetter, callback WorkloadStateCallb
 	}
 }
 
-func WaitForWorkloads(client *k8s.RESTClientGetter, timeout time.Duration, callback WorkloadStateCallbackFunc) error {
-	return wait.PollImmediate(time.Second*time.Duration(2), timeout, AreWorkloadsReady(client, callback))
+// WaitForWorkloads waits for the workloads selected by filter to be ready.
+// callback is called each time the workloads states change. A zero timeout
+// waits forever.
+func WaitForWorkloads(client *k8s.RESTClientGetter, filter *WorkloadFilter, timeout time.Duration, callback WorkloadStateCallbackFunc) (err error) {
+	return WaitForWorkloadsContext(context.Background(), client, filter, timeout, callback)
+}
+
+// WaitForWorkloadsContext is WaitForWorkloads stopping with
+// wait.ErrWaitTimeout when ctx is done.
+func WaitForWorkloadsContext(ctx context.Context, client *k8s.RESTClientGetter, filter *WorkloadFilter, timeout time.Duration, callback WorkloadStateCallbackFunc) (err error) {
+	var config *rest.Config
+	if config, err = client.ToRESTConfig(); err != nil {
+		return
+	}
+	var dynamicClient dynamic.Interface
+	if dynamicClient, err = dynamic.NewForConfig(config); err != nil {
+		return
+	}
+	var resources []schema.GroupVersionResource
+	if resources, err = TrackedResources(client, filter); err != nil {
+		return
+	}
+	return NewReadinessTracker(dynamicClient, resources, filter, callback).Wait(ctx, timeout)
 }
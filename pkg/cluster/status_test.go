@@ -0,0 +1,59 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestBlockingWorkloadStates(t *testing.T) {
+	ready := &WorkloadState{Namespace: "default", Name: "deployments/ready", Ok: true}
+	blocking := &WorkloadState{Namespace: "default", Name: "deployments/blocking"}
+	ignored := &WorkloadState{Namespace: "demo", Name: "deployments/ignored", Ignored: true}
+
+	result, _, unready := SplitWorkloadStates([]*WorkloadState{ready, blocking, ignored})
+	assert.False(t, result)
+	assert.Equal(t, []*WorkloadState{blocking}, BlockingWorkloadStates(unready), "ignored workloads are not diagnosed")
+	assert.Empty(t, BlockingWorkloadStates([]*WorkloadState{ignored}))
+}
+
+func TestWorkloadStatesFor(t *testing.T) {
+	labeled := testDeployment("default", "labeled", 0)
+	labeled.SetLabels(map[string]string{"tier": "front"})
+	client := newFakeDynamicClient(
+		labeled,
+		testDeployment("default", "unlabeled", 1),
+		testDeployment("kube-system", "coredns", 1),
+		testApplication("apps", "Healthy"),
+	)
+	resources := []schema.GroupVersionResource{deploymentsResource, applicationsResource}
+
+	states, err := WorkloadStatesFor(context.Background(), client, resources, nil)
+	require.NoError(t, err)
+	require.Len(t, states, 4)
+	assert.Equal(t, "argocd/applications/apps:🟩", states[0].String())
+	assert.Equal(t, "kube-system/deployments/coredns:🟩", states[3].String())
+
+	states, err = WorkloadStatesFor(context.Background(), client, resources, &WorkloadFilter{Namespace: "default", Selector: "tier=front", Ignore: []string{"default"}})
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, "default/deployments/labeled:🟥", states[0].String())
+	assert.True(t, states[0].Ignored)
+}
@@ -0,0 +1,267 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultSyncTimeout is the time given to the informers to list the
+// resources, even when the wait has no timeout.
+const DefaultSyncTimeout = 2 * time.Minute
+
+// ReadinessTracker follows the readiness of workloads through informers.
+// The states are only recomputed for the objects that change and the
+// callback is only called when the overall result changes.
+type ReadinessTracker struct {
+	// SyncTimeout is the maximum time taken by the initial listing.
+	SyncTimeout time.Duration
+
+	client    dynamic.Interface
+	resources []schema.GroupVersionResource
+	filter    *WorkloadFilter
+	callback  WorkloadStateCallbackFunc
+
+	mutex     sync.Mutex
+	synced    bool
+	states    map[string]*WorkloadState
+	signature string
+	ready     chan struct{}
+	closed    bool
+	// pending is the last notification not yet given to the callback. The
+	// callback is called outside of mutex so that it doesn't block the
+	// informers handlers. delivering serializes the calls.
+	pending    *trackerNotification
+	wake       chan struct{}
+	delivering sync.Mutex
+}
+
+type trackerNotification struct {
+	result         bool
+	total          int
+	ready, unready []*WorkloadState
+}
+
+// NewReadinessTracker creates a tracker of the resources selected by filter,
+// which can be nil.
+func NewReadinessTracker(client dynamic.Interface, resources []schema.GroupVersionResource, filter *WorkloadFilter, callback WorkloadStateCallbackFunc) *ReadinessTracker {
+	return &ReadinessTracker{
+		SyncTimeout: DefaultSyncTimeout,
+		client:      client,
+		resources:   resources,
+		filter:      filter,
+		callback:    callback,
+		states:      make(map[string]*WorkloadState),
+		ready:       make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func trackerKey(gvr schema.GroupVersionResource, namespace string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", gvr.GroupResource(), namespace, name)
+}
+
+func (t *ReadinessTracker) update(gvr schema.GroupVersionResource, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	state, err := unstructuredWorkloadState(gvr.Resource, u)
+	if err != nil {
+		log.WithError(err).WithField("resource", gvr.String()).Debug("Couldn't compute workload state")
+		return
+	}
+
+	key := trackerKey(gvr, u.GetNamespace(), u.GetName())
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.filter.Excludes(state) {
+		delete(t.states, key)
+	} else {
+		state.Ignored = t.filter.Ignores(state)
+		t.states[key] = state
+	}
+	t.notify()
+}
+
+func (t *ReadinessTracker) delete(gvr schema.GroupVersionResource, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.states, trackerKey(gvr, u.GetNamespace(), u.GetName()))
+	t.notify()
+}
+
+// notify schedules a call to the callback if the states have changed since
+// the last call. It must be called with the mutex held.
+func (t *ReadinessTracker) notify() {
+	if !t.synced {
+		return
+	}
+
+	states := t.sortedStates()
+	var builder strings.Builder
+	for _, state := range states {
+		fmt.Fprintf(&builder, "%s\x00%t\x00%s\x00%t\x00", state, state.Ok, state.Message, state.Ignored)
+	}
+	signature := builder.String()
+	if signature == t.signature {
+		return
+	}
+	t.signature = signature
+
+	result, ready, unready := SplitWorkloadStates(states)
+	t.pending = &trackerNotification{result: result, total: len(states), ready: ready, unready: unready}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	if result && !t.closed {
+		t.closed = true
+		close(t.ready)
+	}
+}
+
+// deliver calls the callback with the pending notification, if any.
+func (t *ReadinessTracker) deliver() {
+	t.delivering.Lock()
+	defer t.delivering.Unlock()
+	t.mutex.Lock()
+	notification := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+	if notification != nil && t.callback != nil {
+		t.callback(notification.result, notification.total, notification.ready, notification.unready)
+	}
+}
+
+// dispatch delivers the notifications until ctx is done.
+func (t *ReadinessTracker) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.wake:
+			t.deliver()
+		}
+	}
+}
+
+// States returns the current states of the tracked workloads, sorted.
+func (t *ReadinessTracker) States() []*WorkloadState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.sortedStates()
+}
+
+// sortedStates is States with the mutex held. The states are replaced, not
+// modified, on updates so the result can be used after unlocking.
+func (t *ReadinessTracker) sortedStates() []*WorkloadState {
+	result := make([]*WorkloadState, 0, len(t.states))
+	for _, state := range t.states {
+		result = append(result, state)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result
+}
+
+// Start starts the informers and waits for their initial listing, for at
+// most SyncTimeout. The callback is called once the caches are synced and
+// then on each change.
+func (t *ReadinessTracker) Start(ctx context.Context) error {
+	selector := t.filter.selector()
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(t.client, 0, t.filter.namespace(), func(options *metav1.ListOptions) {
+		options.LabelSelector = selector
+	})
+	for _, gvr := range t.resources {
+		gvr := gvr
+		informer := factory.ForResource(gvr).Informer()
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { t.update(gvr, obj) },
+			UpdateFunc: func(_, obj interface{}) { t.update(gvr, obj) },
+			DeleteFunc: func(obj interface{}) { t.delete(gvr, obj) },
+		})
+		if err != nil {
+			return err
+		}
+	}
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, t.SyncTimeout)
+	defer cancel()
+	for gvr, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("couldn't list %s in %s", gvr.String(), t.SyncTimeout)
+		}
+	}
+
+	t.mutex.Lock()
+	t.synced = true
+	t.notify()
+	t.mutex.Unlock()
+	t.deliver()
+	go t.dispatch(ctx)
+	return nil
+}
+
+// Wait tracks the workloads until they are all ready. A zero timeout waits
+// forever. wait.ErrWaitTimeout is returned when the timeout expires.
+func (t *ReadinessTracker) Wait(ctx context.Context, timeout time.Duration) (err error) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	if err = t.Start(ctx); err != nil {
+		if ctx.Err() != nil {
+			err = wait.ErrWaitTimeout
+		}
+		return
+	}
+
+	select {
+	case <-t.ready:
+		// The callback sees the final states before returning
+		t.deliver()
+		return nil
+	case <-ctx.Done():
+		return wait.ErrWaitTimeout
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	deploymentsResource  = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	applicationsResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+)
+
+func testDeployment(namespace string, name string, available int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"namespace":  namespace,
+			"name":       name,
+			"generation": int64(1),
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+		},
+		"status": map[string]interface{}{
+			"observedGeneration": int64(1),
+			"replicas":           int64(1),
+			"updatedReplicas":    int64(1),
+			"availableReplicas":  available,
+		},
+	}}
+}
+
+func testApplication(name string, health string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Application",
+		"metadata": map[string]interface{}{
+			"namespace": "argocd",
+			"name":      name,
+		},
+		"status": map[string]interface{}{
+			"sync":   map[string]interface{}{"status": "Synced"},
+			"health": map[string]interface{}{"status": health},
+		},
+	}}
+}
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		deploymentsResource:  "DeploymentList",
+		applicationsResource: "ApplicationList",
+	}, objects...)
+}
+
+type callbackRecorder struct {
+	sync.Mutex
+	calls   int
+	ready   bool
+	unready []*WorkloadState
+}
+
+func (r *callbackRecorder) callback(state bool, total int, ready []*WorkloadState, unready []*WorkloadState) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	r.ready = state
+	r.unready = unready
+}
+
+func (r *callbackRecorder) get() (int, bool, []*WorkloadState) {
+	r.Lock()
+	defer r.Unlock()
+	return r.calls, r.ready, r.unready
+}
+
+func TestReadinessTrackerWaitsForChanges(t *testing.T) {
+	client := newFakeDynamicClient(
+		testDeployment("kube-system", "coredns", 1),
+		testDeployment("default", "app", 0),
+		testApplication("apps", "Progressing"),
+	)
+	recorder := &callbackRecorder{}
+	tracker := NewReadinessTracker(client, []schema.GroupVersionResource{deploymentsResource, applicationsResource}, nil, recorder.callback)
+
+	done := make(chan error)
+	go func() {
+		done <- tracker.Wait(context.Background(), 10*time.Second)
+	}()
+
+	require.Eventually(t, func() bool {
+		calls, _, _ := recorder.get()
+		return calls == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ready, unready := recorder.get()
+	assert.False(t, ready)
+	require.Len(t, unready, 2)
+	assert.Equal(t, "argocd/applications/apps:🟥", unready[0].String())
+	assert.Equal(t, "default/deployments/app:🟥", unready[1].String())
+
+	ctx := context.Background()
+	// Changing something that doesn't alter the state doesn't call back
+	coredns := testDeployment("kube-system", "coredns", 1)
+	coredns.SetLabels(map[string]string{"changed": "true"})
+	_, err := client.Resource(deploymentsResource).Namespace("kube-system").Update(ctx, coredns, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	_, err = client.Resource(deploymentsResource).Namespace("default").Update(ctx, testDeployment("default", "app", 1), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		calls, _, _ := recorder.get()
+		return calls == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Resource(applicationsResource).Namespace("argocd").Delete(ctx, "apps", metav1.DeleteOptions{}))
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracker didn't detect readiness")
+	}
+	calls, ready, unready := recorder.get()
+	assert.Equal(t, 3, calls)
+	assert.True(t, ready)
+	assert.Empty(t, unready)
+}
+
+func TestReadinessTrackerTimeout(t *testing.T) {
+	client := newFakeDynamicClient(testDeployment("default", "app", 0))
+	tracker := NewReadinessTracker(client, []schema.GroupVersionResource{deploymentsResource}, nil, nil)
+	assert.Equal(t, wait.ErrWaitTimeout, tracker.Wait(context.Background(), 200*time.Millisecond))
+}
+
+func TestReadinessTrackerSyncTimeout(t *testing.T) {
+	client := newFakeDynamicClient(testDeployment("default", "app", 1))
+	client.PrependReactor("list", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unreachable")
+	})
+	tracker := NewReadinessTracker(client, []schema.GroupVersionResource{deploymentsResource}, nil, nil)
+	tracker.SyncTimeout = 200 * time.Millisecond
+
+	done := make(chan error)
+	go func() {
+		done <- tracker.Wait(context.Background(), 0)
+	}()
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "couldn't list apps/v1, Resource=deployments in 200ms")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cache sync isn't bounded without timeout")
+	}
+}
+
+func TestReadinessTrackerCallbackUnlocked(t *testing.T) {
+	client := newFakeDynamicClient(testDeployment("default", "app", 0))
+	var tracker *ReadinessTracker
+	var states []*WorkloadState
+	tracker = NewReadinessTracker(client, []schema.GroupVersionResource{deploymentsResource}, nil, func(bool, int, []*WorkloadState, []*WorkloadState) {
+		// Would deadlock if the callback was called with the lock held
+		states = tracker.States()
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- tracker.Wait(context.Background(), 10*time.Second)
+	}()
+	_, err := client.Resource(deploymentsResource).Namespace("default").Update(context.Background(), testDeployment("default", "app", 1), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback blocks the tracker")
+	}
+	require.Len(t, states, 1)
+	assert.True(t, states[0].Ok)
+}
+
+func TestReadinessTrackerFilter(t *testing.T) {
+	labeled := testDeployment("default", "labeled", 1)
+	labeled.SetLabels(map[string]string{"tier": "front"})
+	demo := testDeployment("default", "demo", 0)
+	demo.SetLabels(map[string]string{"tier": "front"})
+	excluded := testDeployment("default", "excluded", 0)
+	excluded.SetLabels(map[string]string{"tier": "front"})
+	client := newFakeDynamicClient(
+		labeled,
+		demo,
+		excluded,
+		testDeployment("default", "unlabeled", 0),
+		testDeployment("kube-system", "coredns", 0),
+	)
+	filter := &WorkloadFilter{
+		Namespace: "default",
+		Selector:  "tier=front",
+		Exclude:   []string{"default/deployments/excl*"},
+		Ignore:    []string{"*/*/demo"},
+	}
+	require.NoError(t, filter.Validate())
+
+	recorder := &callbackRecorder{}
+	tracker := NewReadinessTracker(client, []schema.GroupVersionResource{deploymentsResource}, filter, recorder.callback)
+	require.NoError(t, tracker.Wait(context.Background(), 5*time.Second), "Ignored workloads shouldn't block readiness")
+
+	calls, ready, unready := recorder.get()
+	assert.Equal(t, 1, calls)
+	assert.True(t, ready)
+	require.Len(t, unready, 1)
+	assert.True(t, unready[0].Ignored)
+	assert.Equal(t, "deployments/demo", unready[0].Name)
+	assert.Len(t, tracker.States(), 2)
+}
+
+func TestWorkloadFilterPatterns(t *testing.T) {
+	state := &WorkloadState{Namespace: "demo", Name: "deployments/hello"}
+	var filter *WorkloadFilter
+	assert.False(t, filter.Excludes(state), "nil filter excludes nothing")
+
+	for pattern, expected := range map[string]bool{
+		"demo":                 true,
+		"de*":                  true,
+		"default":              false,
+		"demo/deployments/*":   true,
+		"*/*/hello":            true,
+		"demo/statefulsets/*":  false,
+		"demo/deployments/hel": false,
+	} {
+		filter = &WorkloadFilter{Exclude: []string{pattern}}
+		assert.Equal(t, expected, filter.Excludes(state), "pattern %s", pattern)
+	}
+
+	filter = &WorkloadFilter{Include: []string{"demo/deployments/hello", "argocd"}}
+	assert.False(t, filter.Excludes(state))
+	assert.True(t, filter.Excludes(&WorkloadState{Namespace: "demo", Name: "deployments/other"}))
+	assert.False(t, filter.Excludes(&WorkloadState{Namespace: "argocd", Name: "applications/apps"}))
+	filter.Exclude = []string{"demo/deployments/hel*"}
+	assert.True(t, filter.Excludes(state), "exclude wins over include")
+
+	assert.Error(t, (&WorkloadFilter{Include: []string{"demo/["}}).Validate())
+	assert.Error(t, (&WorkloadFilter{Ignore: []string{"demo/["}}).Validate())
+	assert.Error(t, (&WorkloadFilter{Selector: "tier in ("}).Validate())
+}
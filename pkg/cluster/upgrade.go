@@ -0,0 +1,189 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/config"
+	"github.com/kaweezle/kaweezle/pkg/k8s"
+	"github.com/kaweezle/kaweezle/pkg/logger"
+	"github.com/kaweezle/kaweezle/pkg/wsl"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/yuk7/wsllib-go"
+)
+
+var upgradeClusterFields = log.Fields{
+	logger.TaskKey: "Upgrade Cluster",
+}
+
+type UpgradeOptions struct {
+	// RootFS is the path of the new root file system.
+	RootFS string
+	// InstallDir is the directory containing the distribution virtual disk.
+	InstallDir string
+	// BackupDir is where the snapshot and the kept paths are saved.
+	BackupDir string
+	// KeepPaths are the paths restored in the new distribution.
+	KeepPaths []string
+	// KeepSnapshot prevents the removal of the snapshot on success.
+	KeepSnapshot bool
+	LogLevel     string
+	Timeout      time.Duration
+	// Filter selects the workloads waited for after the start.
+	Filter *WorkloadFilter
+	// Configuration is applied to the new distribution before starting.
+	Configuration *config.ConfigurationOptions
+}
+
+// BackupPaths saves the existing paths of the distribution in the tar.gz
+// file at destination.
+func BackupPaths(distributionName string, paths []string, destination string) (err error) {
+	var command []string
+	if command, err = backupPathsCommand(paths); err != nil {
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Create(destination); err != nil {
+		return
+	}
+	defer file.Close()
+
+	log.WithFields(upgradeClusterFields).WithFields(log.Fields{
+		"distribution_name": distributionName,
+		"paths":             strings.Join(paths, " "),
+		"destination":       destination,
+	}).Info("Saving paths to keep...")
+
+	if err = wsl.WslCommandToWriter(file, distributionName, command...); err != nil {
+		err = errors.Wrapf(err, "while saving paths of distribution %s", distributionName)
+	}
+	return
+}
+
+// RestorePaths extracts the tar.gz file at source in the root of the
+// distribution.
+func RestorePaths(distributionName string, source string) (err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(source); err != nil {
+		return
+	}
+	if info.Size() == 0 {
+		log.WithFields(upgradeClusterFields).WithField("distribution_name", distributionName).Info("No path to restore")
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Open(source); err != nil {
+		return
+	}
+	defer file.Close()
+
+	log.WithFields(upgradeClusterFields).WithFields(log.Fields{
+		"distribution_name": distributionName,
+		"source":            source,
+	}).Info("Restoring kept paths...")
+
+	if err = wsl.WslPipeReader(file, distributionName, "/bin/tar", "xzpf", "-", "-C", "/"); err != nil {
+		err = errors.Wrapf(err, "while restoring paths of distribution %s", distributionName)
+	}
+	return
+}
+
+func reimportDistribution(distributionName string, rootfs string, installDir string) (err error) {
+	wsl.StopDistribution(distributionName)
+	if wsllib.WslIsDistributionRegistered(distributionName) {
+		if err = wsllib.WslUnregisterDistribution(distributionName); err != nil {
+			return errors.Wrapf(err, "while unregistering distribution %s", distributionName)
+		}
+	}
+	return wsl.RegisterDistribution(distributionName, rootfs, installDir)
+}
+
+func startAndWait(distributionName string, logLevel string, filter *WorkloadFilter, timeout time.Duration) (err error) {
+	if err = StartCluster(distributionName, logLevel); err != nil {
+		return
+	}
+	if err = k8s.MergeKubernetesConfig(distributionName); err != nil {
+		return
+	}
+	return WaitForCluster(distributionName, filter, timeout)
+}
+
+// UpgradeCluster replaces the root file system of the distribution while
+// keeping the paths listed in options. The distribution is snapshotted first
+// and restored if the upgraded cluster doesn't become ready.
+func UpgradeCluster(distributionName string, options *UpgradeOptions) (err error) {
+	fields := log.Fields{
+		"distribution_name": distributionName,
+		"rootfs":            options.RootFS,
+	}
+
+	if !wsllib.WslIsDistributionRegistered(distributionName) {
+		return fmt.Errorf("distribution %s is not installed", distributionName)
+	}
+
+	if err = os.MkdirAll(options.BackupDir, os.ModePerm); err != nil {
+		return
+	}
+	stamp := time.Now().Format("20060102-150405")
+	snapshot := filepath.Join(options.BackupDir, fmt.Sprintf("%s-%s.tar", distributionName, stamp))
+	kept := filepath.Join(options.BackupDir, fmt.Sprintf("%s-%s-keep.tar.gz", distributionName, stamp))
+	defer os.Remove(kept)
+
+	steps := []upgradeStep{
+		{name: "stopping the cluster", run: func() error { return StopCluster(distributionName) }},
+		{name: "saving the paths to keep", run: func() error { return BackupPaths(distributionName, options.KeepPaths, kept) }},
+		{name: "stopping the distribution", run: func() error { return wsl.StopDistribution(distributionName) }},
+		{name: "taking the snapshot", run: func() error { return wsl.ExportDistribution(distributionName, snapshot) }},
+		{name: "importing the new root file system", rollback: true, run: func() error {
+			log.WithFields(upgradeClusterFields).WithFields(fields).Info("Importing new root file system...")
+			return reimportDistribution(distributionName, options.RootFS, options.InstallDir)
+		}},
+		{name: "restoring the kept paths", rollback: true, run: func() error { return RestorePaths(distributionName, kept) }},
+		{name: "configuring", rollback: true, run: func() error { return config.Configure(distributionName, options.Configuration) }},
+		{name: "starting", rollback: true, run: func() error {
+			return startAndWait(distributionName, options.LogLevel, options.Filter, options.Timeout)
+		}},
+	}
+	rollback := func() error {
+		log.WithFields(upgradeClusterFields).WithFields(fields).Error("Upgrade failed, rolling back...")
+		StopCluster(distributionName)
+		return reimportDistribution(distributionName, snapshot, options.InstallDir)
+	}
+	restart := func() {
+		if err := startAndWait(distributionName, options.LogLevel, options.Filter, options.Timeout); err != nil {
+			log.WithError(err).WithFields(upgradeClusterFields).WithFields(fields).Warn("Restored cluster not ready")
+		}
+		log.WithFields(upgradeClusterFields).WithFields(fields).WithField("snapshot", snapshot).Info("Distribution restored from snapshot")
+	}
+	if err = runUpgradeSteps(steps, snapshot, rollback, restart); err != nil {
+		return
+	}
+
+	if options.KeepSnapshot {
+		log.WithFields(upgradeClusterFields).WithFields(fields).WithField("snapshot", snapshot).Info("Snapshot kept")
+	} else {
+		os.Remove(snapshot)
+	}
+	log.WithFields(upgradeClusterFields).WithFields(fields).Info("Cluster upgraded")
+	return
+}
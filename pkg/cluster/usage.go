@@ -0,0 +1,298 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+// ErrMetricsUnavailable is returned when the metrics API is not served,
+// usually because metrics-server is not installed or not ready.
+var ErrMetricsUnavailable = errors.New("metrics API not available, is metrics-server installed?")
+
+// UsageSortKeys are the accepted values to sort the resource usages.
+var UsageSortKeys = []string{"cpu", "memory", "name"}
+
+// ResourceUsage is an amount of CPU and memory.
+type ResourceUsage struct {
+	// CPU is in millicores.
+	CPU int64 `json:"cpu"`
+	// Memory is in bytes.
+	Memory int64 `json:"memory"`
+}
+
+func (u *ResourceUsage) add(list v1.ResourceList) {
+	u.CPU += list.Cpu().MilliValue()
+	u.Memory += list.Memory().Value()
+}
+
+type NodeUsage struct {
+	Name string `json:"name"`
+	ResourceUsage
+	// Allocatable is the amount of resources available for the pods.
+	Allocatable ResourceUsage `json:"allocatable"`
+}
+
+type PodUsage struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	ResourceUsage
+}
+
+type NamespaceUsage struct {
+	Name string `json:"name"`
+	Pods int    `json:"pods"`
+	ResourceUsage
+}
+
+// ClusterUsage is the resource usage of the nodes and pods reported by the
+// metrics API.
+type ClusterUsage struct {
+	Nodes []*NodeUsage
+	Pods  []*PodUsage
+}
+
+// Total returns the usage and the allocatable resources of all the nodes.
+func (u *ClusterUsage) Total() (usage ResourceUsage, allocatable ResourceUsage) {
+	for _, node := range u.Nodes {
+		usage.CPU += node.CPU
+		usage.Memory += node.Memory
+		allocatable.CPU += node.Allocatable.CPU
+		allocatable.Memory += node.Allocatable.Memory
+	}
+	return
+}
+
+// Namespaces returns the usage of the pods summed by namespace.
+func (u *ClusterUsage) Namespaces() (result []*NamespaceUsage) {
+	byName := make(map[string]*NamespaceUsage)
+	for _, pod := range u.Pods {
+		namespace, ok := byName[pod.Namespace]
+		if !ok {
+			namespace = &NamespaceUsage{Name: pod.Namespace}
+			byName[pod.Namespace] = namespace
+			result = append(result, namespace)
+		}
+		namespace.Pods++
+		namespace.CPU += pod.CPU
+		namespace.Memory += pod.Memory
+	}
+	return
+}
+
+// usageLess returns a less function comparing the usages by key, in
+// decreasing order for cpu and memory.
+func usageLess(key string, name func(i int) string, usage func(i int) *ResourceUsage) (func(i, j int) bool, error) {
+	switch key {
+	case "cpu":
+		return func(i, j int) bool { return usage(i).CPU > usage(j).CPU }, nil
+	case "memory":
+		return func(i, j int) bool { return usage(i).Memory > usage(j).Memory }, nil
+	case "name":
+		return func(i, j int) bool { return name(i) < name(j) }, nil
+	}
+	return nil, fmt.Errorf("unknown sort key %s, should be one of %s", key, strings.Join(UsageSortKeys, ", "))
+}
+
+// SortPodUsages sorts pods by key, one of UsageSortKeys.
+func SortPodUsages(pods []*PodUsage, key string) error {
+	less, err := usageLess(key,
+		func(i int) string { return pods[i].Namespace + "/" + pods[i].Name },
+		func(i int) *ResourceUsage { return &pods[i].ResourceUsage })
+	if err == nil {
+		sort.SliceStable(pods, less)
+	}
+	return err
+}
+
+// SortNamespaceUsages sorts namespaces by key, one of UsageSortKeys.
+func SortNamespaceUsages(namespaces []*NamespaceUsage, key string) error {
+	less, err := usageLess(key,
+		func(i int) string { return namespaces[i].Name },
+		func(i int) *ResourceUsage { return &namespaces[i].ResourceUsage })
+	if err == nil {
+		sort.SliceStable(namespaces, less)
+	}
+	return err
+}
+
+func metricsError(err error) error {
+	if apierrors.IsNotFound(err) || apierrors.IsServiceUnavailable(err) {
+		return ErrMetricsUnavailable
+	}
+	return err
+}
+
+// GetClusterUsage returns the resource usage of the nodes and of the pods
+// of namespace (all if empty). ErrMetricsUnavailable is returned when the
+// metrics API is not served.
+func GetClusterUsage(ctx context.Context, client kubernetes.Interface, metricsClient metrics.Interface, namespace string) (*ClusterUsage, error) {
+	nodeMetrics, err := metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, metricsError(err)
+	}
+	podMetrics, err := metricsClient.MetricsV1beta1().PodMetricses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, metricsError(err)
+	}
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	allocatable := make(map[string]v1.ResourceList)
+	for _, node := range nodes.Items {
+		allocatable[node.Name] = node.Status.Allocatable
+	}
+
+	result := &ClusterUsage{}
+	for _, metric := range nodeMetrics.Items {
+		node := &NodeUsage{Name: metric.Name}
+		node.add(metric.Usage)
+		node.Allocatable.add(allocatable[metric.Name])
+		result.Nodes = append(result.Nodes, node)
+	}
+	for _, metric := range podMetrics.Items {
+		result.Pods = append(result.Pods, podUsage(&metric))
+	}
+	return result, nil
+}
+
+func podUsage(metric *metricsv1beta1.PodMetrics) *PodUsage {
+	pod := &PodUsage{Namespace: metric.Namespace, Name: metric.Name}
+	for _, container := range metric.Containers {
+		pod.add(container.Usage)
+	}
+	return pod
+}
+
+// MemInfo is the memory of the guest from /proc/meminfo, in bytes.
+type MemInfo struct {
+	Total     int64
+	Available int64
+}
+
+// ParseMemInfo reads the content of /proc/meminfo.
+func ParseMemInfo(r io.Reader) (*MemInfo, error) {
+	result := &MemInfo{}
+	fields := map[string]*int64{"MemTotal": &result.Total, "MemAvailable": &result.Available}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		target, ok := fields[name]
+		if !found || !ok {
+			continue
+		}
+		// Values are in kB
+		number, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "kB")), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad meminfo line %s: %w", scanner.Text(), err)
+		}
+		*target = number * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result.Total == 0 {
+		return nil, fmt.Errorf("no MemTotal in meminfo")
+	}
+	return result, nil
+}
+
+var memorySizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+	"T":  1 << 40,
+	"TB": 1 << 40,
+}
+
+// ParseMemorySize parses a size like the ones of .wslconfig, e.g. 8GB or
+// 4096MB. Units are binary multiples.
+func ParseMemorySize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	end := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end < 0 {
+		end = len(size)
+	}
+	unit, ok := memorySizeUnits[strings.TrimSpace(size[end:])]
+	if !ok {
+		return 0, fmt.Errorf("bad memory size %s", size)
+	}
+	number, err := strconv.ParseFloat(size[:end], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad memory size %s", size)
+	}
+	return int64(number * float64(unit)), nil
+}
+
+// ParseWSLConfigMemory returns the memory limit of the [wsl2] section of
+// the .wslconfig content read from r. Zero means no limit is set.
+func ParseWSLConfigMemory(r io.Reader) (int64, error) {
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || section != "wsl2" || strings.ToLower(strings.TrimSpace(key)) != "memory" {
+			continue
+		}
+		if comment := strings.IndexAny(value, "#;"); comment >= 0 {
+			value = value[:comment]
+		}
+		return ParseMemorySize(value)
+	}
+	return 0, scanner.Err()
+}
+
+// WSLConfigMemory returns the memory limit set in the .wslconfig file at
+// path. Zero means no limit is set or no file exists.
+func WSLConfigMemory(path string) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return ParseWSLConfigMemory(file)
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+)
+
+func resources(cpu string, memory string) v1.ResourceList {
+	return v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(cpu),
+		v1.ResourceMemory: resource.MustParse(memory),
+	}
+}
+
+func podMetrics(namespace string, name string, usages ...v1.ResourceList) metricsv1beta1.PodMetrics {
+	metric := metricsv1beta1.PodMetrics{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	for _, usage := range usages {
+		metric.Containers = append(metric.Containers, metricsv1beta1.ContainerMetrics{Usage: usage})
+	}
+	return metric
+}
+
+// metricsClient returns a fake metrics client. The fake object tracker
+// doesn't map the metrics kinds to their resources, so the lists are
+// returned by reactors.
+func metricsClient(nodes *metricsv1beta1.NodeMetricsList, pods *metricsv1beta1.PodMetricsList) *metricsfake.Clientset {
+	client := &metricsfake.Clientset{}
+	client.AddReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nodes, nil
+	})
+	client.AddReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, pods, nil
+	})
+	return client
+}
+
+func TestGetClusterUsage(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "kaweezle"},
+		Status:     v1.NodeStatus{Allocatable: resources("4", "8Gi")},
+	})
+	metrics := metricsClient(&metricsv1beta1.NodeMetricsList{Items: []metricsv1beta1.NodeMetrics{
+		{ObjectMeta: metav1.ObjectMeta{Name: "kaweezle"}, Usage: resources("1500m", "3Gi")},
+	}}, &metricsv1beta1.PodMetricsList{Items: []metricsv1beta1.PodMetrics{
+		podMetrics("argocd", "server", resources("100m", "200Mi")),
+		podMetrics("kube-system", "etcd", resources("300m", "100Mi")),
+		podMetrics("argocd", "repo", resources("50m", "300Mi"), resources("10m", "20Mi")),
+	}})
+
+	usage, err := GetClusterUsage(context.Background(), client, metrics, "")
+	require.NoError(t, err)
+	require.Len(t, usage.Nodes, 1)
+	assert.Equal(t, int64(1500), usage.Nodes[0].CPU)
+	assert.Equal(t, int64(3<<30), usage.Nodes[0].Memory)
+	assert.Equal(t, ResourceUsage{CPU: 4000, Memory: 8 << 30}, usage.Nodes[0].Allocatable)
+	total, allocatable := usage.Total()
+	assert.Equal(t, int64(1500), total.CPU)
+	assert.Equal(t, int64(4000), allocatable.CPU)
+
+	require.NoError(t, SortPodUsages(usage.Pods, "memory"))
+	assert.Equal(t, "repo", usage.Pods[0].Name)
+	assert.Equal(t, ResourceUsage{CPU: 60, Memory: 320 << 20}, usage.Pods[0].ResourceUsage)
+	require.NoError(t, SortPodUsages(usage.Pods, "cpu"))
+	assert.Equal(t, "etcd", usage.Pods[0].Name)
+
+	namespaces := usage.Namespaces()
+	require.NoError(t, SortNamespaceUsages(namespaces, "memory"))
+	require.Len(t, namespaces, 2)
+	assert.Equal(t, &NamespaceUsage{Name: "argocd", Pods: 2, ResourceUsage: ResourceUsage{CPU: 160, Memory: 520 << 20}}, namespaces[0])
+	require.NoError(t, SortNamespaceUsages(namespaces, "name"))
+	assert.Equal(t, "argocd", namespaces[0].Name)
+	require.NoError(t, SortNamespaceUsages(namespaces, "cpu"))
+	assert.Equal(t, "kube-system", namespaces[0].Name)
+
+	assert.Error(t, SortPodUsages(usage.Pods, "age"))
+}
+
+func TestGetClusterUsageWithoutMetrics(t *testing.T) {
+	metrics := &metricsfake.Clientset{}
+	metrics.AddReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "metrics.k8s.io", Resource: "nodes"}, "")
+	})
+	_, err := GetClusterUsage(context.Background(), fake.NewSimpleClientset(), metrics, "")
+	assert.ErrorIs(t, err, ErrMetricsUnavailable)
+}
+
+func TestParseMemInfo(t *testing.T) {
+	info, err := ParseMemInfo(strings.NewReader(`MemTotal:        8024448 kB
+MemFree:         5119884 kB
+MemAvailable:    6522796 kB
+Buffers:           77000 kB
+`))
+	require.NoError(t, err)
+	assert.Equal(t, int64(8024448*1024), info.Total)
+	assert.Equal(t, int64(6522796*1024), info.Available)
+
+	_, err = ParseMemInfo(strings.NewReader("MemFree: 12 kB\n"))
+	assert.Error(t, err)
+}
+
+func TestParseWSLConfigMemory(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected int64
+	}{
+		{"none", "", 0},
+		{"gigabytes", "[wsl2]\nmemory=8GB\nprocessors=4\n", 8 << 30},
+		{"megabytes", "# limits\n[WSL2]\n  Memory = 4096MB ; half\n", 4 << 30},
+		{"other section", "[experimental]\nmemory=8GB\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, err := ParseWSLConfigMemory(strings.NewReader(tt.content))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, memory)
+		})
+	}
+
+	_, err := ParseWSLConfigMemory(strings.NewReader("[wsl2]\nmemory=lots\n"))
+	assert.Error(t, err)
+	size, err := ParseMemorySize("1.5g")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3<<29), size)
+}
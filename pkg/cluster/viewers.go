@@ -0,0 +1,164 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/kubectl/pkg/polymorphichelpers"
+)
+
+var (
+	FluxKustomizationGroupKind = schema.GroupKind{Group: "kustomize.toolkit.fluxcd.io", Kind: "Kustomization"}
+	FluxHelmReleaseGroupKind   = schema.GroupKind{Group: "helm.toolkit.fluxcd.io", Kind: "HelmRelease"}
+	FluxGitRepositoryGroupKind = schema.GroupKind{Group: "source.toolkit.fluxcd.io", Kind: "GitRepository"}
+	CertificateGroupKind       = schema.GroupKind{Group: "cert-manager.io", Kind: "Certificate"}
+	ClusterIssuerGroupKind     = schema.GroupKind{Group: "cert-manager.io", Kind: "ClusterIssuer"}
+	JobGroupKind               = schema.GroupKind{Group: "batch", Kind: "Job"}
+	PVCGroupKind               = schema.GroupKind{Kind: "PersistentVolumeClaim"}
+)
+
+// StatusViewers are the status viewers for the kinds not handled by kubectl.
+var StatusViewers = map[schema.GroupKind]polymorphichelpers.StatusViewer{
+	ApplicationSchemaGroupVersionKind.GroupKind(): &ApplicationStatusViewer{},
+	FluxKustomizationGroupKind:                    &ConditionStatusViewer{},
+	FluxHelmReleaseGroupKind:                      &ConditionStatusViewer{},
+	FluxGitRepositoryGroupKind:                    &ConditionStatusViewer{},
+	CertificateGroupKind:                          &ConditionStatusViewer{},
+	ClusterIssuerGroupKind:                        &ConditionStatusViewer{},
+	JobGroupKind:                                  &JobStatusViewer{},
+	PVCGroupKind:                                  &PVCStatusViewer{},
+}
+
+// workloadKinds are the kinds tracked for readiness when present in the
+// cluster. Jobs and PersistentVolumeClaims are only tracked when asked for
+// with the filter kinds: failed Jobs kept in history and claims waiting for
+// their first consumer would otherwise never be ready.
+var workloadKinds = []schema.GroupKind{
+	{Group: "apps", Kind: "Deployment"},
+	{Group: "apps", Kind: "StatefulSet"},
+	{Group: "apps", Kind: "DaemonSet"},
+	ApplicationSchemaGroupVersionKind.GroupKind(),
+	FluxKustomizationGroupKind,
+	FluxHelmReleaseGroupKind,
+	FluxGitRepositoryGroupKind,
+	CertificateGroupKind,
+	ClusterIssuerGroupKind,
+}
+
+// StatusViewerFor returns the status viewer of kind. The health rules come
+// first, then the registered viewers and the kubectl ones. Other kinds use
+// their Ready condition.
+func StatusViewerFor(kind schema.GroupKind) (polymorphichelpers.StatusViewer, error) {
+	if viewer, ok := ruleViewers[kind]; ok {
+		return viewer, nil
+	}
+	if viewer, ok := StatusViewers[kind]; ok {
+		return viewer, nil
+	}
+	if viewer, err := polymorphichelpers.StatusViewerFor(kind); err == nil {
+		return viewer, nil
+	}
+	return &ConditionStatusViewer{}, nil
+}
+
+func findCondition(obj map[string]interface{}, conditionType string) (condition map[string]interface{}, found bool) {
+	conditions, _, _ := unstructured.NestedSlice(obj, "status", "conditions")
+	for _, c := range conditions {
+		if m, ok := c.(map[string]interface{}); ok && m["type"] == conditionType {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func objectDescription(obj map[string]interface{}) string {
+	u := &unstructured.Unstructured{Object: obj}
+	return fmt.Sprintf("%s %q", strings.ToLower(u.GetKind()), u.GetName())
+}
+
+// ConditionStatusViewer uses the standard Ready condition. The object is
+// ready when the condition is True and reflects the latest generation. An
+// object without Ready condition is considered ready.
+type ConditionStatusViewer struct{}
+
+func (s *ConditionStatusViewer) Status(obj runtime.Unstructured, revision int64) (string, bool, error) {
+	content := obj.UnstructuredContent()
+	description := objectDescription(content)
+
+	generation, _, _ := unstructured.NestedInt64(content, "metadata", "generation")
+	observed, hasObserved, _ := unstructured.NestedInt64(content, "status", "observedGeneration")
+	if hasObserved && observed < generation {
+		return fmt.Sprintf("%s waiting for reconciliation of generation %d", description, generation), false, nil
+	}
+
+	condition, found := findCondition(content, "Ready")
+	if !found {
+		return fmt.Sprintf("%s has no Ready condition", description), true, nil
+	}
+	status, _ := condition["status"].(string)
+	message, _ := condition["message"].(string)
+	if message == "" {
+		message, _ = condition["reason"].(string)
+	}
+	return fmt.Sprintf("%s ready: %s, %s", description, status, message), status == "True", nil
+}
+
+// JobStatusViewer considers a Job ready once it has completed. The Jobs
+// created by a CronJob are not waited on as the next run replaces them.
+type JobStatusViewer struct{}
+
+func (s *JobStatusViewer) Status(obj runtime.Unstructured, revision int64) (string, bool, error) {
+	content := obj.UnstructuredContent()
+	description := objectDescription(content)
+
+	for _, owner := range (&unstructured.Unstructured{Object: content}).GetOwnerReferences() {
+		if owner.Kind == "CronJob" {
+			return fmt.Sprintf("%s run by cronjob %q", description, owner.Name), true, nil
+		}
+	}
+	if condition, found := findCondition(content, "Complete"); found && condition["status"] == "True" {
+		return fmt.Sprintf("%s complete", description), true, nil
+	}
+	completions, found, _ := unstructured.NestedInt64(content, "spec", "completions")
+	if !found {
+		completions = 1
+	}
+	succeeded, _, _ := unstructured.NestedInt64(content, "status", "succeeded")
+	if succeeded >= completions {
+		return fmt.Sprintf("%s succeeded", description), true, nil
+	}
+	if condition, found := findCondition(content, "Failed"); found && condition["status"] == "True" {
+		message, _ := condition["message"].(string)
+		return fmt.Sprintf("%s failed: %s", description, message), false, nil
+	}
+	return fmt.Sprintf("%s: %d of %d completions", description, succeeded, completions), false, nil
+}
+
+// PVCStatusViewer considers a PersistentVolumeClaim ready once it is bound.
+type PVCStatusViewer struct{}
+
+func (s *PVCStatusViewer) Status(obj runtime.Unstructured, revision int64) (string, bool, error) {
+	content := obj.UnstructuredContent()
+	phase, _, _ := unstructured.NestedString(content, "status", "phase")
+	if phase == "" {
+		phase = "Pending"
+	}
+	return fmt.Sprintf("%s is %s", objectDescription(content), phase), phase == "Bound", nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func testObject(apiVersion string, kind string, name string, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"namespace":  "default",
+			"name":       name,
+			"generation": int64(2),
+		},
+		"status": status,
+	}}
+}
+
+func withOwner(obj *unstructured.Unstructured, kind string, name string) *unstructured.Unstructured {
+	obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "batch/v1", Kind: kind, Name: name}})
+	return obj
+}
+
+func condition(conditionType string, status string, message string) map[string]interface{} {
+	return map[string]interface{}{"type": conditionType, "status": status, "message": message}
+}
+
+func TestStatusViewers(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		obj   *unstructured.Unstructured
+		ready bool
+	}{
+		{"kustomization ready", testObject("kustomize.toolkit.fluxcd.io/v1beta2", "Kustomization", "apps", map[string]interface{}{
+			"observedGeneration": int64(2),
+			"conditions":         []interface{}{condition("Ready", "True", "Applied revision")},
+		}), true},
+		{"kustomization stale", testObject("kustomize.toolkit.fluxcd.io/v1beta2", "Kustomization", "apps", map[string]interface{}{
+			"observedGeneration": int64(1),
+			"conditions":         []interface{}{condition("Ready", "True", "Applied revision")},
+		}), false},
+		{"certificate not ready", testObject("cert-manager.io/v1", "Certificate", "tls", map[string]interface{}{
+			"conditions": []interface{}{condition("Ready", "False", "Issuing certificate")},
+		}), false},
+		{"job complete", testObject("batch/v1", "Job", "migrate", map[string]interface{}{
+			"conditions": []interface{}{condition("Complete", "True", "")},
+			"succeeded":  int64(1),
+		}), true},
+		{"job failed", testObject("batch/v1", "Job", "migrate", map[string]interface{}{
+			"conditions": []interface{}{condition("Failed", "True", "BackoffLimitExceeded")},
+		}), false},
+		{"job of a cronjob failed", withOwner(testObject("batch/v1", "Job", "backup-27", map[string]interface{}{
+			"conditions": []interface{}{condition("Failed", "True", "BackoffLimitExceeded")},
+		}), "CronJob", "backup"), true},
+		{"job succeeded before failing", testObject("batch/v1", "Job", "migrate", map[string]interface{}{
+			"conditions": []interface{}{condition("Failed", "True", "DeadlineExceeded")},
+			"succeeded":  int64(1),
+		}), true},
+		{"job running", testObject("batch/v1", "Job", "migrate", map[string]interface{}{
+			"active": int64(1),
+		}), false},
+		{"pvc bound", testObject("v1", "PersistentVolumeClaim", "data", map[string]interface{}{
+			"phase": "Bound",
+		}), true},
+		{"pvc pending", testObject("v1", "PersistentVolumeClaim", "data", map[string]interface{}{
+			"phase": "Pending",
+		}), false},
+		{"unknown crd ready", testObject("example.com/v1", "Widget", "w", map[string]interface{}{
+			"conditions": []interface{}{condition("Ready", "True", "")},
+		}), true},
+		{"unknown crd not ready", testObject("example.com/v1", "Widget", "w", map[string]interface{}{
+			"conditions": []interface{}{condition("Ready", "False", "Waiting")},
+		}), false},
+		{"unknown crd without conditions", testObject("example.com/v1", "Widget", "w", map[string]interface{}{}), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			viewer, err := StatusViewerFor(tc.obj.GroupVersionKind().GroupKind())
+			require.NoError(t, err)
+			msg, ready, err := viewer.Status(tc.obj, 0)
+			require.NoError(t, err)
+			assert.Equal(t, tc.ready, ready, msg)
+			assert.NotEmpty(t, msg)
+		})
+	}
+}
+
+func TestResourcesFor(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{
+		{Group: "apps", Version: "v1"},
+		{Group: "batch", Version: "v1"},
+		{Version: "v1"},
+		{Group: "kustomize.toolkit.fluxcd.io", Version: "v1beta2"},
+		{Group: "cert-manager.io", Version: "v1"},
+	})
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "kustomize.toolkit.fluxcd.io", Version: "v1beta2", Kind: "Kustomization"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "ClusterIssuer"}, meta.RESTScopeRoot)
+
+	resources, err := resourcesFor(mapper, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{
+		deploymentsResource,
+		{Group: "kustomize.toolkit.fluxcd.io", Version: "v1beta2", Resource: "kustomizations"},
+		{Group: "cert-manager.io", Version: "v1", Resource: "clusterissuers"},
+	}, resources, "Only the kinds present should be tracked, Jobs and PVCs on demand")
+
+	resources, err = resourcesFor(mapper, &WorkloadFilter{Namespace: "default"})
+	require.NoError(t, err)
+	assert.Len(t, resources, 2, "Cluster scoped kinds should be skipped in a namespace")
+
+	resources, err = resourcesFor(mapper, &WorkloadFilter{Kinds: []string{"deployments"}})
+	require.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{deploymentsResource}, resources)
+
+	resources, err = resourcesFor(mapper, &WorkloadFilter{Kinds: []string{"jobs", "persistentvolumeclaims"}})
+	require.NoError(t, err)
+	assert.Equal(t, []schema.GroupVersionResource{
+		{Group: "batch", Version: "v1", Resource: "jobs"},
+		{Version: "v1", Resource: "persistentvolumeclaims"},
+	}, resources)
+
+	_, err = resourcesFor(mapper, &WorkloadFilter{Kinds: []string{"widgets"}})
+	assert.Error(t, err)
+}
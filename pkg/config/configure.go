@@ -30,12 +30,12 @@ func ConfigureAgeKeyFile(distributionName string, ageKeyFile string) error {
 		if exists, _ := afs.Exists(ageKeyFile); !exists {
 			log.WithField("age_key_file", ageKeyFile).Warn("Age key file does not exist")
 		} else {
-			err := wsl.CopyFileToDistribution(distributionName, ageKeyFile, "/root/.config/sops/age/keys.txt")
+			err := wsl.CopyFileToDistribution(distributionName, ageKeyFile, ageKeyDestination)
 			if err != nil {
 				return errors.Wrap(err, "failed to copy age key file")
 			}
-			line := "export SOPS_AGE_KEY_FILE=\"/root/.config/sops/age/keys.txt\"\n"
-			filename := wsl.WslFile(distributionName, "/etc/conf.d/iknite")
+			line := fmt.Sprintf("export SOPS_AGE_KEY_FILE=\"%s\"\n", ageKeyDestination)
+			filename := wsl.WslFile(distributionName, ikniteConfFile)
 			s.File(filename).RejectRegexp(regexp.MustCompile(`^export SOPS_AGE_KEY_FILE=.*$`)).WriteFile(filename)
 			_, err = s.Echo(line).AppendFile(filename)
 			return err
@@ -49,7 +49,7 @@ func ConfigureSshKeyFile(distributionName string, sshKeyFile string) error {
 		if exists, _ := afs.Exists(sshKeyFile); !exists {
 			log.WithField("ssh_key_file", sshKeyFile).Warn("SSH key file does not exist")
 		} else {
-			err := wsl.CopyFileToDistribution(distributionName, sshKeyFile, "/root/.ssh/id_rsa", "chmod 600 /root/.ssh/id_rsa", "chmod 700 /root/.ssh")
+			err := wsl.CopyFileToDistribution(distributionName, sshKeyFile, sshKeyDestination, "chmod 600 "+sshKeyDestination, "chmod 700 /root/.ssh")
 			if err != nil {
 				return errors.Wrap(err, "failed to copy ssh key file")
 			}
@@ -62,7 +62,7 @@ func ConfigureKustomizeUrl(distributionName string, kustomizeUrl string) error {
 	if kustomizeUrl != "" {
 		log.WithField("kustomize_url", kustomizeUrl).Info("Setting kustomize url...")
 		line := fmt.Sprintf("export IKNITE_KUSTOMIZE_DIRECTORY=\"%s\"\n", kustomizeUrl)
-		filename := wsl.WslFile(distributionName, "/etc/conf.d/iknite")
+		filename := wsl.WslFile(distributionName, ikniteConfFile)
 		s.File(filename).RejectRegexp(regexp.MustCompile(`^export IKNITE_KUSTOMIZE_DIRECTORY=.*$`)).WriteFile(filename)
 		_, err := s.Echo(line).AppendFile(filename)
 		return err
@@ -106,6 +106,16 @@ func Configure(distributionName string, options *ConfigurationOptions) error {
 	return err
 }
 
+// MappedDomains returns the domain names mapped to ipAddress in the hosts
+// file. Reading the hosts file doesn't need elevation.
+func MappedDomains(ipAddress string) ([]string, error) {
+	hosts, err := txeh.NewHostsDefault()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get hosts file")
+	}
+	return hosts.ListHostsByIP(ipAddress), nil
+}
+
 func ConfigureDomains(distributionName, ipAddress string, domains []string, remove bool) ([]string, error) {
 	if len(domains) > 0 && !remove {
 		// Check if the configuration is already done
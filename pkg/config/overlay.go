@@ -0,0 +1,95 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/kaweezle/kaweezle/pkg/knownhosts"
+	"github.com/kaweezle/kaweezle/pkg/rootfs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ageKeyDestination = "/root/.config/sops/age/keys.txt"
+	sshKeyDestination = "/root/.ssh/id_rsa"
+	knownHostsFile    = "/root/.ssh/known_hosts"
+	ikniteConfFile    = "/etc/conf.d/iknite"
+)
+
+// OverlayFiles returns the overlay files that perform the same configuration
+// as Configure directly in the root file system. The ssh known hosts are
+// scanned from Windows. If the scan fails, Configure scans them from the
+// distribution after the import.
+func OverlayFiles(options *ConfigurationOptions) (files []*rootfs.OverlayFile) {
+	root := 0
+	confLines := ""
+
+	if options.AgeKeyFile != "" {
+		if exists, _ := afs.Exists(options.AgeKeyFile); exists {
+			files = append(files, &rootfs.OverlayFile{
+				Path:   ageKeyDestination,
+				Source: options.AgeKeyFile,
+				Mode:   "0600",
+				Uid:    &root,
+				Gid:    &root,
+			})
+			confLines += fmt.Sprintf("export SOPS_AGE_KEY_FILE=\"%s\"\n", ageKeyDestination)
+		} else {
+			log.WithField("age_key_file", options.AgeKeyFile).Warn("Age key file does not exist")
+		}
+	}
+
+	if options.SshKeyFile != "" {
+		if exists, _ := afs.Exists(options.SshKeyFile); exists {
+			files = append(files, &rootfs.OverlayFile{
+				Path:   sshKeyDestination,
+				Source: options.SshKeyFile,
+				Mode:   "0600",
+				Uid:    &root,
+				Gid:    &root,
+			})
+		} else {
+			log.WithField("ssh_key_file", options.SshKeyFile).Warn("SSH key file does not exist")
+		}
+	}
+
+	if len(options.SshHosts) > 0 {
+		if content, err := knownhosts.Scan(options.SshHosts, knownhosts.DefaultTimeout); err == nil {
+			files = append(files, &rootfs.OverlayFile{
+				Path:    knownHostsFile,
+				Content: content,
+				Mode:    "0600",
+				Uid:     &root,
+				Gid:     &root,
+			})
+		} else {
+			log.WithError(err).WithField("ssh_hosts", options.SshHosts).Warn("Couldn't scan the ssh hosts keys")
+		}
+	}
+
+	if options.KustomizeUrl != "" {
+		confLines += fmt.Sprintf("export IKNITE_KUSTOMIZE_DIRECTORY=\"%s\"\n", options.KustomizeUrl)
+	}
+
+	if confLines != "" {
+		files = append(files, &rootfs.OverlayFile{
+			Path:    ikniteConfFile,
+			Content: confLines,
+			Append:  true,
+		})
+	}
+	return
+}
@@ -7,6 +7,11 @@ type ConfigurationOptions struct {
 	KustomizeUrl        string
 	DomainNames         []string
 	SshHosts            []string
+	// DomainsFromIngresses maps the hosts of the cluster Ingresses and
+	// HTTPRoutes once the cluster is ready.
+	DomainsFromIngresses bool
+	// DomainSuffixes restricts the hosts mapped from the cluster.
+	DomainSuffixes []string
 }
 
 func NewConfigurationOptions() *ConfigurationOptions {
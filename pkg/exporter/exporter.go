@@ -0,0 +1,207 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exporter exposes the state of a kaweezle cluster as Prometheus
+// metrics.
+package exporter
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "kaweezle"
+
+// Distribution is a WSL distribution as listed by wsl --list --verbose.
+type Distribution struct {
+	Name      string
+	State     string
+	Version   int
+	IsDefault bool
+}
+
+// Sources give the values exported on each scrape. The cluster is only
+// queried for its workloads when it is started.
+type Sources struct {
+	Status        func() (cluster.ClusterStatus, error)
+	Phase         func() (cluster.ClusterPhase, error)
+	Workloads     func() ([]*cluster.WorkloadState, error)
+	Distributions func() ([]Distribution, error)
+	// RootFSVersion returns the version installed in the distribution, empty
+	// if unknown.
+	RootFSVersion func() (string, error)
+	// LastStart returns nil when no start has been recorded.
+	LastStart func() (*cluster.StartRecord, error)
+}
+
+var (
+	statuses = []cluster.ClusterStatus{cluster.Uninstalled, cluster.Installed, cluster.Started}
+	phases   = []cluster.ClusterPhase{cluster.Stopped, cluster.Booting, cluster.Starting, cluster.Ready, cluster.Degraded, cluster.Stopping, cluster.Error}
+)
+
+// Collector collects the metrics of a distribution from its Sources.
+type Collector struct {
+	distributionName string
+	sources          *Sources
+
+	up            *prometheus.Desc
+	status        *prometheus.Desc
+	phase         *prometheus.Desc
+	workloads     *prometheus.Desc
+	timeToReady   *prometheus.Desc
+	lastStart     *prometheus.Desc
+	rootfs        *prometheus.Desc
+	distributions *prometheus.Desc
+}
+
+func NewCollector(distributionName string, sources *Sources) *Collector {
+	labels := prometheus.Labels{"distribution": distributionName}
+	return &Collector{
+		distributionName: distributionName,
+		sources:          sources,
+		up: prometheus.NewDesc(prometheus.BuildFQName(namespace, "scrape", "success"),
+			"Whether the source was read successfully.", []string{"source"}, labels),
+		status: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "status"),
+			"Installation status of the cluster, 1 for the current one.", []string{"status"}, labels),
+		phase: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "phase"),
+			"Phase of the cluster, 1 for the current one.", []string{"phase"}, labels),
+		workloads: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workloads"),
+			"Number of workloads by namespace and readiness. Ignored workloads are not counted.", []string{"namespace", "ready"}, labels),
+		timeToReady: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "time_to_ready_seconds"),
+			"Time the last start took for all the workloads to be ready.", nil, labels),
+		lastStart: prometheus.NewDesc(prometheus.BuildFQName(namespace, "cluster", "last_start_timestamp_seconds"),
+			"Time of the last start of the cluster.", nil, labels),
+		rootfs: prometheus.NewDesc(prometheus.BuildFQName(namespace, "rootfs", "info"),
+			"Version of the root file system installed in the distribution.", []string{"version"}, labels),
+		distributions: prometheus.NewDesc(prometheus.BuildFQName(namespace, "wsl", "distribution_info"),
+			"WSL distributions and their state.", []string{"name", "state", "version", "default"}, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.up, c.status, c.phase, c.workloads, c.timeToReady, c.lastStart, c.rootfs, c.distributions} {
+		ch <- desc
+	}
+}
+
+// success reports the result of reading source and logs its error.
+func (c *Collector) success(ch chan<- prometheus.Metric, source string, err error) bool {
+	value := 1.0
+	if err != nil {
+		value = 0
+		log.WithError(err).WithFields(log.Fields{"source": source, "distribution_name": c.distributionName}).Warn("Couldn't collect metrics")
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, value, source)
+	return err == nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	status, err := c.sources.Status()
+	if c.success(ch, "status", err) {
+		for _, s := range statuses {
+			ch <- prometheus.MustNewConstMetric(c.status, prometheus.GaugeValue, boolValue(s == status), s.String())
+		}
+	}
+
+	phase, err := c.sources.Phase()
+	if c.success(ch, "phase", err) {
+		for _, p := range phases {
+			ch <- prometheus.MustNewConstMetric(c.phase, prometheus.GaugeValue, boolValue(p == phase), p.String())
+		}
+	}
+
+	if status == cluster.Started {
+		c.collectWorkloads(ch)
+	}
+
+	record, err := c.sources.LastStart()
+	if c.success(ch, "last_start", err) && record != nil {
+		ch <- prometheus.MustNewConstMetric(c.lastStart, prometheus.GaugeValue, float64(record.Started.Unix()))
+		if !record.ReadyAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.timeToReady, prometheus.GaugeValue, record.TimeToReady().Seconds())
+		}
+	}
+
+	version, err := c.sources.RootFSVersion()
+	if c.success(ch, "rootfs", err) && version != "" {
+		ch <- prometheus.MustNewConstMetric(c.rootfs, prometheus.GaugeValue, 1, version)
+	}
+
+	distributions, err := c.sources.Distributions()
+	if c.success(ch, "distributions", err) {
+		for _, d := range distributions {
+			ch <- prometheus.MustNewConstMetric(c.distributions, prometheus.GaugeValue, 1,
+				d.Name, d.State, strconv.Itoa(d.Version), strconv.FormatBool(d.IsDefault))
+		}
+	}
+}
+
+func (c *Collector) collectWorkloads(ch chan<- prometheus.Metric) {
+	states, err := c.sources.Workloads()
+	if !c.success(ch, "workloads", err) {
+		return
+	}
+	counts := make(map[string][2]int)
+	for _, state := range states {
+		if state.Ignored {
+			continue
+		}
+		count := counts[state.Namespace]
+		if state.Ok {
+			count[1]++
+		} else {
+			count[0]++
+		}
+		counts[state.Namespace] = count
+	}
+	namespaces := make([]string, 0, len(counts))
+	for ns := range counts {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		count := counts[ns]
+		ch <- prometheus.MustNewConstMetric(c.workloads, prometheus.GaugeValue, float64(count[1]), ns, "true")
+		ch <- prometheus.MustNewConstMetric(c.workloads, prometheus.GaugeValue, float64(count[0]), ns, "false")
+	}
+}
+
+// NewHandler returns a handler serving the metrics of collector on /metrics
+// and the health of the exporter on /healthz.
+func NewHandler(collector prometheus.Collector) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux, nil
+}
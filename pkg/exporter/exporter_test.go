@@ -0,0 +1,167 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/cluster"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func testSources(status cluster.ClusterStatus) *Sources {
+	started := time.Unix(1700000000, 0)
+	return &Sources{
+		Status: func() (cluster.ClusterStatus, error) { return status, nil },
+		Phase:  func() (cluster.ClusterPhase, error) { return cluster.Degraded, nil },
+		Workloads: func() ([]*cluster.WorkloadState, error) {
+			return []*cluster.WorkloadState{
+				{Namespace: "argocd", Name: "apps/v1/Deployment:argocd-server", Ok: true},
+				{Namespace: "argocd", Name: "apps/v1/StatefulSet:argocd-application-controller", Ok: false},
+				{Namespace: "kube-system", Name: "apps/v1/Deployment:coredns", Ok: true},
+				{Namespace: "kube-system", Name: "batch/v1/Job:helm-install", Ok: false, Ignored: true},
+			}, nil
+		},
+		Distributions: func() ([]Distribution, error) {
+			return nil, fmt.Errorf("wsl not found")
+		},
+		RootFSVersion: func() (string, error) { return "v0.3.4", nil },
+		LastStart: func() (*cluster.StartRecord, error) {
+			return &cluster.StartRecord{Started: started, ReadyAt: started.Add(95 * time.Second)}, nil
+		},
+	}
+}
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector("kaweezle", testSources(cluster.Started))
+	expected := `
+# HELP kaweezle_cluster_phase Phase of the cluster, 1 for the current one.
+# TYPE kaweezle_cluster_phase gauge
+kaweezle_cluster_phase{distribution="kaweezle",phase="booting"} 0
+kaweezle_cluster_phase{distribution="kaweezle",phase="degraded"} 1
+kaweezle_cluster_phase{distribution="kaweezle",phase="error"} 0
+kaweezle_cluster_phase{distribution="kaweezle",phase="ready"} 0
+kaweezle_cluster_phase{distribution="kaweezle",phase="starting"} 0
+kaweezle_cluster_phase{distribution="kaweezle",phase="stopped"} 0
+kaweezle_cluster_phase{distribution="kaweezle",phase="stopping"} 0
+# HELP kaweezle_cluster_time_to_ready_seconds Time the last start took for all the workloads to be ready.
+# TYPE kaweezle_cluster_time_to_ready_seconds gauge
+kaweezle_cluster_time_to_ready_seconds{distribution="kaweezle"} 95
+# HELP kaweezle_scrape_success Whether the source was read successfully.
+# TYPE kaweezle_scrape_success gauge
+kaweezle_scrape_success{distribution="kaweezle",source="distributions"} 0
+kaweezle_scrape_success{distribution="kaweezle",source="last_start"} 1
+kaweezle_scrape_success{distribution="kaweezle",source="phase"} 1
+kaweezle_scrape_success{distribution="kaweezle",source="rootfs"} 1
+kaweezle_scrape_success{distribution="kaweezle",source="status"} 1
+kaweezle_scrape_success{distribution="kaweezle",source="workloads"} 1
+# HELP kaweezle_workloads Number of workloads by namespace and readiness. Ignored workloads are not counted.
+# TYPE kaweezle_workloads gauge
+kaweezle_workloads{distribution="kaweezle",namespace="argocd",ready="false"} 1
+kaweezle_workloads{distribution="kaweezle",namespace="argocd",ready="true"} 1
+kaweezle_workloads{distribution="kaweezle",namespace="kube-system",ready="false"} 0
+kaweezle_workloads{distribution="kaweezle",namespace="kube-system",ready="true"} 1
+`
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"kaweezle_cluster_phase", "kaweezle_cluster_time_to_ready_seconds", "kaweezle_scrape_success", "kaweezle_workloads"))
+
+	// The workloads are not queried when the cluster is not started
+	sources := testSources(cluster.Installed)
+	sources.Workloads = func() ([]*cluster.WorkloadState, error) {
+		t.Fatal("workloads queried on a stopped cluster")
+		return nil, nil
+	}
+	assert.Equal(t, 0, testutil.CollectAndCount(NewCollector("kaweezle", sources), "kaweezle_workloads"))
+}
+
+func testDeployment(namespace string, name string, ready int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name, "generation": int64(1)},
+		"spec":       map[string]interface{}{"replicas": int64(1)},
+		"status": map[string]interface{}{
+			"observedGeneration": int64(1),
+			"replicas":           int64(1),
+			"updatedReplicas":    int64(1),
+			"readyReplicas":      ready,
+			"availableReplicas":  ready,
+		},
+	}}
+}
+
+// TestCollectorWorkloads computes the workload states from a fake cluster.
+func TestCollectorWorkloads(t *testing.T) {
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		deployments: "DeploymentList",
+	},
+		testDeployment("argocd", "argocd-server", 1),
+		testDeployment("argocd", "argocd-repo-server", 0),
+		testDeployment("kube-system", "coredns", 1),
+		testDeployment("demo", "hello", 0),
+	)
+	filter := &cluster.WorkloadFilter{Ignore: []string{"demo"}}
+	require.NoError(t, filter.Validate())
+
+	sources := testSources(cluster.Started)
+	sources.Workloads = func() ([]*cluster.WorkloadState, error) {
+		return cluster.WorkloadStatesFor(context.Background(), client, []schema.GroupVersionResource{deployments}, filter)
+	}
+	expected := `
+# HELP kaweezle_workloads Number of workloads by namespace and readiness. Ignored workloads are not counted.
+# TYPE kaweezle_workloads gauge
+kaweezle_workloads{distribution="kaweezle",namespace="argocd",ready="false"} 1
+kaweezle_workloads{distribution="kaweezle",namespace="argocd",ready="true"} 1
+kaweezle_workloads{distribution="kaweezle",namespace="kube-system",ready="false"} 0
+kaweezle_workloads{distribution="kaweezle",namespace="kube-system",ready="true"} 1
+`
+	require.NoError(t, testutil.CollectAndCompare(NewCollector("kaweezle", sources), strings.NewReader(expected), "kaweezle_workloads"))
+}
+
+func TestHandler(t *testing.T) {
+	handler, err := NewHandler(NewCollector("kaweezle", testSources(cluster.Started)))
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(path string) string {
+		response, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "ok\n", get("/healthz"))
+	metrics := get("/metrics")
+	assert.Contains(t, metrics, `kaweezle_cluster_status{distribution="kaweezle",status="started"} 1`)
+	assert.Contains(t, metrics, `kaweezle_rootfs_info{distribution="kaweezle",version="v0.3.4"} 1`)
+	assert.Contains(t, metrics, `kaweezle_cluster_last_start_timestamp_seconds{distribution="kaweezle"} 1.7e+09`)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package forward keeps port forwards to cluster services running across
+// pod restarts.
+package forward
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubectl/pkg/util"
+	"k8s.io/kubectl/pkg/util/podutils"
+)
+
+// Forward forwards a local port to a port of a service.
+type Forward struct {
+	Namespace string `mapstructure:"namespace" yaml:"namespace" json:"namespace"`
+	Service   string `mapstructure:"service" yaml:"service" json:"service"`
+	// LocalPort is the port listened to on localhost.
+	LocalPort int `mapstructure:"local_port" yaml:"local_port" json:"local_port"`
+	// RemotePort is the port of the service.
+	RemotePort int `mapstructure:"remote_port" yaml:"remote_port" json:"remote_port"`
+}
+
+func (f *Forward) Target() string {
+	return fmt.Sprintf("%s/%s", f.Namespace, f.Service)
+}
+
+func (f *Forward) String() string {
+	return fmt.Sprintf("%s %d:%d", f.Target(), f.LocalPort, f.RemotePort)
+}
+
+func parsePort(port string) (int, error) {
+	result, err := strconv.Atoi(port)
+	if err != nil || result <= 0 || result > 65535 {
+		return 0, fmt.Errorf("bad port %s", port)
+	}
+	return result, nil
+}
+
+// Parse returns the forward of target, given as <namespace>/<service>, with
+// ports given as <local>:<remote>. A single port is used for both.
+func Parse(target string, ports string) (forward *Forward, err error) {
+	forward = &Forward{}
+	var found bool
+	if forward.Namespace, forward.Service, found = strings.Cut(target, "/"); !found || forward.Namespace == "" || forward.Service == "" {
+		return nil, fmt.Errorf("bad service %s, should be <namespace>/<service>", target)
+	}
+	local, remote, found := strings.Cut(ports, ":")
+	if !found {
+		remote = local
+	}
+	if forward.LocalPort, err = parsePort(local); err != nil {
+		return nil, err
+	}
+	if forward.RemotePort, err = parsePort(remote); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Validate checks that the forwards are complete and don't share local
+// ports.
+func Validate(forwards []*Forward) error {
+	used := make(map[int]*Forward)
+	for _, forward := range forwards {
+		if forward.Namespace == "" || forward.Service == "" || forward.LocalPort <= 0 || forward.RemotePort <= 0 {
+			return fmt.Errorf("incomplete forward %s", forward)
+		}
+		if other, ok := used[forward.LocalPort]; ok {
+			return fmt.Errorf("local port %d used by both %s and %s", forward.LocalPort, other, forward)
+		}
+		used[forward.LocalPort] = forward
+	}
+	return nil
+}
+
+// ResolveTarget returns the pod to forward to for forward and the port of
+// the pod corresponding to the service port. Ready pods are preferred.
+func ResolveTarget(ctx context.Context, client kubernetes.Interface, forward *Forward) (*v1.Pod, int, error) {
+	service, err := client.CoreV1().Services(forward.Namespace).Get(ctx, forward.Service, metav1.GetOptions{})
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "while getting service %s", forward.Target())
+	}
+	if len(service.Spec.Selector) == 0 {
+		return nil, 0, fmt.Errorf("service %s has no selector", forward.Target())
+	}
+	pods, err := client.CoreV1().Pods(forward.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(service.Spec.Selector).String(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	candidates := make([]*v1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if isServing(pod) {
+			candidates = append(candidates, pod)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, 0, fmt.Errorf("no running pod for service %s", forward.Target())
+	}
+	sort.Sort(podutils.ByLogging(candidates))
+	pod := candidates[0]
+	port, err := util.LookupContainerPortNumberByServicePort(*service, *pod, int32(forward.RemotePort))
+	if err != nil {
+		return nil, 0, err
+	}
+	return pod, int(port), nil
+}
+
+// isServing tells if pod can still receive the forwarded connections.
+func isServing(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forward
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParse(t *testing.T) {
+	forward, err := Parse("argocd/argocd-server", "8080:443")
+	require.NoError(t, err)
+	assert.Equal(t, &Forward{Namespace: "argocd", Service: "argocd-server", LocalPort: 8080, RemotePort: 443}, forward)
+	assert.Equal(t, "argocd/argocd-server 8080:443", forward.String())
+
+	forward, err = Parse("demo/web", "8080")
+	require.NoError(t, err)
+	assert.Equal(t, 8080, forward.RemotePort)
+
+	for _, args := range [][2]string{{"web", "80"}, {"demo/", "80"}, {"demo/web", "http"}, {"demo/web", "80:0"}, {"demo/web", "70000"}} {
+		_, err = Parse(args[0], args[1])
+		assert.Error(t, err, "%v", args)
+	}
+
+	assert.NoError(t, Validate([]*Forward{{"a", "b", 80, 80}, {"a", "c", 81, 80}}))
+	assert.EqualError(t, Validate([]*Forward{{"a", "b", 80, 80}, {"a", "c", 80, 81}}), "local port 80 used by both a/b 80:80 and a/c 80:81")
+	assert.Error(t, Validate([]*Forward{{Namespace: "a", LocalPort: 80, RemotePort: 80}}))
+}
+
+func testService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: "web"},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []v1.ServicePort{{Port: 80, TargetPort: intstr.FromString("http")}},
+		},
+	}
+}
+
+func testPod(name string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "demo", Name: name, UID: types.UID(name), Labels: map[string]string{"app": "web"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name:  "web",
+			Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		}}},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	ctx := context.Background()
+	forward := &Forward{Namespace: "demo", Service: "web", LocalPort: 8080, RemotePort: 80}
+
+	client := fake.NewSimpleClientset(testService())
+	_, _, err := ResolveTarget(ctx, client, forward)
+	assert.EqualError(t, err, "no running pod for service demo/web")
+
+	client = fake.NewSimpleClientset(testService(), testPod("unready", false), testPod("ready", true))
+	pod, port, err := ResolveTarget(ctx, client, forward)
+	require.NoError(t, err)
+	assert.Equal(t, "ready", pod.Name, "ready pods are preferred")
+	assert.Equal(t, 8080, port, "the named target port is resolved")
+
+	_, _, err = ResolveTarget(ctx, client, &Forward{Namespace: "demo", Service: "web", LocalPort: 8080, RemotePort: 443})
+	assert.Error(t, err)
+	_, _, err = ResolveTarget(ctx, client, &Forward{Namespace: "demo", Service: "api", LocalPort: 8080, RemotePort: 80})
+	assert.Error(t, err)
+}
+
+// fakeForwards records the pods forwarded to.
+type fakeForwards struct {
+	mutex sync.Mutex
+	pods  []string
+}
+
+func (f *fakeForwards) forward(ctx context.Context, pod *v1.Pod, localPort int, port int, ready chan struct{}) error {
+	f.mutex.Lock()
+	f.pods = append(f.pods, pod.Name)
+	f.mutex.Unlock()
+	close(ready)
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeForwards) Pods() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.pods...)
+}
+
+func TestSupervisor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleClientset(testService(), testPod("first", true))
+	forwards := &fakeForwards{}
+	stateFile := filepath.Join(t.TempDir(), "forwards.json")
+	supervisor := NewSupervisor(client, forwards.forward, stateFile)
+	supervisor.Heartbeat = 10 * time.Millisecond
+	supervisor.RetryInterval = 10 * time.Millisecond
+	supervisor.PodCheckInterval = 10 * time.Millisecond
+
+	done := make(chan error)
+	forward := &Forward{Namespace: "demo", Service: "web", LocalPort: 8080, RemotePort: 80}
+	go func() {
+		done <- supervisor.Run(ctx, []*Forward{forward})
+	}()
+
+	forwarding := func(pod string) func() bool {
+		return func() bool {
+			state, err := ReadState(stateFile)
+			if err != nil || state == nil {
+				return false
+			}
+			status := state.Find(forward)
+			return status != nil && status.Phase == Forwarding && status.Pod == pod
+		}
+	}
+	require.Eventually(t, forwarding("first"), time.Second, 10*time.Millisecond)
+
+	// The pod is replaced, like on a rollout
+	require.NoError(t, client.CoreV1().Pods("demo").Delete(ctx, "first", metav1.DeleteOptions{}))
+	_, err := client.CoreV1().Pods("demo").Create(ctx, testPod("second", true), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, forwarding("second"), time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second"}, forwards.Pods())
+
+	state := supervisor.State()
+	assert.True(t, state.Alive(time.Now()))
+	assert.False(t, state.Alive(time.Now().Add(time.Minute)))
+	assert.Equal(t, 1, state.Forwards[0].Reconnects)
+
+	cancel()
+	require.NoError(t, <-done)
+	state, err = ReadState(stateFile)
+	require.NoError(t, err)
+	assert.Nil(t, state, "the state file is removed on exit")
+}
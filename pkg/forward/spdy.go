@@ -0,0 +1,68 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// SPDYForwardFunc returns a ForwardFunc forwarding through the API server
+// with the SPDY protocol, like kubectl port-forward.
+func SPDYForwardFunc(config *rest.Config, client kubernetes.Interface) ForwardFunc {
+	return func(ctx context.Context, pod *v1.Pod, localPort int, port int, ready chan struct{}) error {
+		transport, upgrader, err := spdy.RoundTripperFor(config)
+		if err != nil {
+			return err
+		}
+		url := client.CoreV1().RESTClient().Post().
+			Resource("pods").
+			Namespace(pod.Namespace).
+			Name(pod.Name).
+			SubResource("portforward").
+			URL()
+		dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				close(stop)
+			case <-done:
+			}
+		}()
+
+		// The connection errors are logged for debugging
+		errOut := log.WithField("pod", pod.Name).WriterLevel(log.DebugLevel)
+		defer errOut.Close()
+		forwarder, err := portforward.NewOnAddresses(dialer, []string{"localhost"},
+			[]string{fmt.Sprintf("%d:%d", localPort, port)}, stop, ready, io.Discard, errOut)
+		if err != nil {
+			return err
+		}
+		return forwarder.ForwardPorts()
+	}
+}
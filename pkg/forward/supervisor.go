@@ -0,0 +1,299 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultHeartbeat is the interval between two writes of the state file.
+	DefaultHeartbeat = 5 * time.Second
+	// DefaultRetryInterval is the first delay before reconnecting. It
+	// doubles on each failure up to maxRetryInterval.
+	DefaultRetryInterval = time.Second
+	maxRetryInterval     = 30 * time.Second
+	// DefaultPodCheckInterval is the interval between two checks of the pod
+	// a port is forwarded to.
+	DefaultPodCheckInterval = 2 * time.Second
+)
+
+// Phase is the phase of a forward.
+type Phase string
+
+const (
+	Connecting Phase = "Connecting"
+	Forwarding Phase = "Forwarding"
+	Retrying   Phase = "Retrying"
+)
+
+// Status is the status of a forward run by a supervisor.
+type Status struct {
+	Forward
+	Phase Phase     `json:"phase"`
+	Since time.Time `json:"since"`
+	// Pod is the pod the port is forwarded to.
+	Pod        string `json:"pod,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Reconnects int    `json:"reconnects"`
+}
+
+// State is the state of a supervisor, saved in its state file.
+type State struct {
+	PID      int       `json:"pid"`
+	Updated  time.Time `json:"updated"`
+	Forwards []*Status `json:"forwards"`
+}
+
+// Alive tells if the supervisor saving state is still running, i.e. it has
+// saved its state recently.
+func (s *State) Alive(now time.Time) bool {
+	return now.Sub(s.Updated) < 3*DefaultHeartbeat
+}
+
+// Find returns the status of forward, or nil if forward is not supervised.
+func (s *State) Find(forward *Forward) *Status {
+	for _, status := range s.Forwards {
+		if status.Forward == *forward {
+			return status
+		}
+	}
+	return nil
+}
+
+// ReadState reads the supervisor state file at path. It returns nil if no
+// supervisor has saved its state.
+func ReadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("bad forwards state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// ForwardFunc forwards localPort to port of pod until ctx is done or the
+// connection is lost. ready is closed once the local port is listened to.
+type ForwardFunc func(ctx context.Context, pod *v1.Pod, localPort int, port int, ready chan struct{}) error
+
+// Supervisor keeps forwards running. When the pod a forward goes to is
+// deleted or stops running, the forward is reconnected to another pod of
+// the service.
+type Supervisor struct {
+	Client  kubernetes.Interface
+	Forward ForwardFunc
+	// StateFile is where the state is saved. Empty means no state file.
+	StateFile        string
+	Heartbeat        time.Duration
+	RetryInterval    time.Duration
+	PodCheckInterval time.Duration
+
+	mutex    sync.Mutex
+	statuses []*Status
+	// saving serializes the writes of the state file
+	saving sync.Mutex
+}
+
+func NewSupervisor(client kubernetes.Interface, forward ForwardFunc, stateFile string) *Supervisor {
+	return &Supervisor{
+		Client:           client,
+		Forward:          forward,
+		StateFile:        stateFile,
+		Heartbeat:        DefaultHeartbeat,
+		RetryInterval:    DefaultRetryInterval,
+		PodCheckInterval: DefaultPodCheckInterval,
+	}
+}
+
+// State returns a copy of the current state.
+func (s *Supervisor) State() *State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := &State{PID: os.Getpid(), Updated: time.Now()}
+	for _, status := range s.statuses {
+		copied := *status
+		state.Forwards = append(state.Forwards, &copied)
+	}
+	return state
+}
+
+func (s *Supervisor) saveState() {
+	if s.StateFile == "" {
+		return
+	}
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	data, err := json.MarshalIndent(s.State(), "", "  ")
+	// The file is replaced so readers don't see partial writes
+	temporary := s.StateFile + ".tmp"
+	if err == nil {
+		err = os.WriteFile(temporary, data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(temporary, s.StateFile)
+	}
+	if err != nil {
+		log.WithError(err).WithField("state_file", s.StateFile).Warn("Couldn't save forwards state")
+	}
+}
+
+func (s *Supervisor) update(status *Status, phase Phase, pod string, err error) {
+	s.mutex.Lock()
+	status.Phase, status.Since, status.Pod, status.Error = phase, time.Now(), pod, ""
+	if err != nil {
+		status.Error = err.Error()
+	}
+	s.mutex.Unlock()
+
+	fields := log.Fields{"forward": status.Forward.String(), "pod": pod}
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warnf("Forward %s %s", status.Forward.String(), phase)
+	} else {
+		log.WithFields(fields).Infof("Forward %s %s", status.Forward.String(), phase)
+	}
+	s.saveState()
+}
+
+// Run runs forwards until ctx is done. The state file is removed on exit.
+func (s *Supervisor) Run(ctx context.Context, forwards []*Forward) error {
+	if err := Validate(forwards); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.statuses = make([]*Status, 0, len(forwards))
+	for _, forward := range forwards {
+		s.statuses = append(s.statuses, &Status{Forward: *forward, Phase: Connecting, Since: time.Now()})
+	}
+	s.mutex.Unlock()
+	if s.StateFile != "" {
+		defer os.Remove(s.StateFile)
+	}
+
+	var wg sync.WaitGroup
+	for _, status := range s.statuses {
+		wg.Add(1)
+		go func(status *Status) {
+			defer wg.Done()
+			s.run(ctx, status)
+		}(status)
+	}
+	wait.Until(s.saveState, s.Heartbeat, ctx.Done())
+	wg.Wait()
+	return nil
+}
+
+// run keeps the forward of status running until ctx is done.
+func (s *Supervisor) run(ctx context.Context, status *Status) {
+	forward := &status.Forward
+	interval := s.RetryInterval
+	for ctx.Err() == nil {
+		pod, port, err := ResolveTarget(ctx, s.Client, forward)
+		if err == nil {
+			err = s.forwardTo(ctx, status, pod, port, &interval)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.mutex.Lock()
+		status.Reconnects++
+		s.mutex.Unlock()
+		s.update(status, Retrying, "", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// forwardTo forwards to port of pod until the pod stops serving. interval
+// is reset once the forward is established.
+func (s *Supervisor) forwardTo(ctx context.Context, status *Status, pod *v1.Pod, port int, interval *time.Duration) error {
+	s.update(status, Connecting, pod.Name, nil)
+	podCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var gone error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		gone = s.watchPod(podCtx, pod)
+		cancel()
+	}()
+
+	ready := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ready:
+			*interval = s.RetryInterval
+			s.update(status, Forwarding, pod.Name, nil)
+		case <-podCtx.Done():
+		}
+	}()
+
+	err := s.Forward(podCtx, pod, status.LocalPort, port, ready)
+	cancel()
+	wg.Wait()
+	if gone != nil {
+		return gone
+	}
+	if err == nil {
+		err = fmt.Errorf("forward to pod %s stopped", pod.Name)
+	}
+	return err
+}
+
+// watchPod returns an error once pod stops serving, or nil when ctx is done.
+func (s *Supervisor) watchPod(ctx context.Context, pod *v1.Pod) (gone error) {
+	_ = wait.PollUntilContextCancel(ctx, s.PodCheckInterval, false, func(ctx context.Context) (bool, error) {
+		current, err := s.Client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err) || (err == nil && current.UID != pod.UID):
+			gone = fmt.Errorf("pod %s deleted", pod.Name)
+		case err != nil:
+			// Transient API errors don't stop the forward
+			return false, nil
+		case !isServing(current):
+			gone = fmt.Errorf("pod %s no longer running", pod.Name)
+		}
+		return gone != nil, nil
+	})
+	return
+}
@@ -0,0 +1,197 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	DefaultTimeout   = 30 * time.Second
+	DefaultRetries   = 3
+	DefaultRetryWait = time.Second
+)
+
+// Options holds the settings of the HTTP clients used for downloads.
+type Options struct {
+	// Proxy is the URL of the proxy to use for HTTP and HTTPS. When empty, the
+	// standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables are used.
+	Proxy string
+	// NoProxy is a comma separated list of hosts that are not proxied. When
+	// empty, NO_PROXY is used. It applies to the proxy of the environment too.
+	NoProxy string
+	// CAFiles are PEM bundles added to the system certificate pool.
+	CAFiles []string
+	// Timeout is the maximum time to connect and receive response headers.
+	Timeout time.Duration
+	// Retries is the number of times a failed request is retried.
+	Retries int
+	// RetryWait is the initial wait between retries. It doubles on each retry.
+	RetryWait time.Duration
+}
+
+func NewOptions() *Options {
+	return &Options{
+		Timeout:   DefaultTimeout,
+		Retries:   DefaultRetries,
+		RetryWait: DefaultRetryWait,
+	}
+}
+
+var (
+	DefaultOptions = NewOptions()
+
+	defaultOnce   sync.Once
+	defaultClient *http.Client
+	defaultErr    error
+)
+
+// New creates an HTTP client configured with options.
+func New(options *Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   options.Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = options.Timeout
+	transport.ResponseHeaderTimeout = options.Timeout
+
+	if options.Proxy != "" || options.NoProxy != "" {
+		// The proxy may come from the environment while NoProxy doesn't
+		proxyConfig := httpproxy.FromEnvironment()
+		if options.Proxy != "" {
+			proxyConfig.HTTPProxy = options.Proxy
+			proxyConfig.HTTPSProxy = options.Proxy
+		}
+		if options.NoProxy != "" {
+			proxyConfig.NoProxy = options.NoProxy
+		}
+		proxyFunc := proxyConfig.ProxyFunc()
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			return proxyFunc(r.URL)
+		}
+	}
+
+	if len(options.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, caFile := range options.CAFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while reading CA bundle %s", caFile)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in CA bundle %s", caFile)
+			}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{
+		Transport: &retryTransport{
+			base:    transport,
+			retries: options.Retries,
+			wait:    options.RetryWait,
+		},
+	}, nil
+}
+
+// Default returns the client built from DefaultOptions. It is created on
+// first use, after the command line flags have been parsed.
+func Default() (*http.Client, error) {
+	defaultOnce.Do(func() {
+		defaultClient, defaultErr = New(DefaultOptions)
+	})
+	return defaultClient, defaultErr
+}
+
+// Get issues a GET request with the default client.
+func Get(url string) (*http.Response, error) {
+	client, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return client.Get(url)
+}
+
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	wait    time.Duration
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (resp *http.Response, err error) {
+	wait := t.wait
+	for attempt := 0; ; attempt++ {
+		resp, err = t.base.RoundTrip(r)
+		// Requests with a body can only be replayed if it can be obtained again
+		if attempt >= t.retries || !retryable(resp, err) || (r.Body != nil && r.GetBody == nil) {
+			return
+		}
+
+		fields := log.Fields{
+			"url":     r.URL.String(),
+			"attempt": attempt + 1,
+			"wait":    wait,
+		}
+		if err != nil {
+			log.WithError(err).WithFields(fields).Warn("Request failed, retrying")
+		} else {
+			log.WithFields(fields).Warnf("Request failed with status %s, retrying", resp.Status)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+
+		if r.GetBody != nil {
+			var body io.ReadCloser
+			if body, err = r.GetBody(); err != nil {
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Body = body
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package httpclient
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOptions() *Options {
+	options := NewOptions()
+	options.RetryWait = time.Millisecond
+	return options
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	client, err := New(testOptions())
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	options := testOptions()
+	options.Retries = 0
+	atomic.StoreInt32(&calls, 0)
+	client, err = New(options)
+	require.NoError(t, err)
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCAFiles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	options := testOptions()
+	options.Retries = 0
+	client, err := New(options)
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	require.Error(t, err, "Server certificate should not be trusted")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certificate, 0644))
+
+	options.CAFiles = []string{caFile}
+	client, err = New(options)
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	options.CAFiles = []string{filepath.Join(t.TempDir(), "missing.pem")}
+	_, err = New(options)
+	assert.Error(t, err)
+}
+
+func TestProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		io.WriteString(w, "from proxy "+r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	options := testOptions()
+	options.Proxy = proxy.URL
+	options.NoProxy = "direct.example.com"
+	client, err := New(options)
+	require.NoError(t, err)
+
+	resp, err := client.Get("http://proxied.example.com/file")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "from proxy proxied.example.com", string(body))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+
+	transport := client.Transport.(*retryTransport).base.(*http.Transport)
+	request, _ := http.NewRequest(http.MethodGet, "http://direct.example.com/file", nil)
+	proxyURL, err := transport.Proxy(request)
+	require.NoError(t, err)
+	assert.Nil(t, proxyURL, "Host in no proxy list should not be proxied")
+}
+
+func TestNoProxyWithEnvironmentProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "")
+
+	options := testOptions()
+	options.NoProxy = "direct.example.com"
+	client, err := New(options)
+	require.NoError(t, err)
+
+	transport := client.Transport.(*retryTransport).base.(*http.Transport)
+	for host, expected := range map[string]string{
+		"https://direct.example.com/file":  "",
+		"https://proxied.example.com/file": "http://proxy.example.com:3128",
+	} {
+		request, _ := http.NewRequest(http.MethodGet, host, nil)
+		proxyURL, err := transport.Proxy(request)
+		require.NoError(t, err)
+		if expected == "" {
+			assert.Nil(t, proxyURL, "--no-proxy should apply to the environment proxy")
+		} else {
+			require.NotNil(t, proxyURL)
+			assert.Equal(t, expected, proxyURL.String())
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package knownhosts builds ssh known_hosts files by scanning the host keys
+// from the Windows side, like ssh-keyscan does from the distribution.
+package knownhosts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultTimeout is the time allowed to get the keys of a host.
+const DefaultTimeout = 10 * time.Second
+
+// KeyAlgorithms are the host key types scanned, as ssh-keyscan does by
+// default.
+var KeyAlgorithms = []string{
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoED25519,
+}
+
+// errKeyReceived stops the handshake once the host key is known.
+var errKeyReceived = errors.New("host key received")
+
+// address returns the dial address of host, which may have a port.
+func address(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// scanKey returns the key of host for algorithm, or nil if the host has
+// none.
+func scanKey(host string, algorithm string, timeout time.Duration) (key ssh.PublicKey, err error) {
+	conn, err := net.DialTimeout("tcp", address(host), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:              "kaweezle",
+		HostKeyAlgorithms: []string{algorithm},
+		HostKeyCallback: func(hostname string, remote net.Addr, received ssh.PublicKey) error {
+			key = received
+			return errKeyReceived
+		},
+	}
+	_, _, _, err = ssh.NewClientConn(conn, address(host), config)
+	if key != nil {
+		return key, nil
+	}
+	if err != nil && strings.Contains(err.Error(), "no common algorithm") {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// Scan returns the known_hosts lines of the keys of hosts. Hosts can have a
+// port, as in github.com:22 or [localhost]:2222.
+func Scan(hosts []string, timeout time.Duration) (string, error) {
+	var lines []string
+	for _, host := range hosts {
+		found := false
+		for _, algorithm := range KeyAlgorithms {
+			key, err := scanKey(host, algorithm, timeout)
+			if err != nil {
+				return "", fmt.Errorf("while scanning the keys of %s: %w", host, err)
+			}
+			if key != nil {
+				found = true
+				lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(address(host))}, key))
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("no host key found for %s", host)
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package knownhosts
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer serves the ssh handshake with an ed25519 and an ECDSA host key.
+func testServer(t *testing.T) (string, []ssh.PublicKey) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	var keys []ssh.PublicKey
+	for _, key := range []interface{}{edKey, ecKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		require.NoError(t, err)
+		config.AddHostKey(signer)
+		keys = append(keys, signer.PublicKey())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	return listener.Addr().String(), keys
+}
+
+func TestScan(t *testing.T) {
+	host, keys := testServer(t)
+
+	lines, err := Scan([]string{host}, time.Second)
+	require.NoError(t, err)
+
+	_, port, err := net.SplitHostPort(host)
+	require.NoError(t, err)
+	var scanned []ssh.PublicKey
+	rest := []byte(lines)
+	for len(rest) > 0 {
+		_, hosts, key, _, next, err := ssh.ParseKnownHosts(rest)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"[127.0.0.1]:" + port}, hosts)
+		scanned = append(scanned, key)
+		rest = next
+	}
+	require.Len(t, scanned, 2, "one line per host key, the server has no RSA key")
+	assert.Equal(t, keys[1].Marshal(), scanned[0].Marshal(), "ECDSA comes first")
+	assert.Equal(t, keys[0].Marshal(), scanned[1].Marshal())
+
+	_, err = Scan([]string{"127.0.0.1:1"}, time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package release
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/httpclient"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	DefaultAPIURL = "https://api.github.com"
+	tokenVariable = "GITHUB_TOKEN"
+	pageSize      = 100
+)
+
+// APIURL is the base of the releases API. It can be changed to use a GitHub
+// Enterprise instance.
+var APIURL = DefaultAPIURL
+
+type Channel string
+
+const (
+	// Stable releases are neither drafts nor prereleases.
+	Stable Channel = "stable"
+	// Prerelease includes the release candidates.
+	Prerelease Channel = "prerelease"
+	// Edge is the rolling release built from the main branch, tagged edge
+	// or nightly. It falls back to the most recent release of any kind.
+	Edge Channel = "edge"
+)
+
+var edgeTags = []string{"edge", "nightly"}
+
+func ParseChannel(s string) (Channel, error) {
+	switch Channel(s) {
+	case Stable, Prerelease, Edge:
+		return Channel(s), nil
+	}
+	return Stable, fmt.Errorf("unknown release channel %s (expected %s, %s or %s)", s, Stable, Prerelease, Edge)
+}
+
+// String, Set and Type allow using a channel as a command line flag.
+func (c *Channel) String() string {
+	return string(*c)
+}
+
+func (c *Channel) Set(s string) (err error) {
+	*c, err = ParseChannel(s)
+	return
+}
+
+func (c *Channel) Type() string {
+	return "channel"
+}
+
+type Asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Size               int64  `json:"size"`
+}
+
+type Release struct {
+	TagName     string    `json:"tag_name"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at"`
+	HTMLURL     string    `json:"html_url"`
+	Assets      []Asset   `json:"assets"`
+}
+
+// Asset returns the asset named name or nil if the release doesn't have it.
+func (r *Release) Asset(name string) *Asset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+func (r *Release) IsEdge() bool {
+	for _, tag := range edgeTags {
+		if r.TagName == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind returns the channel the release primarily belongs to.
+func (r *Release) Kind() Channel {
+	switch {
+	case r.IsEdge():
+		return Edge
+	case r.Prerelease:
+		return Prerelease
+	}
+	return Stable
+}
+
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// NewClient returns a client for the releases API at APIURL using the
+// shared HTTP client.
+func NewClient() (*Client, error) {
+	client, err := httpclient.Default()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{BaseURL: APIURL, HTTP: client}, nil
+}
+
+// NewClientWithOptions returns a client for the releases API at APIURL
+// using a dedicated HTTP client built from options.
+func NewClientWithOptions(options *httpclient.Options) (*Client, error) {
+	client, err := httpclient.New(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{BaseURL: APIURL, HTTP: client}, nil
+}
+
+func (c *Client) get(url string, accept string) (resp *http.Response, err error) {
+	var request *http.Request
+	if request, err = http.NewRequest(http.MethodGet, url, nil); err != nil {
+		return
+	}
+	request.Header.Set("Accept", accept)
+	if token := os.Getenv(tokenVariable); token != "" && strings.HasPrefix(url, c.BaseURL) {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	if resp, err = c.HTTP.Do(request); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("error while getting %s: %s", url, resp.Status)
+	}
+	return
+}
+
+// ListReleases returns the releases of repository (owner/name), the most
+// recent first.
+func (c *Client) ListReleases(repository string) (releases []*Release, err error) {
+	url := fmt.Sprintf("%s/repos/%s/releases?per_page=%d", strings.TrimSuffix(c.BaseURL, "/"), repository, pageSize)
+	log.WithField("url", url).Debug("Listing releases")
+
+	var resp *http.Response
+	if resp, err = c.get(url, "application/vnd.github+json"); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		err = errors.Wrapf(err, "while decoding releases of %s", repository)
+		return
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].PublishedAt.After(releases[j].PublishedAt)
+	})
+	return
+}
+
+// Latest returns the most recent release of channel in releases, or nil.
+func Latest(releases []*Release, channel Channel) *Release {
+	var fallback *Release
+	for _, r := range releases {
+		if r.Draft {
+			continue
+		}
+		switch channel {
+		case Stable:
+			if !r.Prerelease && !r.IsEdge() {
+				return r
+			}
+		case Prerelease:
+			if !r.IsEdge() {
+				return r
+			}
+		case Edge:
+			if r.IsEdge() {
+				return r
+			}
+			if fallback == nil {
+				fallback = r
+			}
+		}
+	}
+	return fallback
+}
+
+// LatestRelease returns the most recent release of channel in repository.
+func (c *Client) LatestRelease(repository string, channel Channel) (release *Release, err error) {
+	var releases []*Release
+	if releases, err = c.ListReleases(repository); err != nil {
+		return
+	}
+	if release = Latest(releases, channel); release == nil {
+		err = fmt.Errorf("no %s release found for %s", channel, repository)
+	}
+	return
+}
+
+// Download returns the content of a small asset like a checksums file.
+func (c *Client) Download(asset *Asset) (content []byte, err error) {
+	var resp *http.Response
+	if resp, err = c.get(asset.BrowserDownloadURL, "application/octet-stream"); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// ChecksumForFile returns the checksum of name in the content of a
+// SHA256SUMS like file.
+func ChecksumForFile(sums []byte, name string) string {
+	for _, line := range strings.Split(string(sums), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) > 1 && strings.TrimPrefix(parts[1], "*") == name {
+			return parts[0]
+		}
+	}
+	return ""
+}
+
+// IsNewer tells if the candidate version is more recent than current.
+// Versions that cannot be compared, like edge, are considered newer when
+// they differ.
+func IsNewer(candidate string, current string) bool {
+	candidateVersion, err := version.ParseGeneric(candidate)
+	if err != nil {
+		return candidate != current
+	}
+	currentVersion, err := version.ParseGeneric(current)
+	if err != nil {
+		return candidate != current
+	}
+	if candidateSemantic, err := version.ParseSemantic(candidate); err == nil {
+		if currentSemantic, err := version.ParseSemantic(current); err == nil {
+			return currentSemantic.LessThan(candidateSemantic)
+		}
+	}
+	return currentVersion.LessThan(candidateVersion)
+}
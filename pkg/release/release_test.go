@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package release
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReleases(baseURL string) []*Release {
+	date := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	return []*Release{
+		{TagName: "v0.2.0", PublishedAt: date},
+		{TagName: "edge", Prerelease: true, PublishedAt: date.Add(96 * time.Hour)},
+		{TagName: "v0.3.0-rc1", Prerelease: true, PublishedAt: date.Add(48 * time.Hour)},
+		{TagName: "v0.3.0", PublishedAt: date.Add(24 * time.Hour), Body: "Notes", Assets: []Asset{
+			{Name: "SHA256SUMS", BrowserDownloadURL: baseURL + "/download/v0.3.0/SHA256SUMS"},
+		}},
+		{TagName: "v0.4.0", Draft: true, PublishedAt: date.Add(120 * time.Hour)},
+	}
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *Client) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/api/repos/kaweezle/iknite/releases", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/vnd.github+json", r.Header.Get("Accept"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(testReleases(server.URL))
+	})
+	mux.HandleFunc("/download/v0.3.0/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"), "Token should only be sent to the API")
+		w.Write([]byte("abcdef  kaweezle.rootfs.tar.gz\n012345 *other.zip\n"))
+	})
+
+	t.Setenv(tokenVariable, "secret")
+	return server, &Client{BaseURL: server.URL + "/api", HTTP: server.Client()}
+}
+
+func TestLatestRelease(t *testing.T) {
+	_, client := newTestServer(t)
+
+	releases, err := client.ListReleases("kaweezle/iknite")
+	require.NoError(t, err)
+	require.Len(t, releases, 5)
+	assert.Equal(t, "v0.4.0", releases[0].TagName, "Releases should be sorted by date")
+
+	for channel, expected := range map[Channel]string{
+		Stable:     "v0.3.0",
+		Prerelease: "v0.3.0-rc1",
+		Edge:       "edge",
+	} {
+		latest, err := client.LatestRelease("kaweezle/iknite", channel)
+		require.NoError(t, err)
+		assert.Equal(t, expected, latest.TagName, "Bad release for channel %s", channel)
+		assert.Equal(t, channel, latest.Kind())
+	}
+
+	assert.Equal(t, "v0.3.0", Latest(releases[3:], Edge).TagName, "Edge should fall back to the latest release")
+	assert.Nil(t, Latest(nil, Stable))
+}
+
+func TestDownloadChecksums(t *testing.T) {
+	_, client := newTestServer(t)
+
+	latest, err := client.LatestRelease("kaweezle/iknite", Stable)
+	require.NoError(t, err)
+	assert.Equal(t, "Notes", latest.Body)
+	assert.Nil(t, latest.Asset("missing"))
+
+	sums, err := client.Download(latest.Asset("SHA256SUMS"))
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", ChecksumForFile(sums, "kaweezle.rootfs.tar.gz"))
+	assert.Equal(t, "012345", ChecksumForFile(sums, "other.zip"))
+	assert.Empty(t, ChecksumForFile(sums, "missing"))
+
+	_, err = client.Download(&Asset{BrowserDownloadURL: client.BaseURL + "/missing"})
+	assert.Error(t, err)
+}
+
+func TestParseChannel(t *testing.T) {
+	var channel Channel
+	require.NoError(t, channel.Set("edge"))
+	assert.Equal(t, Edge, channel)
+	assert.Error(t, channel.Set("beta"))
+}
+
+func TestIsNewer(t *testing.T) {
+	assert.True(t, IsNewer("v0.3.18", "v0.3.17"))
+	assert.True(t, IsNewer("v0.4.0", "v0.4.0-rc1"))
+	assert.False(t, IsNewer("v0.3.17", "v0.3.17"))
+	assert.False(t, IsNewer("v0.3.16", "v0.3.17"))
+	assert.True(t, IsNewer("edge", "v0.3.17"))
+	assert.False(t, IsNewer("edge", "edge"))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type Compression int16
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+	Xz
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+func (c Compression) String() (r string) {
+	switch c {
+	case Uncompressed:
+		r = "none"
+	case Gzip:
+		r = "gzip"
+	case Zstd:
+		r = "zstd"
+	case Xz:
+		r = "xz"
+	}
+	return
+}
+
+// ImportSupported tells if wsl --import can use the archive directly.
+func (c Compression) ImportSupported() bool {
+	return c == Uncompressed || c == Gzip
+}
+
+// DetectCompression looks at the magic number at the start of the stream
+// without consuming it.
+func DetectCompression(r *bufio.Reader) (Compression, error) {
+	head, err := r.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return Uncompressed, err
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return Gzip, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd, nil
+	case bytes.HasPrefix(head, xzMagic):
+		return Xz, nil
+	}
+	return Uncompressed, nil
+}
+
+// FileCompression returns the compression of the archive at path.
+func FileCompression(path string) (Compression, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Uncompressed, err
+	}
+	defer file.Close()
+	return DetectCompression(bufio.NewReader(file))
+}
+
+// Decompress returns the tar stream of the archive read from r, whatever
+// its compression.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	compression, err := DetectCompression(buffered)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case Gzip:
+		return gzip.NewReader(buffered)
+	case Zstd:
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case Xz:
+		reader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	}
+	return io.NopCloser(buffered), nil
+}
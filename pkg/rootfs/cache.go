@@ -0,0 +1,252 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CacheDirName   = "cache"
+	CacheIndexName = "index.json"
+	UnknownVersion = "unknown"
+)
+
+var CacheDir = filepath.Join(HomeDir, CacheDirName)
+
+// CacheEntry describes a root filesystem stored in the cache. The file itself
+// is named after its checksum.
+type CacheEntry struct {
+	Version  string    `json:"version"`
+	Checksum string    `json:"checksum"`
+	Date     time.Time `json:"date"`
+	Source   string    `json:"source,omitempty"`
+	Size     int64     `json:"size"`
+}
+
+func (e *CacheEntry) Filename() string {
+	return e.Checksum + ".tar.gz"
+}
+
+func (e *CacheEntry) ShortChecksum() string {
+	if len(e.Checksum) > 12 {
+		return e.Checksum[:12]
+	}
+	return e.Checksum
+}
+
+// Cache is a content addressed store of root filesystems. The index keeps
+// track of the version and download date of each file as well as the one
+// currently in use.
+type Cache struct {
+	Dir     string        `json:"-"`
+	Current string        `json:"current,omitempty"`
+	Entries []*CacheEntry `json:"entries"`
+}
+
+// OpenCache opens the cache located in dir, creating it if needed.
+func OpenCache(dir string) (cache *Cache, err error) {
+	if err = EnsureHomeDir(dir); err != nil {
+		return
+	}
+	cache = &Cache{Dir: dir}
+
+	var content []byte
+	content, err = os.ReadFile(cache.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(content, cache); err != nil {
+		err = errors.Wrapf(err, "while reading cache index %s", cache.indexPath())
+		return
+	}
+	cache.sort()
+	return
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.Dir, CacheIndexName)
+}
+
+func (c *Cache) sort() {
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Date.After(c.Entries[j].Date)
+	})
+}
+
+// Save writes the cache index on disk.
+func (c *Cache) Save() (err error) {
+	c.sort()
+	var content []byte
+	if content, err = json.MarshalIndent(c, "", "  "); err != nil {
+		return
+	}
+	tmpPath := c.indexPath() + ".tmp"
+	if err = os.WriteFile(tmpPath, content, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmpPath, c.indexPath())
+}
+
+// Path returns the path of the root filesystem file of entry.
+func (c *Cache) Path(entry *CacheEntry) string {
+	return filepath.Join(c.Dir, entry.Filename())
+}
+
+// Find returns the entry matching the version or checksum prefix ref. When
+// several entries have the same version, the most recent one is returned.
+func (c *Cache) Find(ref string) *CacheEntry {
+	for _, entry := range c.Entries {
+		if entry.Version == ref || entry.Checksum == ref {
+			return entry
+		}
+	}
+	ref = strings.TrimPrefix(ref, "v")
+	for _, entry := range c.Entries {
+		if strings.TrimPrefix(entry.Version, "v") == ref {
+			return entry
+		}
+	}
+	if len(ref) >= 6 {
+		for _, entry := range c.Entries {
+			if strings.HasPrefix(entry.Checksum, ref) {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// CurrentEntry returns the entry in use or nil if there is none.
+func (c *Cache) CurrentEntry() *CacheEntry {
+	if c.Current == "" {
+		return nil
+	}
+	for _, entry := range c.Entries {
+		if entry.Checksum == c.Current {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Use marks the entry matching ref as the current one.
+func (c *Cache) Use(ref string) (entry *CacheEntry, err error) {
+	if entry = c.Find(ref); entry == nil {
+		err = fmt.Errorf("no root filesystem matching %s in cache", ref)
+		return
+	}
+	c.Current = entry.Checksum
+	err = c.Save()
+	return
+}
+
+// Add moves the file at path into the cache and records it with the given
+// version and source. If the cache already contains a file with the same
+// checksum, the entry is refreshed and path is removed.
+func (c *Cache) Add(path string, checksum string, version string, source string) (entry *CacheEntry, err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(path); err != nil {
+		return
+	}
+
+	if version == "" {
+		version = UnknownVersion
+	}
+
+	for _, existing := range c.Entries {
+		if existing.Checksum == checksum {
+			entry = existing
+			break
+		}
+	}
+	if entry == nil {
+		entry = &CacheEntry{Checksum: checksum}
+		c.Entries = append(c.Entries, entry)
+	}
+	entry.Version = version
+	entry.Source = source
+	entry.Size = info.Size()
+	entry.Date = time.Now()
+
+	destination := c.Path(entry)
+	if _, statErr := os.Stat(destination); statErr == nil {
+		os.Remove(path)
+	} else if err = os.Rename(path, destination); err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"version":  entry.Version,
+		"checksum": entry.Checksum,
+		"path":     destination,
+	}).Debug("Root FS added to cache")
+
+	err = c.Save()
+	return
+}
+
+// Remove deletes entry from the cache.
+func (c *Cache) Remove(entry *CacheEntry) (err error) {
+	if err = os.Remove(c.Path(entry)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	os.Remove(c.Path(entry) + MetadataSuffix)
+	c.Entries = lo.Without(c.Entries, entry)
+	if c.Current == entry.Checksum {
+		c.Current = ""
+	}
+	return c.Save()
+}
+
+// Prune removes the oldest entries, keeping at most keep of them. The current
+// entry is never removed.
+func (c *Cache) Prune(keep int) (removed []*CacheEntry, err error) {
+	c.sort()
+	kept := 0
+	var candidates []*CacheEntry
+	for _, entry := range c.Entries {
+		if entry.Checksum == c.Current {
+			kept++
+			continue
+		}
+		candidates = append(candidates, entry)
+	}
+	for _, entry := range candidates {
+		if kept < keep {
+			kept++
+			continue
+		}
+		if err = c.Remove(entry); err != nil {
+			return
+		}
+		removed = append(removed, entry)
+	}
+	return
+}
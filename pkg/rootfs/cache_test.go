@@ -0,0 +1,87 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addFile(t *testing.T, cache *Cache, content string, checksum string, version string) *CacheEntry {
+	path := filepath.Join(t.TempDir(), "rootfs")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	entry, err := cache.Add(path, checksum, version, "test")
+	require.NoError(t, err)
+	return entry
+}
+
+func TestCacheAddAndFind(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenCache(dir)
+	require.NoError(t, err)
+	assert.Empty(t, cache.Entries)
+
+	entry := addFile(t, cache, "first", "aaaaaaaaaaaaaaaa", "v0.1.0")
+	assert.FileExists(t, filepath.Join(dir, "aaaaaaaaaaaaaaaa.tar.gz"))
+	assert.Equal(t, int64(5), entry.Size)
+
+	assert.Equal(t, entry, cache.Find("v0.1.0"))
+	assert.Equal(t, entry, cache.Find("0.1.0"))
+	assert.Equal(t, entry, cache.Find("aaaaaa"))
+	assert.Nil(t, cache.Find("aaa"), "Checksum prefix too short")
+	assert.Nil(t, cache.Find("v0.2.0"))
+
+	reopened, err := OpenCache(dir)
+	require.NoError(t, err)
+	require.Len(t, reopened.Entries, 1)
+	assert.Equal(t, "v0.1.0", reopened.Entries[0].Version)
+}
+
+func TestCacheUseAndPrune(t *testing.T) {
+	cache, err := OpenCache(t.TempDir())
+	require.NoError(t, err)
+
+	first := addFile(t, cache, "first", "1111111111", "v0.1.0")
+	second := addFile(t, cache, "second", "2222222222", "v0.2.0")
+	third := addFile(t, cache, "third", "3333333333", "v0.3.0")
+	first.Date = time.Now().Add(-3 * time.Hour)
+	second.Date = time.Now().Add(-2 * time.Hour)
+	third.Date = time.Now().Add(-1 * time.Hour)
+
+	_, err = cache.Use("v0.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, first, cache.CurrentEntry())
+
+	_, err = cache.Use("v9.9.9")
+	assert.Error(t, err)
+
+	removed, err := cache.Prune(2)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, second, removed[0], "The current entry should be kept")
+	assert.NoFileExists(t, cache.Path(second))
+	assert.ElementsMatch(t, []*CacheEntry{first, third}, cache.Entries)
+
+	removed, err = cache.Prune(0)
+	require.NoError(t, err)
+	assert.Equal(t, []*CacheEntry{third}, removed)
+	assert.Equal(t, []*CacheEntry{first}, cache.Entries)
+}
@@ -0,0 +1,270 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MetadataSuffix      = ".json"
+	osReleasePath       = "etc/os-release"
+	apkInstalledPath    = "lib/apk/db/installed"
+	ikniteComponent     = "iknite"
+	maxManifestFileSize = 1 << 20
+)
+
+// trackedPackages are the apk packages reported as components.
+var trackedPackages = []string{
+	ikniteComponent,
+	"kubelet",
+	"kubeadm",
+	"kubectl",
+	"containerd",
+	"cni-plugins",
+	"cri-tools",
+	"etcd",
+	"buildkit",
+	"nerdctl",
+}
+
+var manifestImageRegexp = regexp.MustCompile(`image:\s*["']?[^\s"']*/([a-z0-9-]+):([^\s"'@]+)`)
+
+// Metadata describes the content of a root file system archive.
+type Metadata struct {
+	OSRelease map[string]string `json:"osRelease,omitempty"`
+	// Components maps the kubernetes related components to their version.
+	Components       map[string]string `json:"components,omitempty"`
+	UncompressedSize int64             `json:"uncompressedSize"`
+	FileCount        int               `json:"fileCount"`
+}
+
+func (m *Metadata) OSName() string {
+	if name, ok := m.OSRelease["PRETTY_NAME"]; ok {
+		return name
+	}
+	return strings.TrimSpace(m.OSRelease["NAME"] + " " + m.OSRelease["VERSION_ID"])
+}
+
+func (m *Metadata) IkniteVersion() string {
+	return m.Components[ikniteComponent]
+}
+
+func parseOSRelease(content []byte) map[string]string {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, found := strings.Cut(line, "="); found {
+			result[key] = strings.Trim(value, `"'`)
+		}
+	}
+	return result
+}
+
+// parseApkInstalled extracts the versions of the tracked packages from the
+// apk database. Packages are separated by blank lines and described by
+// single letter keys, P: being the name and V: the version.
+func parseApkInstalled(content []byte, components map[string]string) {
+	var name, version string
+	flush := func() {
+		for _, tracked := range trackedPackages {
+			if name == tracked {
+				components[name] = version
+			}
+		}
+		name, version = "", ""
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "P:"):
+			name = line[2:]
+		case strings.HasPrefix(line, "V:"):
+			version = line[2:]
+		}
+	}
+	flush()
+}
+
+// parseManifestImages gets the version of the components whose container
+// image is referenced in packaged manifests.
+func parseManifestImages(content []byte, components map[string]string) {
+	for _, match := range manifestImageRegexp.FindAllSubmatch(content, -1) {
+		name := string(match[1])
+		if _, ok := components[name]; !ok {
+			components[name] = string(match[2])
+		}
+	}
+}
+
+func isManifest(name string) bool {
+	ext := path.Ext(name)
+	if ext != ".yaml" && ext != ".yml" {
+		return false
+	}
+	return strings.HasPrefix(name, "etc/kubernetes/") || strings.Contains(name, "/manifests/")
+}
+
+// Inspect reads the root file system archive without extracting it and
+// returns its metadata.
+func Inspect(r io.Reader) (metadata *Metadata, err error) {
+	var archiveReader io.ReadCloser
+	if archiveReader, err = Decompress(r); err != nil {
+		return
+	}
+	defer archiveReader.Close()
+	tarReader := tar.NewReader(archiveReader)
+
+	result := &Metadata{Components: make(map[string]string)}
+	var apkInstalled []byte
+
+	var header *tar.Header
+	for {
+		if header, err = tarReader.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		result.FileCount++
+		result.UncompressedSize += header.Size
+
+		name := normalizeName(header.Name)
+		switch {
+		case name == osReleasePath || (name == "usr/lib/os-release" && result.OSRelease == nil):
+			var content []byte
+			if content, err = io.ReadAll(tarReader); err != nil {
+				return
+			}
+			result.OSRelease = parseOSRelease(content)
+		case name == apkInstalledPath:
+			if apkInstalled, err = io.ReadAll(tarReader); err != nil {
+				return
+			}
+		case isManifest(name) && header.Size < maxManifestFileSize:
+			var content []byte
+			if content, err = io.ReadAll(tarReader); err != nil {
+				return
+			}
+			parseManifestImages(content, result.Components)
+		}
+	}
+
+	// Packages take precedence over manifests
+	if apkInstalled != nil {
+		parseApkInstalled(apkInstalled, result.Components)
+	}
+
+	metadata = result
+	return
+}
+
+// InspectFile returns the metadata of the root file system at path.
+func InspectFile(path string) (metadata *Metadata, err error) {
+	var file *os.File
+	if file, err = os.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	if metadata, err = Inspect(file); err != nil {
+		err = errors.Wrapf(err, "while inspecting %s", path)
+	}
+	return
+}
+
+// Metadata returns the metadata of entry. It is computed on first access
+// and stored next to the root file system.
+func (c *Cache) Metadata(entry *CacheEntry) (metadata *Metadata, err error) {
+	metadataPath := c.Path(entry) + MetadataSuffix
+
+	var content []byte
+	if content, err = os.ReadFile(metadataPath); err == nil {
+		metadata = &Metadata{}
+		if err = json.Unmarshal(content, metadata); err == nil {
+			return
+		}
+		log.WithError(err).WithField("path", metadataPath).Warn("Bad root FS metadata, inspecting again")
+	}
+
+	if metadata, err = InspectFile(c.Path(entry)); err != nil {
+		return
+	}
+	if content, err = json.MarshalIndent(metadata, "", "  "); err != nil {
+		return
+	}
+	err = os.WriteFile(metadataPath, content, 0644)
+	return
+}
+
+// MetadataChange is a difference between two root file systems.
+type MetadataChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// DiffMetadata returns the components and OS versions that differ between
+// old and new.
+func DiffMetadata(old, new *Metadata) (changes []MetadataChange) {
+	if old.OSName() != new.OSName() {
+		changes = append(changes, MetadataChange{"os", old.OSName(), new.OSName()})
+	}
+
+	names := make(map[string]bool)
+	for name := range old.Components {
+		names[name] = true
+	}
+	for name := range new.Components {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if old.Components[name] != new.Components[name] {
+			changes = append(changes, MetadataChange{name, old.Components[name], new.Components[name]})
+		}
+	}
+	return
+}
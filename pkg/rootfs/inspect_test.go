@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOSRelease = `NAME="Alpine Linux"
+ID=alpine
+VERSION_ID=3.20.2
+PRETTY_NAME="Alpine Linux v3.20"
+`
+	testApkInstalled = `C:Q1abc=
+P:musl
+V:1.2.5-r0
+
+C:Q1def=
+P:iknite
+V:0.3.4-r0
+A:x86_64
+
+P:kubelet
+V:1.30.3-r0
+
+P:containerd
+V:1.7.20-r0
+`
+	testManifest = `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: kube-apiserver
+    image: registry.k8s.io/kube-apiserver:v1.30.3
+  - name: kubelet
+    image: "registry.k8s.io/kubelet:v0.0.0"
+`
+)
+
+var inspectedRootFS = []testFile{
+	{name: "./etc/", mode: 0755, dir: true},
+	{name: "./etc/os-release", content: testOSRelease, mode: 0644},
+	{name: "./lib/apk/db/installed", content: testApkInstalled, mode: 0644},
+	{name: "./etc/kubernetes/manifests/kube-apiserver.yaml", content: testManifest, mode: 0644},
+	{name: "./sbin/iknite", content: "binary", mode: 0755},
+}
+
+func TestInspect(t *testing.T) {
+	metadata, err := Inspect(bytes.NewReader(makeTarGz(t, inspectedRootFS)))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Alpine Linux v3.20", metadata.OSName())
+	assert.Equal(t, "0.3.4-r0", metadata.IkniteVersion())
+	assert.Equal(t, map[string]string{
+		"iknite":         "0.3.4-r0",
+		"kubelet":        "1.30.3-r0",
+		"containerd":     "1.7.20-r0",
+		"kube-apiserver": "v1.30.3",
+	}, metadata.Components, "musl is not tracked and packages take precedence over manifests")
+	assert.Equal(t, 4, metadata.FileCount)
+	assert.Equal(t, int64(len(testOSRelease)+len(testApkInstalled)+len(testManifest)+len("binary")), metadata.UncompressedSize)
+}
+
+func TestCacheMetadata(t *testing.T) {
+	cache, err := OpenCache(t.TempDir())
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "rootfs")
+	require.NoError(t, os.WriteFile(path, makeTarGz(t, inspectedRootFS), 0644))
+	entry, err := cache.Add(path, "1234567890", "v0.3.4", "test")
+	require.NoError(t, err)
+
+	metadata, err := cache.Metadata(entry)
+	require.NoError(t, err)
+	assert.FileExists(t, cache.Path(entry)+MetadataSuffix)
+	assert.Equal(t, "0.3.4-r0", metadata.IkniteVersion())
+
+	require.NoError(t, cache.Remove(entry))
+	assert.NoFileExists(t, cache.Path(entry)+MetadataSuffix)
+}
+
+func TestDiffMetadata(t *testing.T) {
+	old := &Metadata{
+		OSRelease:  map[string]string{"PRETTY_NAME": "Alpine Linux v3.19"},
+		Components: map[string]string{"iknite": "0.3.3", "kubelet": "1.30.2", "etcd": "3.5.0"},
+	}
+	new := &Metadata{
+		OSRelease:  map[string]string{"PRETTY_NAME": "Alpine Linux v3.20"},
+		Components: map[string]string{"iknite": "0.3.4", "kubelet": "1.30.2", "containerd": "1.7.20"},
+	}
+	assert.Equal(t, []MetadataChange{
+		{"os", "Alpine Linux v3.19", "Alpine Linux v3.20"},
+		{"containerd", "", "1.7.20"},
+		{"etcd", "3.5.0", ""},
+		{"iknite", "0.3.3", "0.3.4"},
+	}, DiffMetadata(old, new))
+}
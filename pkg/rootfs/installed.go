@@ -0,0 +1,47 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"os"
+	"strings"
+)
+
+// SaveInstalledVersion records in the file at path the version of the root
+// file system imported in a distribution. An empty version, i.e. a root file
+// system not coming from the cache, removes the record.
+func SaveInstalledVersion(path string, version string) error {
+	if version == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(version+"\n"), 0o644)
+}
+
+// ReadInstalledVersion returns the version recorded at path. It is empty if
+// no version is recorded.
+func ReadInstalledVersion(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstalledVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kaweezle-rootfs-version")
+
+	version, err := ReadInstalledVersion(path)
+	require.NoError(t, err)
+	assert.Empty(t, version, "nothing recorded")
+
+	require.NoError(t, SaveInstalledVersion(path, "v0.3.4"))
+	version, err = ReadInstalledVersion(path)
+	require.NoError(t, err)
+	assert.Equal(t, "v0.3.4", version)
+
+	require.NoError(t, SaveInstalledVersion(path, ""))
+	version, err = ReadInstalledVersion(path)
+	require.NoError(t, err)
+	assert.Empty(t, version, "an unknown version removes the record")
+	require.NoError(t, SaveInstalledVersion(path, ""), "removing twice is fine")
+}
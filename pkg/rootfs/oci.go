@@ -0,0 +1,220 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/kaweezle/kaweezle/pkg/httpclient"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OCIScheme        = "oci://"
+	ociLayoutFile    = "oci-layout"
+	ociRefAnnotation = "org.opencontainers.image.ref.name"
+	ociImageOS       = "linux"
+	ociImageArch     = "amd64"
+)
+
+var ociPlatform = v1.Platform{OS: ociImageOS, Architecture: ociImageArch}
+
+// IsOCISource tells if source is a registry reference (oci://...) or a
+// local OCI image layout directory.
+func IsOCISource(source string) bool {
+	if strings.HasPrefix(source, OCIScheme) {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(source, ociLayoutFile))
+	return err == nil
+}
+
+func remoteImage(reference string) (image v1.Image, version string, err error) {
+	var ref name.Reference
+	if ref, err = name.ParseReference(strings.TrimPrefix(reference, OCIScheme)); err != nil {
+		return
+	}
+	options := []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(ociPlatform),
+	}
+	var httpClient *http.Client
+	if httpClient, err = httpclient.Default(); err != nil {
+		return
+	}
+	options = append(options, remote.WithTransport(httpClient.Transport))
+	if image, err = remote.Image(ref, options...); err != nil {
+		return
+	}
+	version = ref.Identifier()
+	return
+}
+
+// layoutImage returns the image of the layout directory. When the layout
+// contains several images, the one for the linux/amd64 platform is chosen.
+func layoutImage(dir string) (image v1.Image, version string, err error) {
+	var index v1.ImageIndex
+	if index, err = layout.ImageIndexFromPath(dir); err != nil {
+		return
+	}
+	var manifest *v1.IndexManifest
+	if manifest, err = index.IndexManifest(); err != nil {
+		return
+	}
+	if len(manifest.Manifests) == 0 {
+		err = fmt.Errorf("no image in OCI layout %s", dir)
+		return
+	}
+
+	var descriptor *v1.Descriptor
+	for i := range manifest.Manifests {
+		candidate := &manifest.Manifests[i]
+		if candidate.Platform == nil || candidate.Platform.Satisfies(ociPlatform) {
+			descriptor = candidate
+			break
+		}
+	}
+	if descriptor == nil {
+		err = fmt.Errorf("no %s/%s image in OCI layout %s", ociImageOS, ociImageArch, dir)
+		return
+	}
+
+	if descriptor.MediaType.IsIndex() {
+		var child v1.ImageIndex
+		if child, err = index.ImageIndex(descriptor.Digest); err != nil {
+			return
+		}
+		return layoutImageFromIndex(child, descriptor)
+	}
+	if image, err = index.Image(descriptor.Digest); err != nil {
+		return
+	}
+	version = descriptor.Annotations[ociRefAnnotation]
+	return
+}
+
+func layoutImageFromIndex(index v1.ImageIndex, parent *v1.Descriptor) (image v1.Image, version string, err error) {
+	var manifest *v1.IndexManifest
+	if manifest, err = index.IndexManifest(); err != nil {
+		return
+	}
+	for _, descriptor := range manifest.Manifests {
+		if descriptor.Platform == nil || descriptor.Platform.Satisfies(ociPlatform) {
+			image, err = index.Image(descriptor.Digest)
+			version = parent.Annotations[ociRefAnnotation]
+			return
+		}
+	}
+	err = fmt.Errorf("no %s/%s image in OCI index %s", ociImageOS, ociImageArch, parent.Digest)
+	return
+}
+
+// flatten writes the merged file system of the image layers, with whiteouts
+// applied, as a tar.gz in a temporary file of dir.
+func flatten(image v1.Image, dir string) (path string, checksum string, err error) {
+	var out *os.File
+	if out, err = os.CreateTemp(dir, "oci"); err != nil {
+		return
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(out.Name())
+		}
+	}()
+
+	extracted := mutate.Extract(image)
+	defer extracted.Close()
+
+	hasher := sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(out, hasher))
+	if _, err = io.Copy(gzipWriter, extracted); err != nil {
+		return
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return
+	}
+	path = out.Name()
+	checksum = fmt.Sprintf("%x", hasher.Sum(nil))
+	return
+}
+
+// EnsureOCIRootFS adds the root file system of the OCI image designated by
+// source to the cache. The image is flattened only once per digest.
+func EnsureOCIRootFS(cache *Cache, source string, fields *log.Fields) (entry *CacheEntry, err error) {
+	var image v1.Image
+	var version string
+	if strings.HasPrefix(source, OCIScheme) {
+		image, version, err = remoteImage(source)
+	} else {
+		image, version, err = layoutImage(source)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "while getting OCI image %s", source)
+		return
+	}
+
+	var digest v1.Hash
+	if digest, err = image.Digest(); err != nil {
+		return
+	}
+	if version == "" {
+		version = digest.Hex[:12]
+	}
+	digestSource := fmt.Sprintf("%s@%s", source, digest)
+
+	for _, existing := range cache.Entries {
+		if existing.Source == digestSource {
+			if _, statErr := os.Stat(cache.Path(existing)); statErr == nil {
+				log.WithFields(*fields).WithFields(log.Fields{
+					"source":   source,
+					"digest":   digest.String(),
+					"checksum": existing.Checksum,
+				}).Info("OCI root FS already in cache")
+				entry = existing
+				return
+			}
+		}
+	}
+
+	log.WithFields(*fields).WithFields(log.Fields{
+		"source": source,
+		"digest": digest.String(),
+	}).Info("Flattening OCI image layers...")
+
+	var path, checksum string
+	if path, checksum, err = flatten(image, cache.Dir); err != nil {
+		err = errors.Wrapf(err, "while flattening OCI image %s", source)
+		return
+	}
+
+	entry, err = cache.Add(path, checksum, version, digestSource)
+	return
+}
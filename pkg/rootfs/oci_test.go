@@ -0,0 +1,170 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func makeTar(t *testing.T, files []testFile) []byte {
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	for _, file := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: file.name, Mode: file.mode, Size: int64(len(file.content)), Typeflag: tar.TypeReg}))
+		_, err := tarWriter.Write([]byte(file.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	return buffer.Bytes()
+}
+
+func makeLayer(t *testing.T, files []testFile) v1.Layer {
+	content := makeTar(t, files)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	})
+	require.NoError(t, err)
+	return layer
+}
+
+// testImage has two layers, the second one removing a file of the first one.
+func testImage(t *testing.T) v1.Image {
+	image, err := mutate.AppendLayers(empty.Image,
+		makeLayer(t, []testFile{
+			{name: "etc/os-release", content: testOSRelease, mode: 0644},
+			{name: "etc/removed", content: "removed", mode: 0644},
+		}),
+		makeLayer(t, []testFile{
+			{name: "etc/.wh.removed", mode: 0644},
+			{name: "sbin/iknite", content: "binary", mode: 0755},
+		}),
+	)
+	require.NoError(t, err)
+	return image
+}
+
+func checkFlattened(t *testing.T, cache *Cache, entry *CacheEntry) {
+	content, err := os.ReadFile(cache.Path(entry))
+	require.NoError(t, err)
+	files := readTarGz(t, content)
+	assert.Contains(t, files, "etc/os-release")
+	assert.Contains(t, files, "sbin/iknite")
+	assert.NotContains(t, files, "etc/removed", "Whiteout should be applied")
+	assert.NotContains(t, files, "etc/.wh.removed")
+}
+
+func TestEnsureOCIRootFSFromRegistry(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	reference := serverURL.Host + "/kaweezle/rootfs:v1.0.0"
+	ref, err := name.ParseReference(reference)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, testImage(t)))
+
+	source := OCIScheme + reference
+	assert.True(t, IsOCISource(source))
+
+	cache, err := OpenCache(t.TempDir())
+	require.NoError(t, err)
+	entry, err := EnsureOCIRootFS(cache, source, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, "v1.0.0", entry.Version)
+	checkFlattened(t, cache, entry)
+
+	again, err := EnsureOCIRootFS(cache, source, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, entry, again)
+	assert.Len(t, cache.Entries, 1)
+}
+
+func TestEnsureOCIRootFSFromLayout(t *testing.T) {
+	dir := t.TempDir()
+	path, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, path.AppendImage(testImage(t), layout.WithAnnotations(map[string]string{
+		ociRefAnnotation: "custom",
+	})))
+	assert.True(t, IsOCISource(dir))
+	assert.False(t, IsOCISource(t.TempDir()))
+
+	cache, err := OpenCache(t.TempDir())
+	require.NoError(t, err)
+	entry, err := EnsureOCIRootFS(cache, dir, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, "custom", entry.Version)
+	checkFlattened(t, cache, entry)
+}
+
+func TestDecompress(t *testing.T) {
+	content := makeTar(t, []testFile{{name: "etc/motd", content: "Hello", mode: 0644}})
+
+	var zstdBuffer bytes.Buffer
+	zstdWriter, err := zstd.NewWriter(&zstdBuffer)
+	require.NoError(t, err)
+	_, err = zstdWriter.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, zstdWriter.Close())
+
+	var xzBuffer bytes.Buffer
+	xzWriter, err := xz.NewWriter(&xzBuffer)
+	require.NoError(t, err)
+	_, err = xzWriter.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, xzWriter.Close())
+
+	for compression, archive := range map[Compression][]byte{
+		Uncompressed: content,
+		Zstd:         zstdBuffer.Bytes(),
+		Xz:           xzBuffer.Bytes(),
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			reader, err := Decompress(bytes.NewReader(archive))
+			require.NoError(t, err)
+			defer reader.Close()
+			decompressed, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, content, decompressed)
+
+			// The overlay converts any archive to tar.gz
+			var output bytes.Buffer
+			require.NoError(t, ApplyOverlay(bytes.NewReader(archive), &output, &Overlay{}))
+			assert.Equal(t, "Hello", readTarGz(t, output.Bytes())["etc/motd"].content)
+		})
+	}
+}
@@ -0,0 +1,408 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitfield/script"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OverlayDirName     = "overlay"
+	DefaultOverlayMode = 0644
+)
+
+// OverlayFile is a file added to or modified in the root file system.
+// Its content comes either from Source, a local file, or from Content. When
+// neither is given, only the mode and owner of the existing file are changed.
+type OverlayFile struct {
+	// Path is the absolute path of the file in the root file system.
+	Path    string `mapstructure:"path"`
+	Source  string `mapstructure:"source"`
+	Content string `mapstructure:"content"`
+	// Mode is the octal permission of the file, e.g. "0600".
+	Mode string `mapstructure:"mode"`
+	Uid  *int   `mapstructure:"uid"`
+	Gid  *int   `mapstructure:"gid"`
+	// Append adds the content at the end of the existing file.
+	Append bool `mapstructure:"append"`
+}
+
+// Overlay describes the changes to apply to a root file system before
+// importing it. The files in Dir are copied at the same relative path.
+type Overlay struct {
+	Dir   string         `mapstructure:"dir"`
+	Files []*OverlayFile `mapstructure:"files"`
+}
+
+func (o *Overlay) IsEmpty() bool {
+	return o == nil || (o.Dir == "" && len(o.Files) == 0)
+}
+
+type overlayEntry struct {
+	*OverlayFile
+	name    string
+	content []byte
+	mode    int64
+	applied bool
+}
+
+func (e *overlayEntry) hasContent() bool {
+	return e.Source != "" || e.Content != ""
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+}
+
+// entries resolves the overlay files, reading their content. Files from Dir
+// come first and can be altered by the file list.
+func (o *Overlay) entries() (result map[string]*overlayEntry, err error) {
+	result = make(map[string]*overlayEntry)
+
+	if o.Dir != "" {
+		err = filepath.WalkDir(o.Dir, func(p string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil || d.IsDir() {
+				return walkErr
+			}
+			rel, relErr := filepath.Rel(o.Dir, p)
+			if relErr != nil {
+				return relErr
+			}
+			name := normalizeName(filepath.ToSlash(rel))
+			result[name] = &overlayEntry{OverlayFile: &OverlayFile{Path: "/" + name, Source: p}, name: name}
+			return nil
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "while reading overlay directory %s", o.Dir)
+			return
+		}
+	}
+
+	for _, file := range o.Files {
+		if file.Path == "" {
+			err = fmt.Errorf("overlay file without path")
+			return
+		}
+		name := normalizeName(file.Path)
+		if existing, ok := result[name]; ok && !file.Append && file.Source == "" && file.Content == "" {
+			// Attributes only: alter the file coming from the directory
+			merged := *existing.OverlayFile
+			merged.Mode, merged.Uid, merged.Gid = file.Mode, file.Uid, file.Gid
+			existing.OverlayFile = &merged
+			continue
+		}
+		result[name] = &overlayEntry{OverlayFile: file, name: name}
+	}
+
+	for _, entry := range result {
+		entry.mode = -1
+		if entry.Mode != "" {
+			var mode uint64
+			if mode, err = strconv.ParseUint(entry.Mode, 8, 32); err != nil {
+				err = errors.Wrapf(err, "bad mode %s for overlay file %s", entry.Mode, entry.Path)
+				return
+			}
+			entry.mode = int64(mode)
+		}
+		if entry.Source != "" {
+			if entry.content, err = os.ReadFile(entry.Source); err != nil {
+				err = errors.Wrapf(err, "while reading overlay file %s", entry.Source)
+				return
+			}
+		} else {
+			entry.content = []byte(entry.Content)
+		}
+	}
+	return
+}
+
+func sortedEntries(entries map[string]*overlayEntry) []*overlayEntry {
+	result := make([]*overlayEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// overlayFormat changes with the way overlays are applied, so that the root
+// file systems derived before are not reused. 2: private parent directories.
+const overlayFormat = "2"
+
+// Checksum identifies the overlay content. It changes whenever a file, its
+// content or its attributes change.
+func (o *Overlay) Checksum() (checksum string, err error) {
+	var entries map[string]*overlayEntry
+	if entries, err = o.entries(); err != nil {
+		return
+	}
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%s\x00", overlayFormat)
+	for _, entry := range sortedEntries(entries) {
+		fmt.Fprintf(hasher, "%s\x00%d\x00%v\x00%v\x00%t\x00%t\x00", entry.name, entry.mode, uidString(entry.Uid), uidString(entry.Gid), entry.Append, entry.hasContent())
+		hasher.Write(entry.content)
+		hasher.Write([]byte{0})
+	}
+	checksum = fmt.Sprintf("%x", hasher.Sum(nil))
+	return
+}
+
+func uidString(id *int) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.Itoa(*id)
+}
+
+func (e *overlayEntry) applyAttributes(header *tar.Header) {
+	if e.mode >= 0 {
+		header.Mode = e.mode
+	}
+	if e.Uid != nil {
+		header.Uid = *e.Uid
+		header.Uname = ""
+	}
+	if e.Gid != nil {
+		header.Gid = *e.Gid
+		header.Gname = ""
+	}
+}
+
+// ApplyOverlay writes to w the root file system read from r with the overlay
+// applied. The input can be any supported archive, the output is a tar.gz.
+func ApplyOverlay(r io.Reader, w io.Writer, overlay *Overlay) (err error) {
+	var entries map[string]*overlayEntry
+	if entries, err = overlay.entries(); err != nil {
+		return
+	}
+
+	var archiveReader io.ReadCloser
+	if archiveReader, err = Decompress(r); err != nil {
+		return
+	}
+	defer archiveReader.Close()
+	tarReader := tar.NewReader(archiveReader)
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	directories := map[string]bool{"": true}
+	prefix := ""
+
+	var header *tar.Header
+	for {
+		if header, err = tarReader.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		if prefix == "" && strings.HasPrefix(header.Name, "./") {
+			prefix = "./"
+		}
+
+		name := normalizeName(header.Name)
+		if header.Typeflag == tar.TypeDir {
+			directories[name] = true
+		}
+
+		entry, ok := entries[name]
+		if !ok || header.Typeflag == tar.TypeDir {
+			if err = tarWriter.WriteHeader(header); err != nil {
+				return
+			}
+			if _, err = io.Copy(tarWriter, tarReader); err != nil {
+				return
+			}
+			continue
+		}
+
+		entry.applied = true
+		content := entry.content
+		if entry.Append || !entry.hasContent() {
+			var existing []byte
+			if existing, err = io.ReadAll(tarReader); err != nil {
+				return
+			}
+			if entry.Append {
+				if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+					existing = append(existing, '\n')
+				}
+				content = append(existing, content...)
+			} else {
+				content = existing
+			}
+		}
+
+		newHeader := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     header.Name,
+			Mode:     header.Mode,
+			Uid:      header.Uid,
+			Gid:      header.Gid,
+			Uname:    header.Uname,
+			Gname:    header.Gname,
+			ModTime:  time.Now(),
+			Size:     int64(len(content)),
+			Format:   header.Format,
+		}
+		entry.applyAttributes(newHeader)
+		if err = tarWriter.WriteHeader(newHeader); err != nil {
+			return
+		}
+		if _, err = tarWriter.Write(content); err != nil {
+			return
+		}
+	}
+
+	// The missing parents of private files, like /root/.ssh, are private too
+	privateDirs := make(map[string]bool)
+	for _, entry := range entries {
+		if !entry.applied && entry.mode >= 0 && entry.mode&0o077 == 0 {
+			for dir := path.Dir(entry.name); dir != "." && !directories[dir]; dir = path.Dir(dir) {
+				privateDirs[dir] = true
+			}
+		}
+	}
+
+	// Add the files not present in the original archive
+	for _, entry := range sortedEntries(entries) {
+		if entry.applied {
+			continue
+		}
+		if !entry.hasContent() && !entry.Append {
+			log.WithField("path", entry.Path).Warn("Overlay file attributes for missing file ignored")
+			continue
+		}
+
+		var parents []string
+		for dir := path.Dir(entry.name); dir != "." && !directories[dir]; dir = path.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			var mode int64 = 0755
+			if privateDirs[dir] {
+				mode = 0700
+			}
+			if err = tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     prefix + dir + "/",
+				Mode:     mode,
+				ModTime:  time.Now(),
+			}); err != nil {
+				return
+			}
+			directories[dir] = true
+		}
+
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     prefix + entry.name,
+			Mode:     DefaultOverlayMode,
+			ModTime:  time.Now(),
+			Size:     int64(len(entry.content)),
+		}
+		entry.applyAttributes(header)
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return
+		}
+		if _, err = tarWriter.Write(entry.content); err != nil {
+			return
+		}
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		return
+	}
+	return gzipWriter.Close()
+}
+
+// DeriveRootFS returns the path of the root file system source with the
+// overlay applied. The derived file is kept in dir, named after the combined
+// checksum of the source and of the overlay, so it is only built once.
+func DeriveRootFS(source string, sourceChecksum string, overlay *Overlay, dir string) (derived string, err error) {
+	if sourceChecksum == "" {
+		if sourceChecksum, err = script.File(source).SHA256Sum(); err != nil {
+			return
+		}
+	}
+	var overlayChecksum string
+	if overlayChecksum, err = overlay.Checksum(); err != nil {
+		return
+	}
+
+	combined := fmt.Sprintf("%x", sha256.Sum256([]byte(sourceChecksum+overlayChecksum)))
+	derived = filepath.Join(dir, combined+".tar.gz")
+	fields := log.Fields{
+		"source":  source,
+		"derived": derived,
+	}
+
+	if _, err = os.Stat(derived); err == nil {
+		log.WithFields(fields).Info("Using cached customized root FS")
+		return
+	}
+
+	if err = EnsureHomeDir(dir); err != nil {
+		return
+	}
+
+	log.WithFields(fields).Info("Applying overlay to root FS...")
+
+	var in, out *os.File
+	if in, err = os.Open(source); err != nil {
+		return
+	}
+	defer in.Close()
+
+	if out, err = os.CreateTemp(dir, "derived"); err != nil {
+		return
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(out.Name())
+			derived = ""
+		}
+	}()
+
+	if err = ApplyOverlay(in, out, overlay); err != nil {
+		err = errors.Wrapf(err, "while applying overlay to %s", source)
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	err = os.Rename(out.Name(), derived)
+	return
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	name    string
+	content string
+	mode    int64
+	dir     bool
+}
+
+func makeTarGz(t *testing.T, files []testFile) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: file.mode, Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+		if file.dir {
+			header.Typeflag = tar.TypeDir
+			header.Size = 0
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		if !file.dir {
+			_, err := tarWriter.Write([]byte(file.content))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return buffer.Bytes()
+}
+
+type tarEntry struct {
+	*tar.Header
+	content string
+}
+
+func readTarGz(t *testing.T, content []byte) map[string]*tarEntry {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	result := make(map[string]*tarEntry)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tarReader)
+		require.NoError(t, err)
+		result[header.Name] = &tarEntry{header, string(data)}
+	}
+	return result
+}
+
+var baseRootFS = []testFile{
+	{name: "./", mode: 0755, dir: true},
+	{name: "./etc/", mode: 0755, dir: true},
+	{name: "./etc/conf.d/", mode: 0755, dir: true},
+	{name: "./etc/conf.d/iknite", content: "export A=1", mode: 0644},
+	{name: "./etc/motd", content: "Welcome", mode: 0644},
+	{name: "./sbin/", mode: 0755, dir: true},
+	{name: "./sbin/tool", content: "binary", mode: 0644},
+}
+
+func TestApplyOverlay(t *testing.T) {
+	overlayDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(overlayDir, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(overlayDir, "etc", "motd"), []byte("Hello"), 0644))
+
+	uid := 1000
+	overlay := &Overlay{
+		Dir: overlayDir,
+		Files: []*OverlayFile{
+			{Path: "/etc/conf.d/iknite", Content: "export B=2\n", Append: true},
+			{Path: "/root/.ssh/id_rsa", Content: "key", Mode: "0600", Uid: &uid},
+			{Path: "/sbin/tool", Mode: "0755"},
+			{Path: "/etc/motd", Mode: "0640"},
+			{Path: "/opt/app/config", Content: "public"},
+		},
+	}
+
+	var output bytes.Buffer
+	require.NoError(t, ApplyOverlay(bytes.NewReader(makeTarGz(t, baseRootFS)), &output, overlay))
+	headers := readTarGz(t, output.Bytes())
+
+	assert.Equal(t, "export A=1\nexport B=2\n", headers["./etc/conf.d/iknite"].content)
+	assert.Equal(t, "Hello", headers["./etc/motd"].content)
+	assert.Equal(t, int64(0640), headers["./etc/motd"].Mode)
+	assert.Equal(t, "binary", headers["./sbin/tool"].content)
+	assert.Equal(t, int64(0755), headers["./sbin/tool"].Mode)
+
+	require.Contains(t, headers, "./root/")
+	require.Contains(t, headers, "./root/.ssh/")
+	assert.Equal(t, int64(0700), headers["./root/.ssh/"].Mode, "parents of private files are private")
+	assert.Equal(t, int64(0700), headers["./root/"].Mode)
+	require.Contains(t, headers, "./opt/app/")
+	assert.Equal(t, int64(0755), headers["./opt/app/"].Mode)
+	require.Contains(t, headers, "./root/.ssh/id_rsa")
+	key := headers["./root/.ssh/id_rsa"]
+	assert.Equal(t, "key", key.content)
+	assert.Equal(t, int64(0600), key.Mode)
+	assert.Equal(t, 1000, key.Uid)
+	assert.Equal(t, 0, key.Gid)
+}
+
+func TestOverlayChecksum(t *testing.T) {
+	overlay := &Overlay{Files: []*OverlayFile{{Path: "/etc/motd", Content: "Hello"}}}
+	first, err := overlay.Checksum()
+	require.NoError(t, err)
+
+	overlay.Files[0].Mode = "0600"
+	second, err := overlay.Checksum()
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	overlay.Files[0].Mode = "0999"
+	_, err = overlay.Checksum()
+	assert.Error(t, err, "Mode is not octal")
+}
+
+func TestDeriveRootFS(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "rootfs.tar.gz")
+	require.NoError(t, os.WriteFile(source, makeTarGz(t, baseRootFS), 0644))
+	overlay := &Overlay{Files: []*OverlayFile{{Path: "/etc/motd", Content: "Hello"}}}
+
+	derived, err := DeriveRootFS(source, "", overlay, filepath.Join(dir, "derived"))
+	require.NoError(t, err)
+	assert.FileExists(t, derived)
+
+	again, err := DeriveRootFS(source, "", overlay, filepath.Join(dir, "derived"))
+	require.NoError(t, err)
+	assert.Equal(t, derived, again)
+
+	overlay.Files[0].Content = "Bye"
+	other, err := DeriveRootFS(source, "", overlay, filepath.Join(dir, "derived"))
+	require.NoError(t, err)
+	assert.NotEqual(t, derived, other)
+}
@@ -22,10 +22,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/bitfield/script"
 	"github.com/dustin/go-humanize"
+	"github.com/kaweezle/kaweezle/pkg/httpclient"
+	"github.com/kaweezle/kaweezle/pkg/release"
 	"github.com/pterm/pterm"
 	log "github.com/sirupsen/logrus"
 )
@@ -34,8 +35,10 @@ const (
 	HomeDirName       = "kaweezle"
 	TarFilename       = "rootfs.tar.gz"
 	RemoteTarFilename = "kaweezle.rootfs.tar.gz"
-	RootFsUrl         = "https://github.com/kaweezle/iknite/releases/latest/download/" + RemoteTarFilename
-	RootFSChecksumURL = "https://github.com/kaweezle/iknite/releases/latest/download/SHA256SUMS"
+	ChecksumsFilename = "SHA256SUMS"
+	// ReleasesRepository is the GitHub repository publishing the root file
+	// system.
+	ReleasesRepository = "kaweezle/iknite"
 )
 
 var (
@@ -43,6 +46,8 @@ var (
 	DefaultTarFilePath  = filepath.Join(HomeDir, TarFilename)
 	TarFilePath         = ""
 	TarFileChecksumPath = TarFilePath + ".sha256"
+	// Channel is the release channel the root file system is taken from.
+	Channel = release.Stable
 )
 
 func EnsureHomeDir(homeDir string) (err error) {
@@ -50,31 +55,48 @@ func EnsureHomeDir(homeDir string) (err error) {
 	return
 }
 
-func checksumForFile(sums []byte, name string) string {
-	for _, line := range strings.Split(string(sums), "\n") {
-		parts := strings.Fields(line)
-		if len(parts) > 1 && parts[1] == name {
-			return parts[0]
-		}
-	}
-	return ""
+// RootFSRelease is the root file system published in a release.
+type RootFSRelease struct {
+	*release.Release
+	Asset    *release.Asset
+	Checksum string
 }
 
-func getReleaseChecksum(filename string) (checksum string, err error) {
-	var resp *http.Response
-	if resp, err = http.DefaultClient.Get(RootFSChecksumURL); err != nil {
+// LatestRootFSRelease returns the root file system of the most recent
+// release of channel, along with its published checksum.
+func LatestRootFSRelease(channel release.Channel) (result *RootFSRelease, err error) {
+	var client *release.Client
+	if client, err = release.NewClient(); err != nil {
 		return
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		var bodyBytes []byte
-		if bodyBytes, err = io.ReadAll(resp.Body); err == nil {
-			checksum = checksumForFile(bodyBytes, filename)
-		}
+	var latest *release.Release
+	if latest, err = client.LatestRelease(ReleasesRepository, channel); err != nil {
+		return
 	}
+	return rootFSRelease(client, latest)
+}
 
+func rootFSRelease(client *release.Client, r *release.Release) (result *RootFSRelease, err error) {
+	asset := r.Asset(RemoteTarFilename)
+	if asset == nil {
+		err = fmt.Errorf("release %s has no %s", r.TagName, RemoteTarFilename)
+		return
+	}
+	sumsAsset := r.Asset(ChecksumsFilename)
+	if sumsAsset == nil {
+		err = fmt.Errorf("release %s has no %s", r.TagName, ChecksumsFilename)
+		return
+	}
+	var sums []byte
+	if sums, err = client.Download(sumsAsset); err != nil {
+		return
+	}
+	checksum := release.ChecksumForFile(sums, RemoteTarFilename)
+	if checksum == "" {
+		err = fmt.Errorf("no checksum found for %s in release %s", RemoteTarFilename, r.TagName)
+		return
+	}
+	result = &RootFSRelease{Release: r, Asset: asset, Checksum: checksum}
 	return
 }
 
@@ -88,6 +110,67 @@ func (wp *WritableProgress) Write(p []byte) (n int, err error) {
 	return
 }
 
+// download fetches url into a temporary file in dir, checking that its
+// checksum is expectedChecksum. The caller is responsible for moving or
+// removing the returned file.
+func download(url string, dir string, title string, expectedChecksum string) (path string, err error) {
+	var resp *http.Response
+
+	if resp, err = httpclient.Get(url); err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("error while downloading %s: %s", url, resp.Status)
+		return
+	}
+
+	var rootFSTemp *os.File
+	if rootFSTemp, err = os.CreateTemp(dir, "rootfs"); err != nil {
+		return
+	}
+	defer func() {
+		rootFSTemp.Close()
+		if err != nil {
+			os.Remove(rootFSTemp.Name())
+		}
+	}()
+
+	var bar *pterm.ProgressbarPrinter
+	title = fmt.Sprintf("%s: %s", title, humanize.Bytes(uint64(resp.ContentLength)))
+	if bar, err = pterm.DefaultProgressbar.WithShowCount(false).WithShowElapsedTime(true).WithShowPercentage(true).WithTitle(title).WithTotal(int(resp.ContentLength)).Start(); err != nil {
+		return
+	}
+
+	bar.Start()
+	defer bar.Stop()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(rootFSTemp, &WritableProgress{bar}, hasher), resp.Body); err != nil {
+		return
+	}
+
+	rootFSTemp.Close()
+	bar.Stop()
+
+	downloadedChecksum := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	log.WithFields(log.Fields{
+		"downloadedChecksum": downloadedChecksum,
+		"onlineChecksum":     expectedChecksum,
+	}).Trace("Checksums")
+
+	if downloadedChecksum != expectedChecksum {
+		err = fmt.Errorf("bad checksum for url %s. Expected %s, got %s", url, expectedChecksum, downloadedChecksum)
+		return
+	}
+
+	path = rootFSTemp.Name()
+	return
+}
+
 func EnsureRootFS(path string, fields *log.Fields) (err error) {
 	var tarFilePath string
 	if tarFilePath, err = filepath.Abs(path); err != nil {
@@ -126,9 +209,11 @@ func EnsureRootFS(path string, fields *log.Fields) (err error) {
 		"checksum": currentChecksum,
 	}).Info("Root FS exists: ", currentExists)
 
-	if onlineChecksum, err = getReleaseChecksum(RemoteTarFilename); err != nil {
+	var latest *RootFSRelease
+	if latest, err = LatestRootFSRelease(Channel); err != nil {
 		return
 	}
+	onlineChecksum = latest.Checksum
 
 	log.WithFields(log.Fields{
 		"currentChecksum": currentChecksum,
@@ -143,69 +228,102 @@ func EnsureRootFS(path string, fields *log.Fields) (err error) {
 		return
 	}
 
-	var resp *http.Response
-
 	log.WithFields(log.Fields{
 		"rootFS":    tarFilePath,
 		"checksum":  onlineChecksum,
-		"rootFsUrl": RootFsUrl,
+		"version":   latest.TagName,
+		"rootFsUrl": latest.Asset.BrowserDownloadURL,
 	}).Info("Downloading Root FS")
 
-	if resp, err = http.DefaultClient.Get(RootFsUrl); err != nil {
-		return
-	}
-
-	defer resp.Body.Close()
-
-	var rootFSTemp *os.File
-	if rootFSTemp, err = os.CreateTemp(homeDir, "rootfs"); err != nil {
-		return
-	}
-	defer rootFSTemp.Close()
-	defer os.Remove(rootFSTemp.Name())
-
-	var bar *pterm.ProgressbarPrinter
-	title := fmt.Sprintf("%s: %s", filepath.Base(tarFilePath), humanize.Bytes(uint64(resp.ContentLength)))
-	if bar, err = pterm.DefaultProgressbar.WithShowCount(false).WithShowElapsedTime(true).WithShowPercentage(true).WithTitle(title).WithTotal(int(resp.ContentLength)).Start(); err != nil {
+	var downloaded string
+	if downloaded, err = download(latest.Asset.BrowserDownloadURL, homeDir, filepath.Base(tarFilePath), onlineChecksum); err != nil {
 		return
 	}
 
-	bar.Start()
-	defer bar.Stop()
-
-	hasher := sha256.New()
-	if _, err = io.Copy(io.MultiWriter(rootFSTemp, &WritableProgress{bar}, hasher), resp.Body); err != nil {
-		return
+	if currentExists {
+		os.Remove(tarFilePath)
 	}
 
-	rootFSTemp.Close()
-	bar.Stop()
+	os.Rename(downloaded, tarFilePath)
 
-	downloadedChecksum := fmt.Sprintf("%x", hasher.Sum(nil))
+	_, err = script.Echo(onlineChecksum).WriteFile(tarFileChecksumPath)
 
 	log.WithFields(log.Fields{
-		"downloadedChecksum": downloadedChecksum,
-		"onlineChecksum":     onlineChecksum,
-	}).Trace("Checksums")
+		"rootFS":   tarFilePath,
+		"checksum": onlineChecksum,
+	}).Info("Download ok")
+
+	return
+}
 
-	if downloadedChecksum != onlineChecksum {
-		err = fmt.Errorf("bad checksum for url %s. Expected %s, got %s", RootFsUrl, onlineChecksum, downloadedChecksum)
+// EnsureCachedRootFS makes sure that the latest root filesystem released on
+// Channel is present in cache and marks it as the current one.
+func EnsureCachedRootFS(cache *Cache, fields *log.Fields) (entry *CacheEntry, err error) {
+	var latest *RootFSRelease
+	if latest, err = LatestRootFSRelease(Channel); err != nil {
 		return
 	}
+	return EnsureReleaseRootFS(cache, latest, fields)
+}
 
-	if currentExists {
-		os.Remove(tarFilePath)
+// EnsureReleaseRootFS downloads the root filesystem of latest in cache if
+// needed and marks it as the current one.
+func EnsureReleaseRootFS(cache *Cache, latest *RootFSRelease, fields *log.Fields) (entry *CacheEntry, err error) {
+	if entry = cache.Find(latest.Checksum); entry != nil {
+		log.WithFields(*fields).WithFields(log.Fields{
+			"version":  entry.Version,
+			"checksum": entry.Checksum,
+		}).Info("Root FS already in cache")
+	} else {
+		url := latest.Asset.BrowserDownloadURL
+		log.WithFields(*fields).WithFields(log.Fields{
+			"version":   latest.TagName,
+			"channel":   Channel,
+			"checksum":  latest.Checksum,
+			"rootFsUrl": url,
+		}).Info("Downloading Root FS")
+
+		var downloaded string
+		if downloaded, err = download(url, cache.Dir, RemoteTarFilename, latest.Checksum); err != nil {
+			return
+		}
+		if entry, err = cache.Add(downloaded, latest.Checksum, latest.TagName, url); err != nil {
+			return
+		}
+		if _, metadataErr := cache.Metadata(entry); metadataErr != nil {
+			log.WithError(metadataErr).WithFields(*fields).Warn("Couldn't inspect root FS")
+		}
+		log.WithFields(*fields).WithFields(log.Fields{
+			"version":  entry.Version,
+			"checksum": entry.Checksum,
+		}).Info("Download ok")
 	}
 
-	os.Rename(rootFSTemp.Name(), tarFilePath)
-
-	_, err = script.Echo(downloadedChecksum).WriteFile(tarFileChecksumPath)
+	_, err = cache.Use(entry.Checksum)
+	return
+}
 
-	log.WithFields(log.Fields{
-		"rootFS":   tarFilePath,
-		"checksum": onlineChecksum,
-	}).Info("Download ok")
+// ImportLegacyRootFS moves a root filesystem downloaded by previous versions
+// of kaweezle at path into the cache.
+func ImportLegacyRootFS(cache *Cache, path string) (entry *CacheEntry, err error) {
+	if _, err = os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
 
+	var checksum string
+	if checksum, err = script.File(path).SHA256Sum(); err != nil {
+		return
+	}
+	if entry, err = cache.Add(path, checksum, UnknownVersion, path); err != nil {
+		return
+	}
+	os.Remove(path + ".sha256")
+	if cache.Current == "" {
+		_, err = cache.Use(entry.Checksum)
+	}
 	return
 }
 
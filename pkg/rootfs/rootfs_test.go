@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/release"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReleasesServer serves a stable and a prerelease of the root file system
+// through a releases API stand-in.
+func newReleasesServer(t *testing.T) map[string][]byte {
+	archives := map[string][]byte{
+		"v0.1.0":     makeTarGz(t, baseRootFS),
+		"v0.2.0-rc1": makeTarGz(t, append([]testFile{{name: "etc/motd", content: "rc", mode: 0644}}, baseRootFS...)),
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	var releases []*release.Release
+	date := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for tag, archive := range archives {
+		archive := archive
+		r := &release.Release{TagName: tag, Prerelease: tag != "v0.1.0", PublishedAt: date}
+		if r.Prerelease {
+			r.PublishedAt = date.Add(time.Hour)
+		}
+		for _, name := range []string{RemoteTarFilename, ChecksumsFilename} {
+			r.Assets = append(r.Assets, release.Asset{Name: name, BrowserDownloadURL: fmt.Sprintf("%s/download/%s/%s", server.URL, tag, name)})
+		}
+		mux.HandleFunc(fmt.Sprintf("/download/%s/%s", tag, RemoteTarFilename), func(w http.ResponseWriter, r *http.Request) {
+			w.Write(archive)
+		})
+		mux.HandleFunc(fmt.Sprintf("/download/%s/%s", tag, ChecksumsFilename), func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%x  %s\n", sha256.Sum256(archive), RemoteTarFilename)
+		})
+		releases = append(releases, r)
+	}
+	mux.HandleFunc("/repos/"+ReleasesRepository+"/releases", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(releases)
+	})
+
+	previousURL, previousChannel := release.APIURL, Channel
+	release.APIURL = server.URL
+	t.Cleanup(func() { release.APIURL, Channel = previousURL, previousChannel })
+	return archives
+}
+
+func TestEnsureCachedRootFS(t *testing.T) {
+	archives := newReleasesServer(t)
+	cache, err := OpenCache(t.TempDir())
+	require.NoError(t, err)
+
+	entry, err := EnsureCachedRootFS(cache, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, "v0.1.0", entry.Version)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(archives["v0.1.0"])), entry.Checksum)
+	assert.Equal(t, entry, cache.CurrentEntry())
+	assert.FileExists(t, cache.Path(entry))
+
+	again, err := EnsureCachedRootFS(cache, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, entry, again)
+	assert.Len(t, cache.Entries, 1)
+
+	Channel = release.Prerelease
+	latest, err := LatestRootFSRelease(Channel)
+	require.NoError(t, err)
+	assert.Equal(t, "v0.2.0-rc1", latest.TagName)
+	entry, err = EnsureReleaseRootFS(cache, latest, &log.Fields{})
+	require.NoError(t, err)
+	assert.Equal(t, entry, cache.CurrentEntry())
+	assert.Equal(t, "v0.2.0-rc1", entry.Version)
+	assert.Len(t, cache.Entries, 2)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package selfupdate
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/release"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Repository is the GitHub repository publishing kaweezle.
+	Repository = "kaweezle/kaweezle"
+	// ArchiveName is the name of the goreleaser archive containing the
+	// executable.
+	ArchiveName = "kaweezle_Windows_amd64.zip"
+	// ChecksumsName is the name of the goreleaser checksums file.
+	ChecksumsName  = "kaweezle_checksums.txt"
+	ExecutableName = "kaweezle.exe"
+	NoticeFileName = "update-notice.json"
+	// DefaultNoticeInterval is the minimum time between two checks of the
+	// releases for the new version notice.
+	DefaultNoticeInterval = 24 * time.Hour
+	// NoticeTimeout is the maximum time taken by the check for the new
+	// version notice. The check is not retried.
+	NoticeTimeout = 5 * time.Second
+
+	newSuffix = ".new"
+	oldSuffix = ".old"
+)
+
+// Check returns the latest kaweezle release of channel and tells if it is
+// newer than current.
+func Check(client *release.Client, current string, channel release.Channel) (latest *release.Release, available bool, err error) {
+	if latest, err = client.LatestRelease(Repository, channel); err != nil {
+		return
+	}
+	available = release.IsNewer(latest.TagName, current)
+	return
+}
+
+// download returns the executable contained in the archive of r after
+// checking the archive checksum.
+func download(client *release.Client, r *release.Release) (executable []byte, err error) {
+	archiveAsset := r.Asset(ArchiveName)
+	checksumsAsset := r.Asset(ChecksumsName)
+	if archiveAsset == nil || checksumsAsset == nil {
+		err = fmt.Errorf("release %s doesn't contain %s and %s", r.TagName, ArchiveName, ChecksumsName)
+		return
+	}
+
+	var sums []byte
+	if sums, err = client.Download(checksumsAsset); err != nil {
+		return
+	}
+	expected := release.ChecksumForFile(sums, ArchiveName)
+	if expected == "" {
+		err = fmt.Errorf("no checksum for %s in release %s", ArchiveName, r.TagName)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"version": r.TagName,
+		"url":     archiveAsset.BrowserDownloadURL,
+	}).Info("Downloading kaweezle")
+
+	var archive []byte
+	if archive, err = client.Download(archiveAsset); err != nil {
+		return
+	}
+	if actual := fmt.Sprintf("%x", sha256.Sum256(archive)); actual != expected {
+		err = fmt.Errorf("bad checksum for %s. Expected %s, got %s", ArchiveName, expected, actual)
+		return
+	}
+
+	var reader *zip.Reader
+	if reader, err = zip.NewReader(bytes.NewReader(archive), int64(len(archive))); err != nil {
+		return
+	}
+	for _, file := range reader.File {
+		if filepath.Base(file.Name) != ExecutableName {
+			continue
+		}
+		var content io.ReadCloser
+		if content, err = file.Open(); err != nil {
+			return
+		}
+		defer content.Close()
+		return io.ReadAll(content)
+	}
+	err = fmt.Errorf("no %s in %s", ExecutableName, ArchiveName)
+	return
+}
+
+// Apply replaces executable by the one of release r. As Windows doesn't allow
+// removing a running executable, it is renamed with a .old suffix before the
+// new one takes its place. The old executable is removed by Cleanup on the
+// next run.
+func Apply(client *release.Client, r *release.Release, executable string) (err error) {
+	var content []byte
+	if content, err = download(client, r); err != nil {
+		return
+	}
+
+	var info os.FileInfo
+	if info, err = os.Stat(executable); err != nil {
+		return
+	}
+
+	newPath := executable + newSuffix
+	oldPath := executable + oldSuffix
+	if err = os.WriteFile(newPath, content, info.Mode()); err != nil {
+		return errors.Wrapf(err, "while writing %s", newPath)
+	}
+	defer os.Remove(newPath)
+
+	os.Remove(oldPath)
+	if err = os.Rename(executable, oldPath); err != nil {
+		return errors.Wrapf(err, "while moving %s", executable)
+	}
+	if err = os.Rename(newPath, executable); err != nil {
+		// Put back the current executable
+		if rollbackErr := os.Rename(oldPath, executable); rollbackErr != nil {
+			log.WithError(rollbackErr).WithField("executable", oldPath).Error("Couldn't restore executable")
+		}
+		return errors.Wrapf(err, "while replacing %s", executable)
+	}
+	return
+}
+
+// Cleanup removes the executable left by a previous update.
+func Cleanup(executable string) {
+	os.Remove(executable + oldSuffix)
+}
+
+// Notice is the cached result of the last check made for the new version
+// notice.
+type Notice struct {
+	Checked time.Time `json:"checked"`
+	Latest  string    `json:"latest"`
+}
+
+// NewerVersion returns the latest version if it is newer than current. The
+// releases are only queried through latest when the result cached in path is
+// older than interval.
+func NewerVersion(path string, current string, interval time.Duration, latest func() (string, error)) (newer string, err error) {
+	notice := &Notice{}
+	if content, readErr := os.ReadFile(path); readErr == nil {
+		if json.Unmarshal(content, notice) != nil {
+			notice = &Notice{}
+		}
+	}
+
+	if time.Since(notice.Checked) >= interval {
+		// Failed checks are recorded too so that offline users don't check
+		// on each command. The last known version is kept.
+		version, latestErr := latest()
+		if latestErr == nil {
+			notice.Latest = version
+		}
+		notice.Checked = time.Now()
+		var content []byte
+		if content, err = json.Marshal(notice); err == nil {
+			err = os.WriteFile(path, content, 0644)
+		}
+		if latestErr != nil {
+			return "", latestErr
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if notice.Latest != "" && release.IsNewer(notice.Latest, current) {
+		newer = notice.Latest
+	}
+	return
+}
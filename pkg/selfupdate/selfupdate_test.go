@@ -0,0 +1,145 @@
+/*
+Copyright © 2022 Antoine Martin <antoine@openance.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package selfupdate
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kaweezle/kaweezle/pkg/release"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeArchive(t *testing.T, content string) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, data := range map[string]string{"README.md": "readme", ExecutableName: content} {
+		file, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func newTestServer(t *testing.T, archive []byte, checksum string) *release.Client {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	releases := []*release.Release{{
+		TagName:     "v0.4.0",
+		PublishedAt: time.Now(),
+		Assets: []release.Asset{
+			{Name: ArchiveName, BrowserDownloadURL: server.URL + "/download/" + ArchiveName},
+			{Name: ChecksumsName, BrowserDownloadURL: server.URL + "/download/" + ChecksumsName},
+		},
+	}}
+	mux.HandleFunc("/repos/"+Repository+"/releases", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(releases)
+	})
+	mux.HandleFunc("/download/"+ArchiveName, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	})
+	mux.HandleFunc("/download/"+ChecksumsName, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  %s\n", checksum, ArchiveName)
+	})
+	return &release.Client{BaseURL: server.URL, HTTP: server.Client()}
+}
+
+func TestApply(t *testing.T) {
+	archive := makeArchive(t, "new")
+	client := newTestServer(t, archive, fmt.Sprintf("%x", sha256.Sum256(archive)))
+
+	latest, available, err := Check(client, "v0.3.17", release.Stable)
+	require.NoError(t, err)
+	assert.True(t, available)
+	_, available, err = Check(client, "v0.4.0", release.Stable)
+	require.NoError(t, err)
+	assert.False(t, available)
+
+	executable := filepath.Join(t.TempDir(), ExecutableName)
+	require.NoError(t, os.WriteFile(executable, []byte("old"), 0755))
+	require.NoError(t, Apply(client, latest, executable))
+
+	content, err := os.ReadFile(executable)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	assert.FileExists(t, executable+oldSuffix)
+	assert.NoFileExists(t, executable+newSuffix)
+
+	Cleanup(executable)
+	assert.NoFileExists(t, executable+oldSuffix)
+}
+
+func TestApplyBadChecksum(t *testing.T) {
+	client := newTestServer(t, makeArchive(t, "new"), "0123456789")
+	latest, _, err := Check(client, "v0.3.17", release.Stable)
+	require.NoError(t, err)
+
+	executable := filepath.Join(t.TempDir(), ExecutableName)
+	require.NoError(t, os.WriteFile(executable, []byte("old"), 0755))
+	assert.ErrorContains(t, Apply(client, latest, executable), "bad checksum")
+
+	content, err := os.ReadFile(executable)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(content), "Executable should be untouched")
+}
+
+func TestNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), NoticeFileName)
+	calls := 0
+	latest := func() (string, error) {
+		calls++
+		return "v0.4.0", nil
+	}
+
+	newer, err := NewerVersion(path, "v0.3.17", time.Hour, latest)
+	require.NoError(t, err)
+	assert.Equal(t, "v0.4.0", newer)
+
+	newer, err = NewerVersion(path, "v0.4.0", time.Hour, latest)
+	require.NoError(t, err)
+	assert.Empty(t, newer)
+	assert.Equal(t, 1, calls, "Releases should be checked once per interval")
+
+	_, err = NewerVersion(path, "v0.3.17", 0, latest)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// Failed checks are not retried before the interval
+	offline := func() (string, error) {
+		calls++
+		return "", fmt.Errorf("no network")
+	}
+	_, err = NewerVersion(path, "v0.3.17", 0, offline)
+	assert.EqualError(t, err, "no network")
+	newer, err = NewerVersion(path, "v0.3.17", time.Hour, offline)
+	require.NoError(t, err)
+	assert.Equal(t, "v0.4.0", newer, "the last known version is kept")
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package support builds the diagnostics archives shared in support
+// requests.
+package support
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// ManifestName is the name of the manifest in the archive.
+const ManifestName = "manifest.json"
+
+// ManifestEntry describes a collected item.
+type ManifestEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Size        int    `json:"size"`
+	// Redactions is the number of secrets removed from the item.
+	Redactions int `json:"redactions,omitempty"`
+	// Error tells why the item couldn't be collected.
+	Error string `json:"error,omitempty"`
+}
+
+// Manifest lists the content of the archive.
+type Manifest struct {
+	Created time.Time        `json:"created"`
+	Version string           `json:"version"`
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+// CollectFunc returns the content of an item.
+type CollectFunc func() ([]byte, error)
+
+// Bundle is a zip archive of diagnostics. Every item is redacted before
+// being added.
+type Bundle struct {
+	Manifest Manifest
+	zip      *zip.Writer
+}
+
+// NewBundle creates a bundle writing to w. version is the kaweezle version.
+func NewBundle(w io.Writer, version string) *Bundle {
+	return &Bundle{
+		Manifest: Manifest{Created: time.Now().UTC(), Version: version},
+		zip:      zip.NewWriter(w),
+	}
+}
+
+// Collect adds the item returned by collect under name. A collection error
+// doesn't stop the bundle: it is recorded in the manifest along with any
+// partial content.
+func (b *Bundle) Collect(name string, description string, collect CollectFunc) (entry *ManifestEntry, err error) {
+	entry = &ManifestEntry{Name: name, Description: description}
+	b.Manifest.Entries = append(b.Manifest.Entries, entry)
+
+	data, collectErr := collect()
+	if collectErr != nil {
+		entry.Error = collectErr.Error()
+		if len(data) == 0 {
+			return
+		}
+	}
+	data, entry.Redactions = Redact(data)
+	entry.Size = len(data)
+
+	var w io.Writer
+	if w, err = b.zip.Create(name); err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+// Close writes the manifest and finishes the archive.
+func (b *Bundle) Close() (err error) {
+	var w io.Writer
+	if w, err = b.zip.Create(ManifestName); err != nil {
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(&b.Manifest); err != nil {
+		return
+	}
+	return b.zip.Close()
+}
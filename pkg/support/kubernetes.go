@@ -0,0 +1,83 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package support
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubectl/pkg/describe"
+)
+
+// eventTime returns the last time the event was seen.
+func eventTime(event *v1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// Events lists the events of all the namespaces, oldest first.
+func Events(ctx context.Context, client kubernetes.Interface) ([]byte, error) {
+	list, err := client.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	events := list.Items
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(&events[i]).Before(eventTime(&events[j]))
+	})
+
+	var buffer bytes.Buffer
+	w := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tNAMESPACE\tTYPE\tREASON\tOBJECT\tCOUNT\tMESSAGE")
+	for i := range events {
+		event := &events[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/%s\t%d\t%s\n",
+			eventTime(event).UTC().Format(time.RFC3339), event.Namespace, event.Type, event.Reason,
+			event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Count, event.Message)
+	}
+	err = w.Flush()
+	return buffer.Bytes(), err
+}
+
+// NodeDescriptions returns the kubectl description of the nodes.
+func NodeDescriptions(ctx context.Context, client kubernetes.Interface) ([]byte, error) {
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	describer := &describe.NodeDescriber{Interface: client}
+	for _, node := range nodes.Items {
+		description, err := describer.Describe("", node.Name, describe.DescriberSettings{ShowEvents: true, ChunkSize: 500})
+		if err != nil {
+			return buffer.Bytes(), err
+		}
+		buffer.WriteString(description)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes(), nil
+}
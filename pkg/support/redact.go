@@ -0,0 +1,68 @@
+// Copyright 2022 Antoine Martin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package support
+
+import (
+	"regexp"
+)
+
+// Redacted replaces the secrets in the collected files.
+const Redacted = "<redacted>"
+
+type redaction struct {
+	pattern *regexp.Regexp
+	// group is the index of the submatch to redact, 0 for the whole match.
+	group int
+}
+
+// redactions are the patterns of the secrets removed from the bundle.
+var redactions = []redaction{
+	// Private keys (ssh, TLS, ...)
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`), 0},
+	// age identities
+	{regexp.MustCompile(`AGE-SECRET-KEY-1[0-9A-Z]+`), 0},
+	// GitHub tokens
+	{regexp.MustCompile(`\b(?:gh[pousr]|github_pat)_[0-9A-Za-z_]{20,}`), 0},
+	// Bearer tokens and basic credentials in headers
+	{regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+([0-9A-Za-z\-._~+/]{8,}=*)`), 1},
+	// Credentials in URLs
+	{regexp.MustCompile(`://[^/\s:@]+:([^/\s@]+)@`), 1},
+	// Key values like token: xxx, client-key-data: xxx or PASSWORD=xxx
+	{regexp.MustCompile(`(?im)\b[\w.-]*(?:token|secret|password|passwd|private[_-]?key|client-key-data|api[_-]?key)["']?\s*[:=]\s*["']?([^\s"',}]+)`), 1},
+}
+
+// Redact removes the secrets from data. It returns the redacted data along
+// with the number of secrets removed.
+func Redact(data []byte) ([]byte, int) {
+	count := 0
+	for _, r := range redactions {
+		data = r.pattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			if r.group == 0 {
+				count++
+				return []byte(Redacted)
+			}
+			indexes := r.pattern.FindSubmatchIndex(match)
+			start, end := indexes[2*r.group], indexes[2*r.group+1]
+			if start < 0 || string(match[start:end]) == Redacted {
+				return match
+			}
+			count++
+			result := append([]byte{}, match[:start]...)
+			result = append(result, Redacted...)
+			return append(result, match[end:]...)
+		})
+	}
+	return data, count
+}
@@ -17,6 +17,7 @@ package wsl
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -119,13 +120,20 @@ type DistributionInformation struct {
 	IsDefault bool
 }
 
-func GetDistributions() (result map[string]DistributionInformation, err error) {
-
-	result = make(map[string]DistributionInformation)
-	if out, err := exec.Command(FindWSL(), "--list", "--verbose").Output(); err == nil {
+// ListVerbose returns the output of wsl --list --verbose, decoded from
+// UTF-16.
+func ListVerbose() (out []byte, err error) {
+	if out, err = exec.Command(FindWSL(), "--list", "--verbose").Output(); err == nil {
 		enc := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
 		out, _ = enc.NewDecoder().Bytes(out)
+	}
+	return
+}
+
+func GetDistributions() (result map[string]DistributionInformation, err error) {
 
+	result = make(map[string]DistributionInformation)
+	if out, err := ListVerbose(); err == nil {
 		log.WithField("out", string(out)).Trace("WSL output")
 		lines := strings.Split(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n")
 		log.WithField("lineCount", len(lines)).Trace("Lines")
@@ -213,6 +221,29 @@ func WslPipe(input string, distributionName string, arg ...string) error {
 	return cmd.Run()
 }
 
+// WslPipeReader runs the command in the distribution with input as its
+// standard input.
+func WslPipeReader(input io.Reader, distributionName string, arg ...string) error {
+	newArgs := []string{"-u", "root", "-d", distributionName}
+	newArgs = append(newArgs, arg...)
+	cmd := exec.Command(FindWSL(), newArgs...)
+	cmd.Stdin = input
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// WslCommandToWriter runs the command in the distribution and writes its
+// standard output to output.
+func WslCommandToWriter(output io.Writer, distributionName string, arg ...string) error {
+	newArgs := []string{"-u", "root", "-d", distributionName}
+	newArgs = append(newArgs, arg...)
+	cmd := exec.Command(FindWSL(), newArgs...)
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func WslCommand(distributionName string, arg ...string) ([]byte, error) {
 	newArgs := []string{"-u", "root", "-d", distributionName}
 	newArgs = append(newArgs, arg...)
@@ -271,6 +302,30 @@ func RegisterDistribution(name string, rootfs string, path string) (err error) {
 	return
 }
 
+// ExportDistribution saves the file system of the distribution in the tar
+// file at path.
+func ExportDistribution(name string, path string) (err error) {
+	fields := log.Fields{
+		"distrib_name": name,
+		"path":         path,
+		logger.TaskKey: "WSL Export",
+	}
+
+	log.WithFields(fields).Infof("Exporting %s to %s", name, path)
+
+	var out []byte
+	if out, err = exec.Command(FindWSL(), "--export", name, path).Output(); err == nil {
+		enc := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+		out, _ = enc.NewDecoder().Bytes(out)
+		log.WithFields(fields).WithField("output", out).Trace("result")
+	} else {
+		err = fmt.Errorf("error while exporting WSL distribution %s to %s: %v", name, path, err)
+	}
+	log.WithFields(fields).WithError(err).Info("Export done")
+
+	return
+}
+
 func FileExists(distributionName string, path string) (bool, error) {
 	script := fmt.Sprintf("[ -f \"%s\" ] && echo yes || echo no", path)
 	out, err := exec.Command(FindWSL(), "-d", distributionName, "-u", "root", "/bin/sh", "-c", script).Output()